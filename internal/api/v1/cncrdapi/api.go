@@ -34,6 +34,16 @@ type PaymentLinkRequestDto struct {
 	Currency string `json:"currency"`
 	// The applicable VAT, in percent.
 	VatRate float64 `json:"vat_rate"`
+	// Optional. Overrides the configured page title. Used as is, not as a template.
+	Title string `json:"title,omitempty"`
+	// Optional. Overrides the configured description. Used as is, not as a template.
+	Description string `json:"description,omitempty"`
+	// Optional. Overrides the configured purpose. Used as is, not as a template.
+	Purpose string `json:"purpose,omitempty"`
+	// Optional. Overrides the configured redirect after a successful payment. The host must be on the configured allowlist.
+	SuccessRedirect string `json:"success_redirect,omitempty"`
+	// Optional. Overrides the configured redirect after a failed payment. The host must be on the configured allowlist.
+	FailureRedirect string `json:"failure_redirect,omitempty"`
 }
 
 // PaymentLinkDto struct for PaymentLinkDto
@@ -56,6 +66,60 @@ type PaymentLinkDto struct {
 	VatRate float64 `json:"vat_rate"`
 	// The payment link.
 	Link string `json:"link"`
+	// Only used in responses. Our normalized payment status, one of open, pending, partially-paid, paid, partially-refunded, refunded.
+	Status string `json:"status"`
+	// Only used in responses. All payment attempts made using this link. Not included in list results.
+	Transactions []PaymentLinkTransactionDto `json:"transactions,omitempty"`
+}
+
+// PaymentLinkTransactionDto struct for PaymentLinkTransactionDto
+type PaymentLinkTransactionDto struct {
+	// The Concardis uuid of the transaction, also shown to the customer.
+	Uuid string `json:"uuid"`
+	// The time of the transaction, as reported by Concardis.
+	Time string `json:"time"`
+	// The amount of the transaction, in cents.
+	Amount int64 `json:"amount"`
+	// The Concardis status of the transaction, for example confirmed, declined, refunded.
+	Status string `json:"status"`
+	// The payment brand used, for example VISA or PayPal.
+	Brand string `json:"brand"`
+	// The name of the payment service provider used.
+	Psp string `json:"psp"`
+}
+
+// PaymentLinkListDto struct for PaymentLinkListDto
+type PaymentLinkListDto struct {
+	// The payment links on the requested page, newest first.
+	Paylinks []PaymentLinkListEntryDto `json:"paylinks"`
+	// The page number, starting at 1.
+	Page int `json:"page"`
+	// The maximum number of payment links per page.
+	PageSize int `json:"page_size"`
+	// The total number of payment links that match the filters, across all pages.
+	Total int64 `json:"total"`
+}
+
+// PaymentLinkListEntryDto struct for PaymentLinkListEntryDto
+type PaymentLinkListEntryDto struct {
+	// The id under which to manage the payment link.
+	Id uint `json:"id"`
+	// The badge number of the attendee.
+	DebitorId uint64 `json:"debitor_id"`
+	// The most recent status reported by Concardis.
+	Status string `json:"status"`
+	// The time the payment link was created.
+	CreatedAt string `json:"created_at"`
+	// The payment link.
+	Paylink PaymentLinkDto `json:"paylink"`
+}
+
+// PaymentLinkRefundRequestDto struct for PaymentLinkRefundRequestDto
+type PaymentLinkRefundRequestDto struct {
+	// The amount to refund, in cents. Leave out or set to 0 to refund everything that has not been refunded yet.
+	Amount int64 `json:"amount"`
+	// Free-text reason for the refund. Will be added to the comment of the payment service transaction.
+	Reason string `json:"reason"`
 }
 
 // WebhookEventDto struct for WebhookEventDto
@@ -66,6 +130,7 @@ type WebhookEventDto struct {
 // WebhookEventTransaction struct for WebhookEventTransaction
 type WebhookEventTransaction struct {
 	Id      int64                          `json:"id"` // id of the transaction (not the payment link)
+	Status  string                         `json:"status"`
 	Invoice WebhookEventTransactionInvoice `json:"invoice"`
 }
 
@@ -74,4 +139,79 @@ type WebhookEventTransactionInvoice struct {
 	Number           string `json:"number"` // "123456" -> test webhook payload
 	ReferenceId      string `json:"referenceId"`
 	PaymentRequestId int64  `json:"paymentRequestId"` // id of the payment link concerned
+	RefundedAmount   int64  `json:"refundedAmount"`
+}
+
+// TransactionReplayDto struct for TransactionReplayDto
+type TransactionReplayDto struct {
+	// One entry per reference id that had confirmed transactions in the replayed time window.
+	Results []TransactionReplayResultDto `json:"results"`
+	// True if the replay stopped early to answer before the server write timeout. Replay again to process the rest.
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// TransactionReplayResultDto struct for TransactionReplayResultDto
+type TransactionReplayResultDto struct {
+	// Internal reference number for this payment process.
+	ReferenceId string `json:"reference_id"`
+	// The id of the payment link that was paid.
+	PaylinkId uint `json:"paylink_id"`
+	// What happened during the replay, one of created, updated, skipped, failed, refused.
+	Outcome string `json:"outcome"`
+	// Optional English language details, for example the reason a transaction was skipped or failed.
+	Details string `json:"details,omitempty"`
+}
+
+// AdminFailureListDto struct for AdminFailureListDto
+type AdminFailureListDto struct {
+	// One entry per reference id with failed processing attempts in the requested time window, most recent first.
+	Failures []AdminFailureDto `json:"failures"`
+}
+
+// AdminFailureDto struct for AdminFailureDto
+type AdminFailureDto struct {
+	// Internal reference number for this payment process. May be empty if the failure happened before it was known.
+	ReferenceId string `json:"reference_id"`
+	// The id of the payment link concerned, 0 if not known.
+	PaylinkId uint `json:"paylink_id"`
+	// The message of the most recent error.
+	LastError string `json:"last_error"`
+	// The time of the most recent error.
+	LastErrorAt string `json:"last_error_at"`
+	// All protocol entries for this reference id, oldest first.
+	Protocol []ProtocolEntryDto `json:"protocol"`
+}
+
+// ProtocolEntryDto struct for ProtocolEntryDto
+type ProtocolEntryDto struct {
+	// The time the entry was written.
+	Timestamp string `json:"timestamp"`
+	// What kind of entry this is, for example success, error, duplicate, refunded, rerun.
+	Kind string `json:"kind"`
+	// Short description of the step that was performed.
+	Message string `json:"message"`
+	// Optional English language details.
+	Details string `json:"details,omitempty"`
+	// The request id of the request that caused the entry, to find the matching logs.
+	RequestId string `json:"requestid,omitempty"`
+}
+
+// AdminRerunRequestDto struct for AdminRerunRequestDto
+type AdminRerunRequestDto struct {
+	// The id of the payment link to process again. Set either this or reference_id.
+	PaylinkId uint `json:"paylink_id"`
+	// The reference id to process again. Set either this or paylink_id.
+	ReferenceId string `json:"reference_id"`
+}
+
+// AdminRerunResultDto struct for AdminRerunResultDto
+type AdminRerunResultDto struct {
+	// Internal reference number for this payment process.
+	ReferenceId string `json:"reference_id"`
+	// The id of the payment link that was processed.
+	PaylinkId uint `json:"paylink_id"`
+	// What happened during the re-run, one of success, failed.
+	Outcome string `json:"outcome"`
+	// Optional English language details, for example the reason processing failed.
+	Details string `json:"details,omitempty"`
 }
@@ -0,0 +1,27 @@
+package entity
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	OutboxStatusPending = "pending"
+	OutboxStatusDone    = "done"
+	OutboxStatusDead    = "dead"
+)
+
+// OutboxEvent is a received webhook event that is waiting to be processed by the background worker.
+type OutboxEvent struct {
+	gorm.Model
+	TransactionId int64
+	ReferenceId   string    `gorm:"type:varchar(80) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL;index:cncrd_outbox_ref_id_idx"`
+	ApiId         uint      `gorm:"index:cncrd_outbox_api_id_idx"`
+	Payload       string    `gorm:"type:longtext CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"` // the webhook event as json
+	Status        string    `gorm:"type:varchar(16) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL;index:cncrd_outbox_due_idx,priority:1"`
+	NextAttemptAt time.Time `gorm:"NOT NULL;index:cncrd_outbox_due_idx,priority:2"`
+	Attempts      int
+	LastError     string `gorm:"type:longtext CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"`
+	RequestId     string `gorm:"type:varchar(8) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"` // of the webhook call that delivered the event
+}
@@ -0,0 +1,28 @@
+package entity
+
+import (
+	"gorm.io/gorm"
+)
+
+// Paylink is our local copy of a payment link created at Concardis.
+//
+// The Concardis api does not return title, description, vat rate or debitor when querying a payment link,
+// so we keep what we sent them, and track the most recent status reported to us.
+type Paylink struct {
+	gorm.Model
+	ApiId       uint    `gorm:"NOT NULL;uniqueIndex:cncrd_paylink_api_id_idx"` // the Concardis payment link id
+	ReferenceId string  `gorm:"type:varchar(80) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL;index:cncrd_paylink_ref_id_idx"`
+	DebitorId   uint64  `gorm:"NOT NULL;index:cncrd_paylink_debitor_id_idx"`
+	Title       string  `gorm:"type:varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"`
+	Description string  `gorm:"type:varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"`
+	Purpose     string  `gorm:"type:varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"`
+	AmountDue   int64   // in cents
+	AmountPaid  int64   // in cents
+	Currency    string  `gorm:"type:varchar(3) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL"`
+	VatRate     float64 // in %
+	Link        string  `gorm:"type:varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"`
+	Status      string  `gorm:"type:varchar(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL"`
+	// IdempotencyKey identifies the create request, so a repeated request returns this paylink instead of creating another one.
+	// It is nil if the caller did not supply a key, then repeated requests are recognized by reference id.
+	IdempotencyKey *string `gorm:"type:varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;uniqueIndex:cncrd_paylink_idem_key_idx"`
+}
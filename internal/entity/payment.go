@@ -0,0 +1,17 @@
+package entity
+
+import (
+	"gorm.io/gorm"
+)
+
+// PaymentBooking remembers that a confirmed Concardis transaction has been booked in the payment service.
+//
+// A paylink can have several confirmed transactions (partial payments, a successful attempt after a declined one),
+// and this is how we make sure each of them is booked exactly once.
+type PaymentBooking struct {
+	gorm.Model
+	ReferenceId   string `gorm:"type:varchar(80) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL;index:cncrd_payment_ref_id_idx"`
+	ApiId         uint
+	TransactionId int64 `gorm:"NOT NULL;uniqueIndex:cncrd_payment_tx_id_idx"`
+	BookedAmount  int64 // in cents
+}
@@ -0,0 +1,19 @@
+package entity
+
+import (
+	"gorm.io/gorm"
+)
+
+// RefundBooking remembers how much of a Concardis transaction has been booked as a refund in the payment service.
+//
+// Refunds can be triggered through our api, or reported by the webhook (back office refunds, chargebacks),
+// and this is how we make sure each refunded cent is only booked once.
+type RefundBooking struct {
+	gorm.Model
+	ReferenceId   string `gorm:"type:varchar(80) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL;index:cncrd_refund_ref_id_idx"`
+	ApiId         uint
+	TransactionId int64  `gorm:"NOT NULL;uniqueIndex:cncrd_refund_tx_id_idx"`
+	BookedAmount  int64  // in cents, positive, sum of all refunds booked so far
+	Status        string `gorm:"type:varchar(20)"` // pending until the bank confirms the last refund, then valid (empty for old bookings)
+	PendingTxId   string `gorm:"type:varchar(80)"` // payment service transaction_identifier of the pending refund
+}
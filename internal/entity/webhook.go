@@ -0,0 +1,26 @@
+package entity
+
+import (
+	"gorm.io/gorm"
+)
+
+const (
+	WebhookOutcomeProcessing = "processing"
+	WebhookOutcomeSuccess    = "success"
+	WebhookOutcomeError      = "error"
+)
+
+// ProcessedWebhook records a webhook delivery, so repeated deliveries of the same event are not processed again.
+//
+// A delivery is identified by transaction id, status and refunded amount, because successive partial refunds
+// are reported for the same transaction id with the same status.
+type ProcessedWebhook struct {
+	gorm.Model
+	TransactionId  int64  `gorm:"NOT NULL;uniqueIndex:cncrd_webhook_delivery_idx"`
+	Status         string `gorm:"type:varchar(32) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL;uniqueIndex:cncrd_webhook_delivery_idx"`
+	RefundedAmount int64  `gorm:"NOT NULL;uniqueIndex:cncrd_webhook_delivery_idx"`
+	ReferenceId    string `gorm:"type:varchar(80) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL;index:cncrd_webhook_ref_id_idx"`
+	ApiId          uint
+	Outcome        string `gorm:"type:varchar(16) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;NOT NULL"` // processing, success, error
+	RequestId      string `gorm:"type:varchar(8) CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"`           // of the last delivery that was processed
+}
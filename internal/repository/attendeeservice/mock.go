@@ -32,7 +32,16 @@ func (m *MockImpl) GetAttendee(ctx context.Context, id uint) (AttendeeDto, error
 	}
 
 	attendee := AttendeeDto{
-		Email: "jsquirrel_github_9a6d@packetloss.de",
+		Id:                   id,
+		Nickname:             "Squirrel",
+		FirstName:            "John",
+		LastName:             "Squirrel",
+		Street:               "Teststraße 24",
+		Zip:                  "12345",
+		City:                 "Berlin",
+		Country:              "DE",
+		Email:                "jsquirrel_github_9a6d@packetloss.de",
+		RegistrationLanguage: "de-DE",
 	}
 
 	return attendee, nil
@@ -105,6 +105,21 @@ func signRequest(unsignedRequest string, instanceApiSecret string) string {
 	}
 }
 
+// WebhookSignature calculates the signature expected for a webhook call, which is the
+// base64 encoded hmac sha256 of the raw request body, keyed with the instance api secret.
+//
+// Unlike signRequest this ignores FixedSignatureValue, so contract tests cannot accidentally weaken it.
+func WebhookSignature(body []byte) string {
+	authenticator := hmac.New(sha256.New, []byte(config.ConcardisInstanceApiSecret()))
+	authenticator.Write(body)
+	return base64.StdEncoding.EncodeToString(authenticator.Sum([]byte{}))
+}
+
+// VerifyWebhookSignature compares the received signature to the expected one in constant time.
+func VerifyWebhookSignature(body []byte, signature string) bool {
+	return hmac.Equal([]byte(WebhookSignature(body)), []byte(signature))
+}
+
 func constructBufferWithEncoding(request PaymentLinkCreateRequest, encode func(key string, value string) string) string {
 	var buf strings.Builder
 	buf.WriteString(encode("title", request.Title) + "&")
@@ -128,6 +143,16 @@ func constructBufferWithEncoding(request PaymentLinkCreateRequest, encode func(k
 	// terms is selected by default if not specified
 	buf.WriteString(encode("fields[email][mandatory]", "1") + "&")
 	buf.WriteString(encode("fields[email][defaultValue]", request.Email))
+	for _, field := range request.Fields {
+		buf.WriteString("&" + encode(fmt.Sprintf("fields[%s][active]", field.Name), flag(field.Active)))
+		buf.WriteString("&" + encode(fmt.Sprintf("fields[%s][mandatory]", field.Name), flag(field.Mandatory)))
+		if field.DefaultValue != "" {
+			buf.WriteString("&" + encode(fmt.Sprintf("fields[%s][defaultValue]", field.Name), field.DefaultValue))
+		}
+	}
+	if request.Language != "" {
+		buf.WriteString("&" + encode("language", request.Language))
+	}
 	if request.SuccessRedirectUrl != "" {
 		buf.WriteString("&" + encode("successRedirectUrl", request.SuccessRedirectUrl))
 	}
@@ -137,6 +162,13 @@ func constructBufferWithEncoding(request PaymentLinkCreateRequest, encode func(k
 	return buf.String()
 }
 
+func flag(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
 func buildCreateRequestBody(ctx context.Context, request PaymentLinkCreateRequest) string {
 	// Note: the Concardis PayLink API uses PathEncoding for the Body,
 	// but QueryEncoding to calculate the signature. (don't ask)
@@ -251,6 +283,9 @@ func (i *Impl) QueryPaymentLink(ctx context.Context, id uint) (PaymentLinkQueryR
 	if err := i.performWithRawResponseLogging(ctx, "QueryPaymentLink", "", id, http.MethodGet, requestUrl, requestBody, &response); err != nil {
 		return PaymentLinkQueryResponse{}, err
 	}
+	if response.Status == http.StatusNotFound {
+		return PaymentLinkQueryResponse{}, NoSuchID404Error
+	}
 	if response.Status >= 300 {
 		return PaymentLinkQueryResponse{}, fmt.Errorf("unexpected response status %d", response.Status)
 	}
@@ -278,6 +313,9 @@ func (i *Impl) DeletePaymentLink(ctx context.Context, id uint) error {
 	if err := i.client.Perform(ctx, http.MethodDelete, requestUrl, requestBody, &response); err != nil {
 		return err
 	}
+	if response.Status == http.StatusNotFound {
+		return NoSuchID404Error
+	}
 	if response.Status >= 300 {
 		return fmt.Errorf("unexpected response status %d", response.Status)
 	}
@@ -287,7 +325,121 @@ func (i *Impl) DeletePaymentLink(ctx context.Context, id uint) error {
 	return nil
 }
 
+type transactionsLowlevelResponseBody struct {
+	Status string            `json:"status"`
+	Data   []TransactionData `json:"data"`
+}
+
+// the transaction api returns at most this many entries per call, so we need to page through the results
+const transactionsPageSize = 100
+
+// transactionsMaxPages limits how many pages we fetch for one query. If there are more transactions
+// in the time window, we return those we have, so the caller can still work with them.
+const transactionsMaxPages = 100
+
+const transactionsTimeFormat = "2006-01-02 15:04:05"
+
+func constructTransactionsBufferWithEncoding(timeGreaterThan time.Time, timeLessThan time.Time, offset int, encode func(key string, value string) string) string {
+	var buf strings.Builder
+	buf.WriteString(encode("filterDatetimeUtcGreaterThan", timeGreaterThan.UTC().Format(transactionsTimeFormat)) + "&")
+	buf.WriteString(encode("filterDatetimeUtcLessThan", timeLessThan.UTC().Format(transactionsTimeFormat)) + "&")
+	buf.WriteString(encode("offset", fmt.Sprintf("%d", offset)) + "&")
+	buf.WriteString(encode("limit", fmt.Sprintf("%d", transactionsPageSize)))
+	return buf.String()
+}
+
+func buildTransactionsRequestBody(timeGreaterThan time.Time, timeLessThan time.Time, offset int) string {
+	// same encoding rules as for create, see buildCreateRequestBody
+	pathEncodedPayload := constructTransactionsBufferWithEncoding(timeGreaterThan, timeLessThan, offset, pathEncode)
+	queryEncodedPayloadForSigning := constructTransactionsBufferWithEncoding(timeGreaterThan, timeLessThan, offset, queryEncode)
+
+	signature := signRequest(queryEncodedPayloadForSigning, config.ConcardisInstanceApiSecret())
+	return pathEncodedPayload + "&" + queryEncode(signatureKey, signature)
+}
+
 func (i *Impl) QueryTransactions(ctx context.Context, timeGreaterThan time.Time, timeLessThan time.Time) ([]TransactionData, error) {
-	//TODO implement me
-	panic("implement me")
+	requestUrl := fmt.Sprintf("%s/v1.0/Transaction/?instance=%s", i.baseUrl, url.QueryEscape(i.instanceName))
+	result := make([]TransactionData, 0)
+	var previousPage []TransactionData
+
+	for page := 0; page < transactionsMaxPages; page++ {
+		offset := page * transactionsPageSize
+		requestBody := buildTransactionsRequestBody(timeGreaterThan, timeLessThan, offset)
+		bodyDto := transactionsLowlevelResponseBody{}
+		response := aurestclientapi.ParsedResponse{
+			Body: &bodyDto,
+		}
+		if err := i.performWithRawResponseLogging(ctx, "QueryTransactions", "", 0, http.MethodGet, requestUrl, requestBody, &response); err != nil {
+			return nil, DownstreamError
+		}
+		if response.Status >= 300 {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("QueryTransactions unexpected response status %d", response.Status)
+			return nil, DownstreamError
+		}
+		if bodyDto.Status != "success" {
+			return nil, NotSuccessful
+		}
+
+		if sameTransactionIds(previousPage, bodyDto.Data) {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("QueryTransactions received the same page again for offset %d, giving up", offset)
+			return nil, DownstreamError
+		}
+		previousPage = bodyDto.Data
+
+		result = append(result, bodyDto.Data...)
+		if len(bodyDto.Data) < transactionsPageSize {
+			return result, nil
+		}
+	}
+
+	aulogging.Logger.Ctx(ctx).Warn().Printf("QueryTransactions still receiving full pages after %d pages, returning only the first %d transactions", transactionsMaxPages, len(result))
+	return result, nil
+}
+
+func sameTransactionIds(previous []TransactionData, current []TransactionData) bool {
+	if len(previous) == 0 || len(previous) != len(current) {
+		return false
+	}
+	for n := range previous {
+		if previous[n].ID != current[n].ID {
+			return false
+		}
+	}
+	return true
+}
+
+func buildRefundRequestBody(amount int64) string {
+	if amount == 0 {
+		// refunds the full amount
+		return buildEmptyRequestBody()
+	}
+	payload := queryEncode("amount", fmt.Sprintf("%d", amount))
+	signature := signRequest(payload, config.ConcardisInstanceApiSecret())
+	return payload + "&" + queryEncode(signatureKey, signature)
+}
+
+func (i *Impl) RefundTransaction(ctx context.Context, transactionId int64, amount int64) (TransactionData, error) {
+	requestUrl := fmt.Sprintf("%s/v1.0/Transaction/%d/refund/?instance=%s", i.baseUrl, transactionId, url.QueryEscape(i.instanceName))
+	requestBody := buildRefundRequestBody(amount)
+	bodyDto := transactionsLowlevelResponseBody{}
+	response := aurestclientapi.ParsedResponse{
+		Body: &bodyDto,
+	}
+	if err := i.performWithRawResponseLogging(ctx, "RefundTransaction", "", 0, http.MethodPost, requestUrl, requestBody, &response); err != nil {
+		return TransactionData{}, DownstreamError
+	}
+	if response.Status == http.StatusNotFound {
+		return TransactionData{}, NoSuchID404Error
+	}
+	if response.Status >= 300 {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("RefundTransaction unexpected response status %d", response.Status)
+		return TransactionData{}, DownstreamError
+	}
+	if bodyDto.Status != "success" {
+		return TransactionData{}, NotSuccessful
+	}
+	if len(bodyDto.Data) != 1 {
+		return TransactionData{}, fmt.Errorf("unexpected number of response body data array entries %d", len(bodyDto.Data))
+	}
+	return bodyDto.Data[0], nil
 }
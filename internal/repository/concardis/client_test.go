@@ -1,10 +1,16 @@
 package concardis
 
 import (
+	"context"
 	"crypto/hmac"
 	"encoding/base64"
+	"encoding/json"
+	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
 	"github.com/stretchr/testify/require"
+	"net/http"
 	"testing"
+	"time"
 )
 
 func TestSignRequest(t *testing.T) {
@@ -32,3 +38,99 @@ func TestSignEmpty(t *testing.T) {
 
 	require.True(t, hmac.Equal(decodedSig, decodedCompare))
 }
+
+func TestConstructBufferWithFields(t *testing.T) {
+	request := PaymentLinkCreateRequest{
+		Title:    "title",
+		Amount:   390,
+		VatRate:  19,
+		Currency: "EUR",
+		Email:    "me@example.com",
+		Fields: []PaymentLinkField{
+			{Name: "forename", Active: true, Mandatory: true, DefaultValue: "John"},
+			{Name: "street", Active: true},
+		},
+	}
+
+	actual := constructBufferWithEncoding(request, queryEncode)
+
+	require.Equal(t, "title=title&description=&psp=0&referenceId=&purpose=&amount=390&vatRate=19.0&currency=EUR&sku=&preAuthorization=0&reservation=0"+
+		"&fields%5Bemail%5D%5Bmandatory%5D=1&fields%5Bemail%5D%5BdefaultValue%5D=me%40example.com"+
+		"&fields%5Bforename%5D%5Bactive%5D=1&fields%5Bforename%5D%5Bmandatory%5D=1&fields%5Bforename%5D%5BdefaultValue%5D=John"+
+		"&fields%5Bstreet%5D%5Bactive%5D=1&fields%5Bstreet%5D%5Bmandatory%5D=0", actual)
+}
+
+// fullPageClient always answers with a full page of transactions, starting with the id returned by firstId.
+type fullPageClient struct {
+	calls   int
+	firstId func(call int) int64
+}
+
+func (c *fullPageClient) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	body := transactionsLowlevelResponseBody{Status: "success"}
+	for n := 0; n < transactionsPageSize; n++ {
+		body.Data = append(body.Data, TransactionData{ID: c.firstId(c.calls) + int64(n)})
+	}
+	c.calls++
+
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	*(response.Body.(**[]byte)) = &raw
+	response.Status = http.StatusOK
+	return nil
+}
+
+func tstQueryTransactions(client *fullPageClient) ([]TransactionData, error) {
+	return tstTestingClient(client).QueryTransactions(context.Background(), time.Now().Add(-time.Hour), time.Now())
+}
+
+func tstTestingClient(client aurestclientapi.Client) ConcardisDownstream {
+	config.LoadTestingConfigurationFromPathOrAbort("../../../test/resources/testconfig.yaml")
+	config.Configuration().Logging.FullRequests = false
+	return NewTestingClient(client)
+}
+
+func TestQueryTransactions_OffsetIgnored(t *testing.T) {
+	client := &fullPageClient{firstId: func(call int) int64 { return 1 }}
+
+	_, err := tstQueryTransactions(client)
+
+	require.Equal(t, DownstreamError, err)
+	require.Equal(t, 2, client.calls)
+}
+
+func TestQueryTransactions_TooManyPages(t *testing.T) {
+	client := &fullPageClient{firstId: func(call int) int64 { return int64(call * transactionsPageSize) }}
+
+	actual, err := tstQueryTransactions(client)
+
+	require.Nil(t, err)
+	require.Equal(t, transactionsMaxPages, client.calls)
+	require.Equal(t, transactionsMaxPages*transactionsPageSize, len(actual))
+}
+
+// notFoundClient answers every request with 404, as Concardis does for unknown payment links.
+type notFoundClient struct{}
+
+func (c *notFoundClient) Perform(ctx context.Context, method string, requestUrl string, requestBody interface{}, response *aurestclientapi.ParsedResponse) error {
+	if raw, ok := response.Body.(**[]byte); ok {
+		body := []byte(`{"status":"error","message":"Invoice not found"}`)
+		*raw = &body
+	}
+	response.Status = http.StatusNotFound
+	return nil
+}
+
+func TestQueryPaymentLink_NotFound(t *testing.T) {
+	_, err := tstTestingClient(&notFoundClient{}).QueryPaymentLink(context.Background(), 42)
+
+	require.Equal(t, NoSuchID404Error, err)
+}
+
+func TestDeletePaymentLink_NotFound(t *testing.T) {
+	err := tstTestingClient(&notFoundClient{}).DeletePaymentLink(context.Background(), 42)
+
+	require.Equal(t, NoSuchID404Error, err)
+}
@@ -12,6 +12,7 @@ type ConcardisDownstream interface {
 	DeletePaymentLink(ctx context.Context, id uint) error
 
 	QueryTransactions(ctx context.Context, timeGreaterThan time.Time, timeLessThan time.Time) ([]TransactionData, error)
+	RefundTransaction(ctx context.Context, transactionId int64, amount int64) (TransactionData, error) // amount in cents, 0 for everything. Returns the transaction in its new status
 }
 
 var (
@@ -39,10 +40,20 @@ type PaymentLinkCreateRequest struct {
 	SKU         string  `json:"sku"`
 	Email       string  `json:"email"`
 
+	Fields   []PaymentLinkField `json:"fields"`   // additional fields on the payment page, email is always included
+	Language string             `json:"language"` // optional - ISO 639-1 language of the payment page, e.g. de
+
 	SuccessRedirectUrl string `json:"successRedirectUrl"` // optional - leave empty
 	FailedRedirectUrl  string `json:"failedRedirectUrl"`  // optional - leave empty
 }
 
+type PaymentLinkField struct {
+	Name         string `json:"name"` // one of forename, surname, street, postcode, place, country
+	Active       bool   `json:"active"`
+	Mandatory    bool   `json:"mandatory"`
+	DefaultValue string `json:"defaultValue"` // optional - leave empty
+}
+
 type PaymentLinkCreated struct {
 	ID          uint   `json:"id"`
 	ReferenceID string `json:"referenceId"`
@@ -82,15 +93,15 @@ type PaymentLinkInvoice struct {
 // Payment aborted by customer (status: cancelled) => log info and ignore
 // Payment declined (status: declined) => log info and ignore
 //
-// Order placed (status: waiting) => log warn and notify
+// Order placed (status: waiting) => book as pending
 //
-// Pre-authorization successful (status: authorized) => log error and notify
-// Payment (partial-) refunded by merchant (status: refunded / partially-refunded) => log error and notify
+// Pre-authorization successful (status: authorized) => book as pending
+// Payment (partial-) refunded by merchant (status: refunded / partially-refunded) => book refund unless already booked
 // Refund pending (status: refund_pending) (for transactions for which the refund has been initialized but not yet confirmed by the bank) => log error and notify
-// Chargeback by card holder (status: chargeback) => log error and notify
+// Chargeback by card holder (status: chargeback) => book refund unless already booked
 // Technical error (status: error) => log error and notify
-// Uncaptured (status: uncaptured) (only with PSP Clearhaus Acquiring) => log error and notify
-// Reserved (status: reserved) (??? not explained in docs) => log error and notify
+// Uncaptured (status: uncaptured) (only with PSP Clearhaus Acquiring) => book as pending
+// Reserved (status: reserved) (??? not explained in docs) => book as pending
 
 type TransactionData struct {
 	ID          int64   `json:"id"`
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,13 +16,21 @@ type Mock interface {
 	Reset()
 	Recording() []string
 	SimulateError(err error)
+	SimulateLatency(latency time.Duration)
+	SimulateRefundPending(pending bool)
 	InjectTransaction(tx TransactionData)
 	ManipulateStatus(paylinkId uint, status string)
+	ManipulateTransactions(paylinkId uint, status string, refundedAmount int64)
+	ManipulatePayment(paylinkId uint, brand string, psp string)
+	ManipulateTransaction(paylinkId uint, transactionId int64, status string)
 }
 
 type mockImpl struct {
+	mu            sync.Mutex
 	recording     []string
 	simulateError error
+	latency       time.Duration
+	refundPending bool
 	simulatorData map[uint]PaymentLinkQueryResponse
 	idSequence    uint32
 	simulatorTx   []TransactionData
@@ -31,7 +40,7 @@ func newMock() Mock {
 	simData := make(map[uint]PaymentLinkQueryResponse)
 	// used by some testcases
 	simData[42] = PaymentLinkQueryResponse{
-		ID:          42,
+		ID:          424242, // like the real api, this is not the payment link id
 		Status:      "confirmed",
 		ReferenceID: "221216-122218-000001",
 		Link:        constructSimulatedPaylink("42"),
@@ -44,8 +53,12 @@ func newMock() Mock {
 			{
 				Transactions: []TransactionData{
 					{
-						Time: "2023-01-08 12:22:58",
-						UUID: "d3adb33f",
+						ID:          4711,
+						Time:        "2023-01-08 12:22:58",
+						UUID:        "d3adb33f",
+						Amount:      390,
+						Status:      "confirmed",
+						ReferenceID: "221216-122218-000001",
 					},
 				},
 			},
@@ -65,8 +78,84 @@ func newMock() Mock {
 			{
 				Transactions: []TransactionData{
 					{
-						Time: "2023-01-08 12:22:58",
-						UUID: "d3adb33f",
+						ID:          4712,
+						Time:        "2023-01-08 12:22:58",
+						UUID:        "d3adb33f",
+						Amount:      390,
+						Status:      "confirmed",
+						ReferenceID: "230001-122218-000001",
+					},
+				},
+			},
+		},
+	}
+	// a declined attempt, followed by a successful one
+	simData[43] = PaymentLinkQueryResponse{
+		ID:          43,
+		Status:      "confirmed",
+		ReferenceID: "221216-122218-000002",
+		Link:        constructSimulatedPaylink("43"),
+		Name:        "Online-Shop payment #003",
+		Purpose:     map[string]string{"1": "some payment purpose"},
+		Amount:      390,
+		Currency:    "EUR",
+		CreatedAt:   1418392958,
+		Invoices: []PaymentLinkInvoice{
+			{
+				Transactions: []TransactionData{
+					{
+						ID:          4713,
+						Time:        "2023-01-07 10:11:12",
+						UUID:        "0ddba11",
+						Amount:      390,
+						Status:      "declined",
+						ReferenceID: "221216-122218-000002",
+					},
+					{
+						ID:          4714,
+						Time:        "2023-01-09 14:15:16",
+						UUID:        "c0ffee",
+						Amount:      390,
+						Status:      "confirmed",
+						ReferenceID: "221216-122218-000002",
+					},
+				},
+			},
+		},
+	}
+	// two partial payments
+	simData[44] = PaymentLinkQueryResponse{
+		ID:          444444, // like the real api, this is not the payment link id
+		Status:      "confirmed",
+		ReferenceID: "221216-122218-000003",
+		Link:        constructSimulatedPaylink("44"),
+		Name:        "Online-Shop payment #004",
+		Purpose:     map[string]string{"1": "some payment purpose"},
+		Amount:      390,
+		Currency:    "EUR",
+		CreatedAt:   1418392958,
+		Invoices: []PaymentLinkInvoice{
+			{
+				Transactions: []TransactionData{
+					{
+						ID:          4715,
+						Time:        "2023-01-08 12:22:58",
+						UUID:        "ba5eba11",
+						Amount:      200,
+						Status:      "confirmed",
+						ReferenceID: "221216-122218-000003",
+					},
+				},
+			},
+			{
+				Transactions: []TransactionData{
+					{
+						ID:          4716,
+						Time:        "2023-01-10 08:09:10",
+						UUID:        "f00dfeed",
+						Amount:      190,
+						Status:      "confirmed",
+						ReferenceID: "221216-122218-000003",
 					},
 				},
 			},
@@ -93,6 +182,9 @@ func (m *mockImpl) CreatePaymentLink(ctx context.Context, request PaymentLinkCre
 	if m.simulateError != nil {
 		return PaymentLinkCreated{}, m.simulateError
 	}
+	time.Sleep(m.latency)
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.recording = append(m.recording, fmt.Sprintf("CreatePaymentLink %v", request))
 
 	newId := uint(atomic.AddUint32(&m.idSequence, 1))
@@ -103,7 +195,7 @@ func (m *mockImpl) CreatePaymentLink(ctx context.Context, request PaymentLinkCre
 	}
 	data := PaymentLinkQueryResponse{
 		ID:          newId,
-		Status:      "confirmed",
+		Status:      "waiting",
 		ReferenceID: request.ReferenceId,
 		Link:        response.Link,
 		Name:        "Online-Shop payment #001",
@@ -123,6 +215,8 @@ func (m *mockImpl) QueryPaymentLink(ctx context.Context, id uint) (PaymentLinkQu
 	if m.simulateError != nil {
 		return PaymentLinkQueryResponse{}, m.simulateError
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.recording = append(m.recording, fmt.Sprintf("QueryPaymentLink %d", id))
 
 	copiedData, ok := m.simulatorData[id]
@@ -136,6 +230,8 @@ func (m *mockImpl) DeletePaymentLink(ctx context.Context, id uint) error {
 	if m.simulateError != nil {
 		return m.simulateError
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.recording = append(m.recording, fmt.Sprintf("DeletePaymentLink %d", id))
 
 	_, ok := m.simulatorData[id]
@@ -150,22 +246,94 @@ func (m *mockImpl) QueryTransactions(ctx context.Context, timeGreaterThan time.T
 	if m.simulateError != nil {
 		return []TransactionData{}, m.simulateError
 	}
-	m.recording = append(m.recording, fmt.Sprintf("QueryTransactions %v <= t <= %v", timeGreaterThan, timeLessThan))
+	m.recording = append(m.recording, fmt.Sprintf("QueryTransactions %v < t < %v", timeGreaterThan.UTC().Format(transactionsTimeFormat), timeLessThan.UTC().Format(transactionsTimeFormat)))
 
-	copiedTransactions := make([]TransactionData, len(m.simulatorTx))
-	for k, v := range m.simulatorTx {
-		// time matching not implemented because it interferes with our tests
-		copiedTransactions[k] = v
+	copiedTransactions := make([]TransactionData, 0)
+	for _, v := range m.simulatorTx {
+		txTime, err := time.Parse(transactionsTimeFormat, v.Time)
+		if err != nil {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("mock skipping transaction id=%d with unparseable time %s", v.ID, v.Time)
+			continue
+		}
+		if txTime.After(timeGreaterThan) && txTime.Before(timeLessThan) {
+			copiedTransactions = append(copiedTransactions, v)
+		}
 	}
 	return copiedTransactions, nil
 }
 
+func (m *mockImpl) RefundTransaction(ctx context.Context, transactionId int64, amount int64) (TransactionData, error) {
+	if m.simulateError != nil {
+		return TransactionData{}, m.simulateError
+	}
+	time.Sleep(m.latency)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recording = append(m.recording, fmt.Sprintf("RefundTransaction %d %d", transactionId, amount))
+
+	refund := func(tx TransactionData) TransactionData {
+		if amount == 0 {
+			tx.Invoice.RefundedAmount = tx.Amount
+		} else {
+			tx.Invoice.RefundedAmount += amount
+		}
+		if m.refundPending {
+			tx.Status = "refund_pending"
+		} else if tx.Invoice.RefundedAmount >= tx.Amount {
+			tx.Status = "refunded"
+		} else {
+			tx.Status = "partially-refunded"
+		}
+		return tx
+	}
+
+	found := false
+	var result TransactionData
+	for k, tx := range m.simulatorTx {
+		if tx.ID == transactionId {
+			result = refund(tx)
+			m.simulatorTx[k] = result
+			found = true
+		}
+	}
+	for id, paylink := range m.simulatorData {
+		// copy, because earlier query responses share the slices with the map entry
+		copiedInvoices := make([]PaymentLinkInvoice, len(paylink.Invoices))
+		for invIdx, invoice := range paylink.Invoices {
+			copiedTransactions := make([]TransactionData, len(invoice.Transactions))
+			for txIdx, tx := range invoice.Transactions {
+				if tx.ID == transactionId {
+					tx = refund(tx)
+					result = tx
+					found = true
+				}
+				copiedTransactions[txIdx] = tx
+			}
+			invoice.Transactions = copiedTransactions
+			copiedInvoices[invIdx] = invoice
+		}
+		paylink.Invoices = copiedInvoices
+		m.simulatorData[id] = paylink
+	}
+	if !found {
+		return TransactionData{}, NoSuchID404Error
+	}
+
+	aulogging.Logger.Ctx(ctx).Info().Printf("mock refunding transaction id=%d amount=%d refunded=%d", transactionId, amount, result.Invoice.RefundedAmount)
+
+	return result, nil
+}
+
 func (m *mockImpl) Reset() {
 	m.recording = make([]string, 0)
 	m.simulateError = nil
+	m.latency = 0
+	m.refundPending = false
 }
 
 func (m *mockImpl) Recording() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.recording
 }
 
@@ -173,6 +341,16 @@ func (m *mockImpl) SimulateError(err error) {
 	m.simulateError = err
 }
 
+// SimulateLatency delays payment link creation and refunds, so tests can send concurrent requests while one is in flight.
+func (m *mockImpl) SimulateLatency(latency time.Duration) {
+	m.latency = latency
+}
+
+// SimulateRefundPending makes refunds wait for the bank, as if they had not been confirmed yet.
+func (m *mockImpl) SimulateRefundPending(pending bool) {
+	m.refundPending = pending
+}
+
 func (m *mockImpl) InjectTransaction(tx TransactionData) {
 	newId := int64(atomic.AddUint32(&m.idSequence, 1))
 	tx.ID = newId
@@ -202,3 +380,69 @@ func (m *mockImpl) ManipulateStatus(paylinkId uint, status string) {
 	copiedData.Status = status
 	m.simulatorData[paylinkId] = copiedData
 }
+
+// ManipulateTransaction sets the status of a single transaction of the paylink, leaving the paylink status alone.
+func (m *mockImpl) ManipulateTransaction(paylinkId uint, transactionId int64, status string) {
+	copiedData, ok := m.simulatorData[paylinkId]
+	if !ok {
+		return
+	}
+	copiedInvoices := make([]PaymentLinkInvoice, len(copiedData.Invoices))
+	for invIdx, invoice := range copiedData.Invoices {
+		copiedTransactions := make([]TransactionData, len(invoice.Transactions))
+		for txIdx, tx := range invoice.Transactions {
+			if tx.ID == transactionId {
+				tx.Status = status
+			}
+			copiedTransactions[txIdx] = tx
+		}
+		invoice.Transactions = copiedTransactions
+		copiedInvoices[invIdx] = invoice
+	}
+	copiedData.Invoices = copiedInvoices
+	m.simulatorData[paylinkId] = copiedData
+}
+
+// ManipulatePayment sets the card brand and psp of all transactions of the paylink.
+func (m *mockImpl) ManipulatePayment(paylinkId uint, brand string, psp string) {
+	copiedData, ok := m.simulatorData[paylinkId]
+	if !ok {
+		return
+	}
+	copiedInvoices := make([]PaymentLinkInvoice, len(copiedData.Invoices))
+	for invIdx, invoice := range copiedData.Invoices {
+		copiedTransactions := make([]TransactionData, len(invoice.Transactions))
+		for txIdx, tx := range invoice.Transactions {
+			tx.Payment.Brand = brand
+			tx.Psp = psp
+			copiedTransactions[txIdx] = tx
+		}
+		invoice.Transactions = copiedTransactions
+		copiedInvoices[invIdx] = invoice
+	}
+	copiedData.Invoices = copiedInvoices
+	m.simulatorData[paylinkId] = copiedData
+}
+
+// ManipulateTransactions sets status and refunded amount of the paylink and all its transactions,
+// as if changed in the back office.
+func (m *mockImpl) ManipulateTransactions(paylinkId uint, status string, refundedAmount int64) {
+	copiedData, ok := m.simulatorData[paylinkId]
+	if !ok {
+		return
+	}
+	copiedData.Status = status
+	copiedInvoices := make([]PaymentLinkInvoice, len(copiedData.Invoices))
+	for invIdx, invoice := range copiedData.Invoices {
+		copiedTransactions := make([]TransactionData, len(invoice.Transactions))
+		for txIdx, tx := range invoice.Transactions {
+			tx.Status = status
+			tx.Invoice.RefundedAmount = refundedAmount
+			copiedTransactions[txIdx] = tx
+		}
+		invoice.Transactions = copiedTransactions
+		copiedInvoices[invIdx] = invoice
+	}
+	copiedData.Invoices = copiedInvoices
+	m.simulatorData[paylinkId] = copiedData
+}
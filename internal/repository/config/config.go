@@ -4,6 +4,7 @@ package config
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -63,6 +64,16 @@ func FixedApiToken() string {
 	return Configuration().Security.Fixed.Api
 }
 
+// AdminForToken returns the name of the admin a token belongs to, or "" if it is not an admin token.
+func AdminForToken(token string) string {
+	for name, adminToken := range Configuration().Security.Fixed.Admins {
+		if token != "" && token == adminToken {
+			return name
+		}
+	}
+	return ""
+}
+
 func IsCorsDisabled() bool {
 	return Configuration().Security.Cors.DisableCors
 }
@@ -95,8 +106,57 @@ func WebhookSecret() string {
 	return Configuration().Security.Fixed.Webhook
 }
 
-func TransactionIDPrefix() string {
-	return Configuration().Service.TransactionIDPrefix
+func WebhookSecurityMode() WebhookMode {
+	return Configuration().Security.Webhook.Mode
+}
+
+func WebhookSignatureHeader() string {
+	return Configuration().Security.Webhook.SignatureHeader
+}
+
+func WebhookOutboxEnabled() bool {
+	return !Configuration().Service.WebhookOutbox.Disable
+}
+
+func WebhookOutboxPollInterval() time.Duration {
+	return time.Second * time.Duration(Configuration().Service.WebhookOutbox.PollIntervalSeconds)
+}
+
+func WebhookOutboxInitialBackoff() time.Duration {
+	return time.Second * time.Duration(Configuration().Service.WebhookOutbox.InitialBackoffSeconds)
+}
+
+func WebhookOutboxMaxBackoff() time.Duration {
+	return time.Second * time.Duration(Configuration().Service.WebhookOutbox.MaxBackoffSeconds)
+}
+
+func WebhookOutboxMaxAttempts() int {
+	return Configuration().Service.WebhookOutbox.MaxAttempts
+}
+
+func ReferenceLockUse() ReferenceLockType {
+	return Configuration().Service.ReferenceLock.Use
+}
+
+func ReferenceLockTimeout() time.Duration {
+	return time.Second * time.Duration(Configuration().Service.ReferenceLock.TimeoutSeconds)
+}
+
+// ReferenceIdRegexp only matches entire reference ids. It is compiled when the configuration is loaded.
+func ReferenceIdRegexp() *regexp.Regexp {
+	return Configuration().Service.referenceIdRegexp
+}
+
+func VerifyAmountDue() bool {
+	return Configuration().Service.VerifyAmountDue
+}
+
+func PaymentMethods() map[string]string {
+	return Configuration().Service.PaymentMethods
+}
+
+func PaidAmountMismatchPolicy() AmountMismatchPolicy {
+	return Configuration().Service.AmountMismatchPolicy
 }
 
 func InvoiceTitle() string {
@@ -111,6 +171,18 @@ func InvoicePurpose() string {
 	return Configuration().Invoice.Purpose
 }
 
+func InvoiceDefaultLanguage() string {
+	return Configuration().Invoice.DefaultLanguage
+}
+
+func InvoiceLanguages() map[string]InvoiceTextConfig {
+	return Configuration().Invoice.Languages
+}
+
+func InvoiceFields() map[string]InvoiceFieldConfig {
+	return Configuration().Invoice.Fields
+}
+
 func SuccessRedirect() string {
 	return Configuration().Service.SuccessRedirect
 }
@@ -118,3 +190,7 @@ func SuccessRedirect() string {
 func FailureRedirect() string {
 	return Configuration().Service.FailureRedirect
 }
+
+func RedirectAllowedHosts() []string {
+	return Configuration().Service.RedirectAllowedHosts
+}
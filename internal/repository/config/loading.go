@@ -5,6 +5,7 @@ import (
 	"flag"
 	"net/url"
 	"os"
+	"regexp"
 	"sort"
 	"sync"
 
@@ -53,8 +54,10 @@ func parseAndOverwriteConfig(yamlFile []byte, logPrintf func(format string, v ..
 
 	errs := url.Values{}
 	validateServiceConfiguration(errs, newConfigurationData.Service)
+	compileReferenceIdPattern(errs, &newConfigurationData.Service)
 	validateServerConfiguration(errs, newConfigurationData.Server)
 	validateDatabaseConfiguration(errs, newConfigurationData.Database)
+	validateReferenceLockConfiguration(errs, newConfigurationData.Service.ReferenceLock, newConfigurationData.Database)
 	validateSecurityConfiguration(errs, newConfigurationData.Security)
 	validateLoggingConfiguration(errs, newConfigurationData.Logging)
 	validateInvoiceConfiguration(errs, newConfigurationData.Invoice)
@@ -74,6 +77,10 @@ func parseAndOverwriteConfig(yamlFile []byte, logPrintf func(format string, v ..
 		return errors.New("configuration validation error")
 	}
 
+	if newConfigurationData.Service.TransactionIDPrefix != "" {
+		aulogging.Logger.NoCtx().Warn().Printf("service.transaction_id_prefix is deprecated, please replace it with service.reference_id_pattern: '%s'", newConfigurationData.Service.ReferenceIdPattern)
+	}
+
 	configurationLock.Lock()
 	defer configurationLock.Unlock()
 
@@ -101,6 +108,17 @@ func LoadTestingConfigurationFromPathOrAbort(configFilenameForTests string) {
 	}
 }
 
+// SetTestingReferenceIdPattern is for tests to switch to another reference id pattern after loading the configuration
+func SetTestingReferenceIdPattern(pattern string) {
+	compiled := regexp.MustCompile(anchoredPattern(pattern))
+
+	configurationLock.Lock()
+	defer configurationLock.Unlock()
+
+	configurationData.Service.ReferenceIdPattern = pattern
+	configurationData.Service.referenceIdRegexp = compiled
+}
+
 func StartupLoadConfiguration() error {
 	aulogging.Logger.NoCtx().Info().Print("Reading configuration...")
 	if configurationFilename == "" {
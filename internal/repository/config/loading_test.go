@@ -2,7 +2,9 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/eurofurence/reg-payment-cncrd-adapter/docs"
 	"github.com/stretchr/testify/require"
@@ -99,4 +101,342 @@ invoice:
 	require.Nil(t, err, "expected no error")
 	require.Equal(t, uint16(8080), Configuration().Server.Port, "unexpected value for server.port")
 	require.Equal(t, "INFO", Configuration().Logging.Severity, "unexpected value for logging.severity")
+	require.Equal(t, WebhookModeSecret, Configuration().Security.Webhook.Mode, "unexpected value for security.webhook.mode")
+	require.Equal(t, "X-Webhook-Signature", Configuration().Security.Webhook.SignatureHeader, "unexpected value for security.webhook.signature_header")
+	require.True(t, WebhookOutboxEnabled(), "unexpected value for service.webhook_outbox.disable")
+	require.Equal(t, 30*time.Second, WebhookOutboxInitialBackoff(), "unexpected value for service.webhook_outbox.initial_backoff_seconds")
+	require.Equal(t, 10, WebhookOutboxMaxAttempts(), "unexpected value for service.webhook_outbox.max_attempts")
+	require.Equal(t, AmountMismatchBook, PaidAmountMismatchPolicy(), "unexpected value for service.amount_mismatch_policy")
+	require.Equal(t, `[^-]+-(?P<debitor>\d+)-\d{4}-\d{6}-\d+`, Configuration().Service.ReferenceIdPattern, "unexpected value for service.reference_id_pattern")
+	require.Equal(t, ReferenceLockLocal, ReferenceLockUse(), "unexpected value for service.reference_lock.use")
+	require.Equal(t, 30*time.Second, ReferenceLockTimeout(), "unexpected value for service.reference_lock.timeout_seconds")
+}
+
+func TestParseAndOverwriteConfigValidationErrorsWebhookMode(t *testing.T) {
+	docs.Description("check that an unknown webhook mode is rejected, and the url secret becomes optional in signature mode")
+	wrongConfigYaml := `# yaml with an invalid webhook mode
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+  webhook:
+    mode: 'trust-everyone'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.EqualValues(t, []string{
+		"configuration error: security.fixed.webhook: security.fixed.webhook field must be at least 8 and at most 64 characters long",
+		"configuration error: security.webhook.mode: must be one of secret, signature, both",
+	}, recording)
+
+	recording = make([]string, 0)
+	err = parseAndOverwriteConfig([]byte(strings.Replace(wrongConfigYaml, "trust-everyone", "signature", 1)), tstLogRecorder)
+	require.Nil(t, err, "expected no error")
+	require.Equal(t, WebhookModeSignature, Configuration().Security.Webhook.Mode, "unexpected value for security.webhook.mode")
+}
+
+func TestParseAndOverwriteConfigValidationErrorsInvoiceFields(t *testing.T) {
+	docs.Description("check that unknown invoice fields and mandatory or prefilled hidden fields are rejected")
+	wrongConfigYaml := `# yaml with invalid invoice fields
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+  fields:
+    forename:
+      show: true
+      mandatory: true
+      prefill: true
+    surname:
+      mandatory: true
+    phone:
+      show: true
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.EqualValues(t, []string{
+		"configuration error: invoice.fields.phone: must be one of forename, surname, street, postcode, place, country",
+		"configuration error: invoice.fields.surname: a field that is mandatory or prefilled must also be shown",
+	}, recording)
+}
+
+func TestParseAndOverwriteConfigValidationErrorsInvoiceLanguages(t *testing.T) {
+	docs.Description("check that invoice texts must be keyed by a locale and be complete")
+	wrongConfigYaml := `# yaml with invalid invoice languages
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+  default_language: 'english'
+  languages:
+    de-DE:
+      title: 'Titel'
+      description: 'Beschreibung'
+      purpose: 'Zweck'
+    'fr FR':
+      title: 'titre'
+      description: 'description'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.EqualValues(t, []string{
+		"configuration error: invoice.default_language: must be an RFC 5646 locale such as en-US",
+		"configuration error: invoice.languages.fr FR: must be keyed by an RFC 5646 locale such as de-DE",
+		"configuration error: invoice.languages.fr FR.purpose: invoice.languages.fr FR.purpose field must be at least 1 and at most 256 characters long",
+	}, recording)
+}
+
+func TestParseAndOverwriteConfigValidationErrorsInvoiceTemplates(t *testing.T) {
+	docs.Description("check that invoice text templates are validated, including the variables used")
+	wrongConfigYaml := `# yaml with invalid invoice templates
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+invoice:
+  title: 'fee for {{ .Nickname }} ({{ .BadgeNumber }})'
+  description: 'fee of {{ .Amount'
+  purpose: 'payment for {{ .FavouriteColour }}'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.Equal(t, 2, len(recording))
+	require.Contains(t, recording[0], "configuration error: invoice.description: invoice.description field must be a valid template: ")
+	require.Contains(t, recording[1], "configuration error: invoice.purpose: invoice.purpose field must be a valid template: ")
+	require.Contains(t, recording[1], "can't evaluate field FavouriteColour")
+}
+
+func TestParseAndOverwriteConfigValidationErrorsRedirectHosts(t *testing.T) {
+	docs.Description("check that redirect allowlist entries must be plain host names")
+	wrongConfigYaml := `# yaml with invalid redirect hosts
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+  redirect_allowed_hosts:
+    - 'shop.example.com'
+    - 'https://shop.example.com/'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.EqualValues(t, []string{
+		"configuration error: service.redirect_allowed_hosts: 'https://shop.example.com/' must be a plain host name without scheme, port or path",
+	}, recording)
+}
+
+func TestParseAndOverwriteConfigValidationErrorsPaymentMethods(t *testing.T) {
+	docs.Description("check that brands can only be mapped to payment methods known to the payment service, and the mismatch policy is known")
+	wrongConfigYaml := `# yaml with an invalid payment method
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+  payment_methods:
+    visa: credit
+    twint: smartphone
+  amount_mismatch_policy: 'ignore'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.EqualValues(t, []string{
+		"configuration error: service.amount_mismatch_policy: must be one of book, pending, refuse",
+		"configuration error: service.payment_methods.twint: must be one of credit, cash, paypal, transfer, internal, gift",
+	}, recording)
+}
+
+func TestParseAndOverwriteConfigValidationErrorsReferenceLock(t *testing.T) {
+	docs.Description("check that the mysql reference id lock can only be used with a mysql database")
+	wrongConfigYaml := `# yaml with a reference lock that does not fit the database
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+  reference_lock:
+    use: mysql
+    timeout_seconds: 3600
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.EqualValues(t, []string{
+		"configuration error: service.reference_lock.timeout_seconds: service.reference_lock.timeout_seconds field must be an integer at least 1 and at most 600",
+		"configuration error: service.reference_lock.use: mysql advisory locks need database.use mysql",
+	}, recording)
+}
+
+func TestParseAndOverwriteConfigValidationErrorsReferenceIdPattern(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		`EF2023-(?P<debitor>\d+`:   "configuration error: service.reference_id_pattern: must be a valid regular expression: error parsing regexp: missing closing ): `^(?:EF2023-(?P<debitor>\\d+)$`",
+		`EF2023-(?P<badge>\d+)-.*`: "configuration error: service.reference_id_pattern: must contain a named group (?P<debitor>...) for the debitor id",
+	} {
+		t.Run(pattern, func(t *testing.T) {
+			docs.Description("check that the reference id pattern must compile and contain a debitor group")
+			wrongConfigYaml := `# yaml with an invalid reference id pattern
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+  reference_id_pattern: '` + pattern + `'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+`
+			recording = make([]string, 0)
+			err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+			require.NotNil(t, err, "expected an error")
+			require.EqualValues(t, []string{expected}, recording)
+		})
+	}
+}
+
+func TestParseAndOverwriteConfigDeprecatedTransactionIdPrefix(t *testing.T) {
+	docs.Description("check that the deprecated transaction id prefix still restricts the accepted reference ids")
+	oldConfigYaml := `# yaml from before reference_id_pattern
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+  transaction_id_prefix: 'EF2023'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(oldConfigYaml), tstLogRecorder)
+	require.Nil(t, err, "expected no error")
+	require.Equal(t, `EF2023[^-]*-(?P<debitor>\d+)-\d{4}-\d{6}-\d+`, Configuration().Service.ReferenceIdPattern, "unexpected value for service.reference_id_pattern")
+	require.True(t, ReferenceIdRegexp().MatchString("EF2023-000123-1216-122218-4711"))
+	require.False(t, ReferenceIdRegexp().MatchString("EF2022-000123-1216-122218-4711"))
+}
+
+func TestParseAndOverwriteConfigValidationErrorsTransactionIdPrefixWithPattern(t *testing.T) {
+	docs.Description("check that the deprecated transaction id prefix cannot be combined with a reference id pattern")
+	wrongConfigYaml := `# yaml with both the old prefix and a pattern
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+  transaction_id_prefix: 'EF2023'
+  reference_id_pattern: 'EF2024-(?P<debitor>\d+)-\d{4}-\d{6}-\d+'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.EqualValues(t, []string{
+		"configuration error: service.transaction_id_prefix: is deprecated and cannot be combined with reference_id_pattern, move the prefix into reference_id_pattern and remove transaction_id_prefix",
+	}, recording)
+}
+
+func TestParseAndOverwriteConfigValidationErrorsAdminTokens(t *testing.T) {
+	docs.Description("check that admin tokens must be long enough and differ from the api token")
+	wrongConfigYaml := `# yaml with bad admin tokens
+security:
+  fixed_token:
+    api: 'fixed-testing-token-abc'
+    webhook: 'fixed-webhook-token-abc'
+    admins:
+      kitten: 'fixed-testing-token-abc'
+      squirrel: 'short'
+database:
+  use: inmemory
+service:
+  concardis_instance: 'my-demo-instance'
+  concardis_api_secret: 'my-demo-secret'
+invoice:
+  title: 'demo title'
+  description: 'demo description'
+  purpose: 'demo purpose'
+`
+	recording = make([]string, 0)
+	err := parseAndOverwriteConfig([]byte(wrongConfigYaml), tstLogRecorder)
+	require.NotNil(t, err, "expected an error")
+	require.EqualValues(t, []string{
+		"configuration error: security.fixed.admins.kitten: must differ from the api token, so the admin endpoints are not open to every backend",
+		"configuration error: security.fixed.admins.squirrel: security.fixed.admins.squirrel field must be at least 16 and at most 256 characters long",
+	}, recording)
 }
@@ -1,7 +1,12 @@
 package config
 
+import "regexp"
+
 type (
-	DatabaseType string
+	DatabaseType         string
+	WebhookMode          string
+	AmountMismatchPolicy string
+	ReferenceLockType    string
 )
 
 const (
@@ -9,6 +14,23 @@ const (
 	Mysql    DatabaseType = "mysql"
 )
 
+const (
+	WebhookModeSecret    WebhookMode = "secret"    // shared secret in the url path
+	WebhookModeSignature WebhookMode = "signature" // hmac signature header
+	WebhookModeBoth      WebhookMode = "both"      // check the signature if present, else fall back to the secret (for migration)
+)
+
+const (
+	AmountMismatchBook    AmountMismatchPolicy = "book"    // book what was paid as valid, but alert
+	AmountMismatchPending AmountMismatchPolicy = "pending" // book what was paid as pending, so a human has to look at it
+	AmountMismatchRefuse  AmountMismatchPolicy = "refuse"  // do not book at all
+)
+
+const (
+	ReferenceLockLocal ReferenceLockType = "local" // in-process, only correct with a single replica
+	ReferenceLockMysql ReferenceLockType = "mysql" // mysql advisory lock, for several replicas sharing the database
+)
+
 // Application is the root configuration type
 type Application struct {
 	Service  ServiceConfig  `yaml:"service"`
@@ -41,7 +63,40 @@ type ServiceConfig struct {
 	ConcardisApiSecret  string `yaml:"concardis_api_secret"` // your instance's api secret, required
 	SuccessRedirect     string `yaml:"success_redirect"`
 	FailureRedirect     string `yaml:"failure_redirect"`
+	// RedirectAllowedHosts lists the hosts that callers may use in redirect overrides for individual paylinks
+	RedirectAllowedHosts []string `yaml:"redirect_allowed_hosts"`
+	// ReferenceIdPattern must match entire reference ids of this installation, and extract the debitor id in a (?P<debitor>...) group
+	ReferenceIdPattern string `yaml:"reference_id_pattern"`
+	// TransactionIDPrefix is deprecated, use ReferenceIdPattern. If set, it is translated into a pattern for the default format
 	TransactionIDPrefix string `yaml:"transaction_id_prefix"`
+	VerifyAmountDue     bool   `yaml:"verify_amount_due"` // check amount, currency and vat of new paylinks against the payment service
+	// PaymentMethods maps card brands or psp names (case insensitive) to payment service methods, the brand wins, unmapped is credit
+	PaymentMethods map[string]string `yaml:"payment_methods"`
+	// AmountMismatchPolicy decides how a payment is booked when the amount or currency paid differs from what is due
+	AmountMismatchPolicy AmountMismatchPolicy `yaml:"amount_mismatch_policy"` // one of book, pending, refuse, defaults to book
+
+	WebhookOutbox WebhookOutboxConfig `yaml:"webhook_outbox"`
+	ReferenceLock ReferenceLockConfig `yaml:"reference_lock"`
+
+	referenceIdRegexp *regexp.Regexp // compiled from ReferenceIdPattern during validation
+}
+
+// WebhookOutboxConfig configures asynchronous webhook processing.
+//
+// Received webhook events are stored and acknowledged immediately, then processed by a background worker
+// that retries with exponential backoff.
+type WebhookOutboxConfig struct {
+	Disable               bool `yaml:"disable"`                 // process webhooks synchronously, relying on Concardis to retry
+	PollIntervalSeconds   int  `yaml:"poll_interval_seconds"`   // how often the worker looks for due events, defaults to 5
+	InitialBackoffSeconds int  `yaml:"initial_backoff_seconds"` // delay before the first retry, doubles with each failure, defaults to 30
+	MaxBackoffSeconds     int  `yaml:"max_backoff_seconds"`     // upper limit for the delay between retries, defaults to 3600
+	MaxAttempts           int  `yaml:"max_attempts"`            // after this many failures the event is dead-lettered, defaults to 10
+}
+
+// ReferenceLockConfig configures the lock that serializes webhook and replay processing for the same reference id.
+type ReferenceLockConfig struct {
+	Use            ReferenceLockType `yaml:"use"`             // one of local, mysql, defaults to local
+	TimeoutSeconds int               `yaml:"timeout_seconds"` // how long to wait for the lock before giving up, defaults to 30
 }
 
 // DatabaseConfig configures which db to use (mysql, inmemory)
@@ -56,8 +111,9 @@ type DatabaseConfig struct {
 
 // SecurityConfig configures everything related to incoming request security
 type SecurityConfig struct {
-	Fixed FixedTokenConfig `yaml:"fixed_token"`
-	Cors  CorsConfig       `yaml:"cors"`
+	Fixed   FixedTokenConfig      `yaml:"fixed_token"`
+	Cors    CorsConfig            `yaml:"cors"`
+	Webhook WebhookSecurityConfig `yaml:"webhook"`
 }
 
 type CorsConfig struct {
@@ -68,6 +124,14 @@ type CorsConfig struct {
 type FixedTokenConfig struct {
 	Api     string `yaml:"api"`     // shared-secret for server-to-server backend authentication
 	Webhook string `yaml:"webhook"` // shared-secret for the webhook coming in from concardis
+	// Admins maps the name of each admin to their personal token for the admin endpoints. The name is recorded in the protocol.
+	Admins map[string]string `yaml:"admins"`
+}
+
+// WebhookSecurityConfig configures how incoming webhook calls are authenticated
+type WebhookSecurityConfig struct {
+	Mode            WebhookMode `yaml:"mode"`             // one of secret, signature, both, defaults to secret
+	SignatureHeader string      `yaml:"signature_header"` // header containing the base64 encoded hmac sha256 of the body, signed with the concardis api secret
 }
 
 // LoggingConfig configures logging
@@ -78,8 +142,42 @@ type LoggingConfig struct {
 }
 
 // InvoiceConfig defines what the invoices should look like
+//
+// Title, description and purpose are go templates, see InvoiceTemplateData for the available variables.
 type InvoiceConfig struct {
 	Title       string `yaml:"title"`
 	Description string `yaml:"description"`
 	Purpose     string `yaml:"purpose"`
+
+	// DefaultLanguage is the RFC 5646 locale of the default texts above, optional.
+	DefaultLanguage string `yaml:"default_language"`
+	// Languages holds translated texts keyed by RFC 5646 locale, chosen by the attendee's registration language.
+	Languages map[string]InvoiceTextConfig `yaml:"languages"`
+
+	// Fields configures the address fields on the payment page, keyed by field name
+	// (forename, surname, street, postcode, place, country). Fields not listed are not sent.
+	Fields map[string]InvoiceFieldConfig `yaml:"fields"`
+}
+
+// InvoiceTextConfig holds the invoice texts for one language
+type InvoiceTextConfig struct {
+	Title       string `yaml:"title"`
+	Description string `yaml:"description"`
+	Purpose     string `yaml:"purpose"`
+}
+
+// InvoiceTemplateData is available to the invoice text templates, e.g. {{ .BadgeNumber }}
+type InvoiceTemplateData struct {
+	BadgeNumber uint
+	Nickname    string
+	ReferenceId string
+	Amount      string // formatted with two decimals, e.g. 155.00
+	Currency    string
+}
+
+// InvoiceFieldConfig configures a single field on the payment page
+type InvoiceFieldConfig struct {
+	Show      bool `yaml:"show"`
+	Mandatory bool `yaml:"mandatory"`
+	Prefill   bool `yaml:"prefill"` // prefill with the value from the attendee service
 }
@@ -2,9 +2,11 @@ package config
 
 import (
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"regexp"
+	"text/template"
 )
 
 func setConfigurationDefaults(c *Application) {
@@ -23,6 +25,39 @@ func setConfigurationDefaults(c *Application) {
 	if c.Logging.Severity == "" {
 		c.Logging.Severity = "INFO"
 	}
+	if c.Service.WebhookOutbox.PollIntervalSeconds <= 0 {
+		c.Service.WebhookOutbox.PollIntervalSeconds = 5
+	}
+	if c.Service.WebhookOutbox.InitialBackoffSeconds <= 0 {
+		c.Service.WebhookOutbox.InitialBackoffSeconds = 30
+	}
+	if c.Service.WebhookOutbox.MaxBackoffSeconds <= 0 {
+		c.Service.WebhookOutbox.MaxBackoffSeconds = 3600
+	}
+	if c.Service.WebhookOutbox.MaxAttempts <= 0 {
+		c.Service.WebhookOutbox.MaxAttempts = 10
+	}
+	if c.Service.ReferenceLock.Use == "" {
+		c.Service.ReferenceLock.Use = ReferenceLockLocal
+	}
+	if c.Service.ReferenceLock.TimeoutSeconds <= 0 {
+		c.Service.ReferenceLock.TimeoutSeconds = 30
+	}
+	if c.Service.ReferenceIdPattern == "" && c.Service.TransactionIDPrefix != "" {
+		c.Service.ReferenceIdPattern = prefixReferenceIdPattern(c.Service.TransactionIDPrefix)
+	}
+	if c.Service.ReferenceIdPattern == "" {
+		c.Service.ReferenceIdPattern = defaultReferenceIdPattern
+	}
+	if c.Service.AmountMismatchPolicy == "" {
+		c.Service.AmountMismatchPolicy = AmountMismatchBook
+	}
+	if c.Security.Webhook.Mode == "" {
+		c.Security.Webhook.Mode = WebhookModeSecret
+	}
+	if c.Security.Webhook.SignatureHeader == "" {
+		c.Security.Webhook.SignatureHeader = "X-Webhook-Signature"
+	}
 }
 
 const (
@@ -75,13 +110,37 @@ func validateLoggingConfiguration(errs url.Values, c LoggingConfig) {
 	}
 }
 
+var allowedWebhookModes = []WebhookMode{WebhookModeSecret, WebhookModeSignature, WebhookModeBoth}
+
 func validateSecurityConfiguration(errs url.Values, c SecurityConfig) {
 	checkLength(&errs, 16, 256, "security.fixed.api", c.Fixed.Api)
-	checkLength(&errs, 8, 64, "security.fixed.webhook", c.Fixed.Webhook)
+	adminNames := make(map[string]string)
+	for name, token := range c.Fixed.Admins {
+		checkLength(&errs, 16, 256, "security.fixed.admins."+name, token)
+		if token == c.Fixed.Api {
+			errs.Add("security.fixed.admins."+name, "must differ from the api token, so the admin endpoints are not open to every backend")
+		} else if other, ok := adminNames[token]; ok {
+			errs.Add("security.fixed.admins."+name, "must differ from the token of "+other+", so we know who did what")
+		}
+		adminNames[token] = name
+	}
+	if notInAllowedValues(allowedWebhookModes, c.Webhook.Mode) {
+		errs.Add("security.webhook.mode", "must be one of secret, signature, both")
+	}
+	if c.Webhook.Mode != WebhookModeSignature || c.Fixed.Webhook != "" {
+		// the url secret is optional in pure signature mode
+		checkLength(&errs, 8, 64, "security.fixed.webhook", c.Fixed.Webhook)
+	}
 }
 
 const downstreamPattern = "^(|https?://.*[^/])$"
 
+var allowedAmountMismatchPolicies = []AmountMismatchPolicy{AmountMismatchBook, AmountMismatchPending, AmountMismatchRefuse}
+
+var allowedPaymentMethods = []string{"credit", "cash", "paypal", "transfer", "internal", "gift"}
+
+const hostPattern = "^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$"
+
 func validateServiceConfiguration(errs url.Values, c ServiceConfig) {
 	if violatesPattern(downstreamPattern, c.AttendeeService) {
 		errs.Add("service.attendee_service", "base url must be empty (enables in-memory simulator) or start with http:// or https:// and may not end in a /")
@@ -100,16 +159,111 @@ func validateServiceConfiguration(errs url.Values, c ServiceConfig) {
 	}
 	checkLength(&errs, 1, 256, "service.concardis_instance", c.ConcardisInstance)
 	checkLength(&errs, 1, 256, "service.concardis_api_secret", c.ConcardisApiSecret)
+	for _, host := range c.RedirectAllowedHosts {
+		if violatesPattern(hostPattern, host) {
+			errs.Add("service.redirect_allowed_hosts", fmt.Sprintf("'%s' must be a plain host name without scheme, port or path", host))
+		}
+	}
+	if c.TransactionIDPrefix != "" && c.ReferenceIdPattern != prefixReferenceIdPattern(c.TransactionIDPrefix) {
+		errs.Add("service.transaction_id_prefix", "is deprecated and cannot be combined with reference_id_pattern, move the prefix into reference_id_pattern and remove transaction_id_prefix")
+	}
+	if notInAllowedValues(allowedAmountMismatchPolicies, c.AmountMismatchPolicy) {
+		errs.Add("service.amount_mismatch_policy", "must be one of book, pending, refuse")
+	}
+	for key, method := range c.PaymentMethods {
+		if notInAllowedValues(allowedPaymentMethods, method) {
+			errs.Add("service.payment_methods."+key, "must be one of credit, cash, paypal, transfer, internal, gift")
+		}
+	}
+	checkIntValueRange(&errs, 1, 3600, "service.webhook_outbox.poll_interval_seconds", c.WebhookOutbox.PollIntervalSeconds)
+	checkIntValueRange(&errs, 1, 86400, "service.webhook_outbox.initial_backoff_seconds", c.WebhookOutbox.InitialBackoffSeconds)
+	checkIntValueRange(&errs, c.WebhookOutbox.InitialBackoffSeconds, 86400, "service.webhook_outbox.max_backoff_seconds", c.WebhookOutbox.MaxBackoffSeconds)
+	checkIntValueRange(&errs, 1, 100, "service.webhook_outbox.max_attempts", c.WebhookOutbox.MaxAttempts)
+	checkIntValueRange(&errs, 1, 600, "service.reference_lock.timeout_seconds", c.ReferenceLock.TimeoutSeconds)
+}
+
+// defaultReferenceIdPattern is the format generated by the payment service, prefix-debitor-MMDD-HHMMSS-random.
+const defaultReferenceIdPattern = `[^-]+-(?P<debitor>\d+)-\d{4}-\d{6}-\d+`
+
+// ReferenceIdDebitorGroup is the named group in the reference id pattern that holds the debitor id.
+const ReferenceIdDebitorGroup = "debitor"
+
+// prefixReferenceIdPattern is what the deprecated transaction_id_prefix means: the default format, but only
+// for reference ids that start with prefix.
+func prefixReferenceIdPattern(prefix string) string {
+	return regexp.QuoteMeta(prefix) + `[^-]*-(?P<debitor>\d+)-\d{4}-\d{6}-\d+`
+}
+
+// compileReferenceIdPattern validates the reference id pattern, and stores the compiled regular expression.
+func compileReferenceIdPattern(errs url.Values, c *ServiceConfig) {
+	key := "service.reference_id_pattern"
+	compiled, err := regexp.Compile(anchoredPattern(c.ReferenceIdPattern))
+	if err != nil {
+		errs.Add(key, "must be a valid regular expression: "+err.Error())
+		return
+	}
+	if compiled.SubexpIndex(ReferenceIdDebitorGroup) < 0 {
+		errs.Add(key, "must contain a named group (?P<debitor>...) for the debitor id")
+		return
+	}
+	c.referenceIdRegexp = compiled
 }
 
+var allowedReferenceLockTypes = []ReferenceLockType{ReferenceLockLocal, ReferenceLockMysql}
+
+func validateReferenceLockConfiguration(errs url.Values, c ReferenceLockConfig, db DatabaseConfig) {
+	if notInAllowedValues(allowedReferenceLockTypes, c.Use) {
+		errs.Add("service.reference_lock.use", "must be one of local, mysql")
+	}
+	if c.Use == ReferenceLockMysql && db.Use != Mysql {
+		errs.Add("service.reference_lock.use", "mysql advisory locks need database.use mysql")
+	}
+}
+
+const localePattern = "^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$"
+
+var allowedInvoiceFields = []string{"forename", "surname", "street", "postcode", "place", "country"}
+
 func validateInvoiceConfiguration(errs url.Values, c InvoiceConfig) {
 	checkLength(&errs, 1, 256, "invoice.title", c.Title)
 	checkLength(&errs, 1, 256, "invoice.purpose", c.Purpose)
 	checkLength(&errs, 1, 256, "invoice.description", c.Description)
+	checkInvoiceTemplate(&errs, "invoice.title", c.Title)
+	checkInvoiceTemplate(&errs, "invoice.purpose", c.Purpose)
+	checkInvoiceTemplate(&errs, "invoice.description", c.Description)
+	if c.DefaultLanguage != "" && violatesPattern(localePattern, c.DefaultLanguage) {
+		errs.Add("invoice.default_language", "must be an RFC 5646 locale such as en-US")
+	}
+	for locale, texts := range c.Languages {
+		key := "invoice.languages." + locale
+		if violatesPattern(localePattern, locale) {
+			errs.Add(key, "must be keyed by an RFC 5646 locale such as de-DE")
+		}
+		checkLength(&errs, 1, 256, key+".title", texts.Title)
+		checkLength(&errs, 1, 256, key+".purpose", texts.Purpose)
+		checkLength(&errs, 1, 256, key+".description", texts.Description)
+		checkInvoiceTemplate(&errs, key+".title", texts.Title)
+		checkInvoiceTemplate(&errs, key+".purpose", texts.Purpose)
+		checkInvoiceTemplate(&errs, key+".description", texts.Description)
+	}
+	for name, field := range c.Fields {
+		key := "invoice.fields." + name
+		if notInAllowedValues(allowedInvoiceFields, name) {
+			errs.Add(key, "must be one of forename, surname, street, postcode, place, country")
+		}
+		if (field.Mandatory || field.Prefill) && !field.Show {
+			errs.Add(key, "a field that is mandatory or prefilled must also be shown")
+		}
+	}
 }
 
 // -- helpers
 
+// anchoredPattern makes a regular expression match only entire values.
+func anchoredPattern(pattern string) string {
+	return "^(?:" + pattern + ")$"
+}
+
 func violatesPattern(pattern string, value string) bool {
 	matched, err := regexp.MatchString(pattern, value)
 	if err != nil {
@@ -124,6 +278,17 @@ func checkLength(errs *url.Values, min int, max int, key string, value string) {
 	}
 }
 
+// checkInvoiceTemplate parses the template and executes it once, which catches unknown variables
+func checkInvoiceTemplate(errs *url.Values, key string, value string) {
+	tmpl, err := template.New(key).Parse(value)
+	if err == nil {
+		err = tmpl.Execute(io.Discard, InvoiceTemplateData{})
+	}
+	if err != nil {
+		errs.Add(key, fmt.Sprintf("%s field must be a valid template: %s", key, err.Error()))
+	}
+}
+
 func checkIntValueRange(errs *url.Values, min int, max int, key string, value int) {
 	if value < min || value > max {
 		errs.Add(key, fmt.Sprintf("%s field must be an integer at least %d and at most %d", key, min, max))
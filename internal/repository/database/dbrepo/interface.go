@@ -2,13 +2,58 @@ package dbrepo
 
 import (
 	"context"
+	"errors"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"time"
 )
 
+var PaylinkNotFoundError = errors.New("paylink not found in database")
+
+var LockTimeoutError = errors.New("timed out waiting for reference id lock")
+
+// PaylinkQuery selects stored paylinks. Empty or zero fields do not restrict the result.
+type PaylinkQuery struct {
+	ReferenceId   string
+	DebitorId     uint64
+	Status        string
+	CreatedAfter  time.Time // inclusive
+	CreatedBefore time.Time // exclusive
+	Offset        int
+	Limit         int
+}
+
 type Repository interface {
 	Open() error
 	Close()
 	Migrate() error
 
 	WriteProtocolEntry(ctx context.Context, e *entity.ProtocolEntry) error
+	FindProtocolEntries(ctx context.Context, kind string, since time.Time) ([]*entity.ProtocolEntry, error)    // oldest first
+	FindProtocolEntriesByReferenceId(ctx context.Context, referenceId string) ([]*entity.ProtocolEntry, error) // oldest first
+
+	GetPaylinkByApiId(ctx context.Context, apiId uint) (*entity.Paylink, error)          // PaylinkNotFoundError if not there
+	GetPaylinkByIdempotencyKey(ctx context.Context, key string) (*entity.Paylink, error) // PaylinkNotFoundError if not there
+	WritePaylink(ctx context.Context, e *entity.Paylink) error                           // inserts if ID is 0, else updates
+	DeletePaylink(ctx context.Context, apiId uint) error
+	FindPaylinks(ctx context.Context, query PaylinkQuery) ([]*entity.Paylink, int64, error) // newest first, also returns total count
+
+	FindRefundBookings(ctx context.Context, referenceId string) ([]*entity.RefundBooking, error)
+	WriteRefundBooking(ctx context.Context, e *entity.RefundBooking) error // inserts if ID is 0, else updates
+
+	FindPaymentBookings(ctx context.Context, referenceId string) ([]*entity.PaymentBooking, error)
+	WritePaymentBooking(ctx context.Context, e *entity.PaymentBooking) error // inserts if ID is 0, else updates
+
+	FindProcessedWebhooks(ctx context.Context, transactionId int64) ([]*entity.ProcessedWebhook, error)
+	WriteProcessedWebhook(ctx context.Context, e *entity.ProcessedWebhook) error // inserts if ID is 0, else updates
+	// UpdateProcessedWebhookIfUnchanged updates outcome and request id, but only if outcome, request id and update time
+	// are still as in seen. Returns false if someone else updated it first.
+	UpdateProcessedWebhookIfUnchanged(ctx context.Context, e *entity.ProcessedWebhook, seen entity.ProcessedWebhook) (bool, error)
+
+	// LockReferenceId serializes processing for a reference id. Call the returned function to release the lock.
+	LockReferenceId(ctx context.Context, referenceId string, timeout time.Duration) (func(), error) // LockTimeoutError if not acquired in time
+
+	// ClaimDueOutboxEvents returns pending events that are due, oldest first, and makes them due again only at until,
+	// so no other instance processes them in the meantime.
+	ClaimDueOutboxEvents(ctx context.Context, now time.Time, until time.Time, limit int) ([]*entity.OutboxEvent, error)
+	WriteOutboxEvent(ctx context.Context, e *entity.OutboxEvent) error // inserts if ID is 0, else updates
 }
@@ -0,0 +1,83 @@
+package dbrepo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
+)
+
+// LocalReferenceLock is an in-process lock per reference id.
+//
+// It only serializes goroutines of this process, so it is only correct if a single replica is running.
+type LocalReferenceLock struct {
+	mu      sync.Mutex
+	entries map[string]*localLockEntry
+}
+
+type localLockEntry struct {
+	token chan struct{}
+	users int // goroutines holding or waiting for the lock, the entry is removed when this drops to 0
+}
+
+func NewLocalReferenceLock() *LocalReferenceLock {
+	return &LocalReferenceLock{
+		entries: make(map[string]*localLockEntry),
+	}
+}
+
+func (l *LocalReferenceLock) Lock(ctx context.Context, referenceId string, timeout time.Duration) (func(), error) {
+	l.mu.Lock()
+	entry, ok := l.entries[referenceId]
+	if !ok {
+		entry = &localLockEntry{token: make(chan struct{}, 1)}
+		l.entries[referenceId] = entry
+	}
+	entry.users++
+	l.mu.Unlock()
+
+	select {
+	case entry.token <- struct{}{}:
+		return l.unlockFunc(referenceId, entry), nil
+	default:
+	}
+
+	aulogging.Logger.Ctx(ctx).Info().Printf("waiting for lock reference_id=%s request_id=%s", referenceId, ctxvalues.RequestId(ctx))
+	started := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case entry.token <- struct{}{}:
+		aulogging.Logger.Ctx(ctx).Info().Printf("acquired lock after %v reference_id=%s request_id=%s", time.Since(started), referenceId, ctxvalues.RequestId(ctx))
+		return l.unlockFunc(referenceId, entry), nil
+	case <-timer.C:
+		l.leave(referenceId, entry)
+		aulogging.Logger.Ctx(ctx).Warn().Printf("timed out after %v waiting for lock reference_id=%s request_id=%s", timeout, referenceId, ctxvalues.RequestId(ctx))
+		return nil, LockTimeoutError
+	case <-ctx.Done():
+		l.leave(referenceId, entry)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *LocalReferenceLock) unlockFunc(referenceId string, entry *localLockEntry) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-entry.token
+			l.leave(referenceId, entry)
+		})
+	}
+}
+
+func (l *LocalReferenceLock) leave(referenceId string, entry *localLockEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.users--
+	if entry.users == 0 {
+		delete(l.entries, referenceId)
+	}
+}
@@ -0,0 +1,74 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/docs"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalReferenceLock_Serializes(t *testing.T) {
+	docs.Description("only one goroutine at a time may hold the lock for a reference id")
+	cut := NewLocalReferenceLock()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	holders := 0
+	maxHolders := 0
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := cut.Lock(ctx, "221216-122218-000001", time.Second)
+			require.Nil(t, err)
+			mu.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 1, maxHolders)
+	require.Empty(t, cut.entries, "lock entries should be cleaned up")
+}
+
+func TestLocalReferenceLock_OtherReferenceIdNotBlocked(t *testing.T) {
+	docs.Description("locks for different reference ids are independent")
+	cut := NewLocalReferenceLock()
+	ctx := context.Background()
+
+	unlock, err := cut.Lock(ctx, "221216-122218-000001", time.Second)
+	require.Nil(t, err)
+	defer unlock()
+
+	unlockOther, err := cut.Lock(ctx, "221216-122218-000002", time.Millisecond)
+	require.Nil(t, err)
+	unlockOther()
+}
+
+func TestLocalReferenceLock_Timeout(t *testing.T) {
+	docs.Description("waiting for a held lock times out with LockTimeoutError")
+	cut := NewLocalReferenceLock()
+	ctx := context.Background()
+
+	unlock, err := cut.Lock(ctx, "221216-122218-000001", time.Second)
+	require.Nil(t, err)
+
+	_, err = cut.Lock(ctx, "221216-122218-000001", 10*time.Millisecond)
+	require.Equal(t, LockTimeoutError, err)
+
+	unlock()
+	unlock() // releasing twice is harmless
+	require.Empty(t, cut.entries, "lock entries should be cleaned up")
+}
@@ -2,31 +2,58 @@ package inmemorydb
 
 import (
 	"context"
+	"fmt"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database/dbrepo"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type InMemoryRepository struct {
-	protocol   []*entity.ProtocolEntry
-	idSequence uint32
-	Now        func() time.Time
+	mu             sync.Mutex // the outbox worker and concurrent requests share the maps
+	protocol       []*entity.ProtocolEntry
+	paylinks       map[uint]*entity.Paylink
+	refundBookings map[uint]*entity.RefundBooking
+	payBookings    map[uint]*entity.PaymentBooking
+	webhooks       map[uint]*entity.ProcessedWebhook
+	outbox         map[uint]*entity.OutboxEvent
+	idSequence     uint32
+	locks          *dbrepo.LocalReferenceLock
+	Now            func() time.Time
 }
 
 func Create() dbrepo.Repository {
 	return &InMemoryRepository{
-		Now: time.Now,
+		locks: dbrepo.NewLocalReferenceLock(),
+		Now:   time.Now,
 	}
 }
 
 func (r *InMemoryRepository) Open() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.protocol = make([]*entity.ProtocolEntry, 0)
+	r.paylinks = make(map[uint]*entity.Paylink)
+	r.refundBookings = make(map[uint]*entity.RefundBooking)
+	r.payBookings = make(map[uint]*entity.PaymentBooking)
+	r.webhooks = make(map[uint]*entity.ProcessedWebhook)
+	r.outbox = make(map[uint]*entity.OutboxEvent)
 	return nil
 }
 
 func (r *InMemoryRepository) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.protocol = nil
+	r.paylinks = nil
+	r.refundBookings = nil
+	r.payBookings = nil
+	r.webhooks = nil
+	r.outbox = nil
 }
 
 func (r *InMemoryRepository) Migrate() error {
@@ -37,6 +64,9 @@ func (r *InMemoryRepository) Migrate() error {
 // --- log entries ---
 
 func (r *InMemoryRepository) WriteProtocolEntry(ctx context.Context, e *entity.ProtocolEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	newId := uint(atomic.AddUint32(&r.idSequence, 1))
 	e.ID = newId
 
@@ -47,8 +77,331 @@ func (r *InMemoryRepository) WriteProtocolEntry(ctx context.Context, e *entity.P
 	return nil
 }
 
+func (r *InMemoryRepository) FindProtocolEntries(ctx context.Context, kind string, since time.Time) ([]*entity.ProtocolEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]*entity.ProtocolEntry, 0)
+	for _, e := range r.protocol {
+		if e.Kind == kind && !e.CreatedAt.Before(since) {
+			copiedEntry := *e
+			result = append(result, &copiedEntry)
+		}
+	}
+	return result, nil
+}
+
+func (r *InMemoryRepository) FindProtocolEntriesByReferenceId(ctx context.Context, referenceId string) ([]*entity.ProtocolEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]*entity.ProtocolEntry, 0)
+	for _, e := range r.protocol {
+		if e.ReferenceId == referenceId {
+			copiedEntry := *e
+			result = append(result, &copiedEntry)
+		}
+	}
+	return result, nil
+}
+
+// --- paylinks ---
+
+func (r *InMemoryRepository) GetPaylinkByApiId(ctx context.Context, apiId uint) (*entity.Paylink, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.paylinks {
+		if p.ApiId == apiId {
+			copiedPaylink := *p
+			return &copiedPaylink, nil
+		}
+	}
+	return nil, dbrepo.PaylinkNotFoundError
+}
+
+func (r *InMemoryRepository) GetPaylinkByIdempotencyKey(ctx context.Context, key string) (*entity.Paylink, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var newest *entity.Paylink
+	for _, p := range r.paylinks {
+		if p.IdempotencyKey != nil && *p.IdempotencyKey == key && (newest == nil || p.ID > newest.ID) {
+			newest = p
+		}
+	}
+	if newest == nil {
+		return nil, dbrepo.PaylinkNotFoundError
+	}
+	copiedPaylink := *newest
+	return &copiedPaylink, nil
+}
+
+func (r *InMemoryRepository) WritePaylink(ctx context.Context, e *entity.Paylink) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e.ID == 0 {
+		for _, p := range r.paylinks {
+			if p.ApiId == e.ApiId {
+				return fmt.Errorf("duplicate paylink for api id %d", e.ApiId)
+			}
+			if p.IdempotencyKey != nil && e.IdempotencyKey != nil && *p.IdempotencyKey == *e.IdempotencyKey {
+				return fmt.Errorf("duplicate paylink for idempotency key %s", *e.IdempotencyKey)
+			}
+		}
+		e.ID = uint(atomic.AddUint32(&r.idSequence, 1))
+		e.CreatedAt = r.Now()
+	} else if _, ok := r.paylinks[e.ID]; !ok {
+		return fmt.Errorf("cannot update paylink %d - id not present", e.ID)
+	}
+	e.UpdatedAt = r.Now()
+
+	copiedPaylink := *e
+	r.paylinks[e.ID] = &copiedPaylink
+	return nil
+}
+
+func (r *InMemoryRepository) DeletePaylink(ctx context.Context, apiId uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, p := range r.paylinks {
+		if p.ApiId == apiId {
+			delete(r.paylinks, id)
+			return nil
+		}
+	}
+	return dbrepo.PaylinkNotFoundError
+}
+
+func (r *InMemoryRepository) FindPaylinks(ctx context.Context, query dbrepo.PaylinkQuery) ([]*entity.Paylink, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]*entity.Paylink, 0)
+	for _, p := range r.paylinks {
+		if paylinkMatches(p, query) {
+			copiedPaylink := *p
+			result = append(result, &copiedPaylink)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID > result[j].ID
+	})
+
+	total := int64(len(result))
+	if query.Offset >= len(result) {
+		return make([]*entity.Paylink, 0), total, nil
+	}
+	result = result[query.Offset:]
+	if query.Limit > 0 && len(result) > query.Limit {
+		result = result[:query.Limit]
+	}
+	return result, total, nil
+}
+
+func paylinkMatches(p *entity.Paylink, query dbrepo.PaylinkQuery) bool {
+	return (query.ReferenceId == "" || p.ReferenceId == query.ReferenceId) &&
+		(query.DebitorId == 0 || p.DebitorId == query.DebitorId) &&
+		(query.Status == "" || p.Status == query.Status) &&
+		(query.CreatedAfter.IsZero() || !p.CreatedAt.Before(query.CreatedAfter)) &&
+		(query.CreatedBefore.IsZero() || p.CreatedAt.Before(query.CreatedBefore))
+}
+
+// --- refund bookings ---
+
+func (r *InMemoryRepository) FindRefundBookings(ctx context.Context, referenceId string) ([]*entity.RefundBooking, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]*entity.RefundBooking, 0)
+	for _, b := range r.refundBookings {
+		if b.ReferenceId == referenceId {
+			copiedBooking := *b
+			result = append(result, &copiedBooking)
+		}
+	}
+	return result, nil
+}
+
+func (r *InMemoryRepository) WriteRefundBooking(ctx context.Context, e *entity.RefundBooking) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e.ID == 0 {
+		for _, b := range r.refundBookings {
+			if b.TransactionId == e.TransactionId {
+				return fmt.Errorf("duplicate refund booking for transaction id %d", e.TransactionId)
+			}
+		}
+		e.ID = uint(atomic.AddUint32(&r.idSequence, 1))
+		e.CreatedAt = r.Now()
+	} else if _, ok := r.refundBookings[e.ID]; !ok {
+		return fmt.Errorf("cannot update refund booking %d - id not present", e.ID)
+	}
+	e.UpdatedAt = r.Now()
+
+	copiedBooking := *e
+	r.refundBookings[e.ID] = &copiedBooking
+	return nil
+}
+
+// --- payment bookings ---
+
+func (r *InMemoryRepository) FindPaymentBookings(ctx context.Context, referenceId string) ([]*entity.PaymentBooking, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]*entity.PaymentBooking, 0)
+	for _, b := range r.payBookings {
+		if b.ReferenceId == referenceId {
+			copiedBooking := *b
+			result = append(result, &copiedBooking)
+		}
+	}
+	// in insertion order, like the mysql implementation
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (r *InMemoryRepository) WritePaymentBooking(ctx context.Context, e *entity.PaymentBooking) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e.ID == 0 {
+		for _, b := range r.payBookings {
+			if b.TransactionId == e.TransactionId {
+				return fmt.Errorf("duplicate payment booking for transaction id %d", e.TransactionId)
+			}
+		}
+		e.ID = uint(atomic.AddUint32(&r.idSequence, 1))
+		e.CreatedAt = r.Now()
+	} else if _, ok := r.payBookings[e.ID]; !ok {
+		return fmt.Errorf("cannot update payment booking %d - id not present", e.ID)
+	}
+	e.UpdatedAt = r.Now()
+
+	copiedBooking := *e
+	r.payBookings[e.ID] = &copiedBooking
+	return nil
+}
+
+// --- processed webhooks ---
+
+func (r *InMemoryRepository) FindProcessedWebhooks(ctx context.Context, transactionId int64) ([]*entity.ProcessedWebhook, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]*entity.ProcessedWebhook, 0)
+	for _, w := range r.webhooks {
+		if w.TransactionId == transactionId {
+			copiedWebhook := *w
+			result = append(result, &copiedWebhook)
+		}
+	}
+	return result, nil
+}
+
+func (r *InMemoryRepository) WriteProcessedWebhook(ctx context.Context, e *entity.ProcessedWebhook) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e.ID == 0 {
+		for _, w := range r.webhooks {
+			if w.TransactionId == e.TransactionId && w.Status == e.Status && w.RefundedAmount == e.RefundedAmount {
+				return fmt.Errorf("duplicate processed webhook for transaction id %d status %s", e.TransactionId, e.Status)
+			}
+		}
+		e.ID = uint(atomic.AddUint32(&r.idSequence, 1))
+		e.CreatedAt = r.Now()
+	} else if _, ok := r.webhooks[e.ID]; !ok {
+		return fmt.Errorf("cannot update processed webhook %d - id not present", e.ID)
+	}
+	e.UpdatedAt = r.Now()
+
+	copiedWebhook := *e
+	r.webhooks[e.ID] = &copiedWebhook
+	return nil
+}
+
+func (r *InMemoryRepository) UpdateProcessedWebhookIfUnchanged(ctx context.Context, e *entity.ProcessedWebhook, seen entity.ProcessedWebhook) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.webhooks[e.ID]
+	if !ok {
+		return false, fmt.Errorf("cannot update processed webhook %d - id not present", e.ID)
+	}
+	if stored.Outcome != seen.Outcome || stored.RequestId != seen.RequestId || !stored.UpdatedAt.Equal(seen.UpdatedAt) {
+		return false, nil
+	}
+	stored.Outcome = e.Outcome
+	stored.RequestId = e.RequestId
+	stored.UpdatedAt = r.Now()
+	e.UpdatedAt = stored.UpdatedAt
+	return true, nil
+}
+
+// --- reference id locks ---
+
+func (r *InMemoryRepository) LockReferenceId(ctx context.Context, referenceId string, timeout time.Duration) (func(), error) {
+	// an in-memory database cannot be shared between replicas anyway
+	return r.locks.Lock(ctx, referenceId, timeout)
+}
+
+// --- webhook outbox ---
+
+func (r *InMemoryRepository) ClaimDueOutboxEvents(ctx context.Context, now time.Time, until time.Time, limit int) ([]*entity.OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	due := make([]*entity.OutboxEvent, 0)
+	for _, e := range r.outbox {
+		if e.Status == entity.OutboxStatusPending && !e.NextAttemptAt.After(now) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	result := make([]*entity.OutboxEvent, 0)
+	for _, e := range due {
+		e.NextAttemptAt = until
+		copiedEvent := *e
+		result = append(result, &copiedEvent)
+	}
+	return result, nil
+}
+
+func (r *InMemoryRepository) WriteOutboxEvent(ctx context.Context, e *entity.OutboxEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e.ID == 0 {
+		e.ID = uint(atomic.AddUint32(&r.idSequence, 1))
+		e.CreatedAt = r.Now()
+	} else if _, ok := r.outbox[e.ID]; !ok {
+		return fmt.Errorf("cannot update outbox event %d - id not present", e.ID)
+	}
+	e.UpdatedAt = r.Now()
+
+	copiedEvent := *e
+	r.outbox[e.ID] = &copiedEvent
+	return nil
+}
+
 // --- testing ---
 
 func (r *InMemoryRepository) ProtocolEntries() []*entity.ProtocolEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	return r.protocol
 }
@@ -0,0 +1,45 @@
+package inmemorydb
+
+import (
+	"context"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/docs"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestUpdateProcessedWebhookIfUnchanged_OnlyOnce(t *testing.T) {
+	docs.Description("of two deliveries retrying the same failed webhook, only the first may claim it")
+	cut := Create()
+	require.Nil(t, cut.Open())
+	defer cut.Close()
+	ctx := context.Background()
+
+	failed := &entity.ProcessedWebhook{
+		TransactionId: 1892362736,
+		Status:        "confirmed",
+		Outcome:       entity.WebhookOutcomeError,
+		RequestId:     "first",
+	}
+	require.Nil(t, cut.WriteProcessedWebhook(ctx, failed))
+
+	first := *failed
+	first.Outcome = entity.WebhookOutcomeProcessing
+	first.RequestId = "second"
+	claimed, err := cut.UpdateProcessedWebhookIfUnchanged(ctx, &first, *failed)
+	require.Nil(t, err)
+	require.True(t, claimed)
+
+	second := *failed
+	second.Outcome = entity.WebhookOutcomeProcessing
+	second.RequestId = "third"
+	claimed, err = cut.UpdateProcessedWebhookIfUnchanged(ctx, &second, *failed)
+	require.Nil(t, err)
+	require.False(t, claimed)
+
+	stored, err := cut.FindProcessedWebhooks(ctx, 1892362736)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(stored))
+	require.Equal(t, entity.WebhookOutcomeProcessing, stored[0].Outcome)
+	require.Equal(t, "second", stored[0].RequestId)
+}
@@ -2,25 +2,34 @@ package mysqldb
 
 import (
 	"context"
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database/dbrepo"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
+	"math"
+	"sync"
 	"time"
 )
 
 type MysqlRepository struct {
-	db  *gorm.DB
-	Now func() time.Time
+	db    *gorm.DB
+	locks *dbrepo.LocalReferenceLock
+	Now   func() time.Time
 }
 
 func Create() dbrepo.Repository {
 	return &MysqlRepository{
-		Now: time.Now,
+		locks: dbrepo.NewLocalReferenceLock(),
+		Now:   time.Now,
 	}
 }
 
@@ -61,6 +70,11 @@ func (r *MysqlRepository) Close() {
 func (r *MysqlRepository) Migrate() error {
 	err := r.db.AutoMigrate(
 		&entity.ProtocolEntry{},
+		&entity.Paylink{},
+		&entity.RefundBooking{},
+		&entity.PaymentBooking{},
+		&entity.ProcessedWebhook{},
+		&entity.OutboxEvent{},
 	)
 	if err != nil {
 		aulogging.Logger.NoCtx().Error().WithErr(err).Printf("failed to migrate mysql db: %s", err.Error())
@@ -78,3 +92,296 @@ func (r *MysqlRepository) WriteProtocolEntry(ctx context.Context, e *entity.Prot
 	}
 	return err
 }
+
+func (r *MysqlRepository) FindProtocolEntries(ctx context.Context, kind string, since time.Time) ([]*entity.ProtocolEntry, error) {
+	result := make([]*entity.ProtocolEntry, 0)
+	err := r.db.Where("kind = ? AND created_at >= ?", kind, since).Order("id").Find(&result).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during protocol entry select: %s", err.Error())
+	}
+	return result, err
+}
+
+func (r *MysqlRepository) FindProtocolEntriesByReferenceId(ctx context.Context, referenceId string) ([]*entity.ProtocolEntry, error) {
+	result := make([]*entity.ProtocolEntry, 0)
+	err := r.db.Where("reference_id = ?", referenceId).Order("id").Find(&result).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during protocol entry select: %s", err.Error())
+	}
+	return result, err
+}
+
+// --- paylinks ---
+
+func (r *MysqlRepository) GetPaylinkByApiId(ctx context.Context, apiId uint) (*entity.Paylink, error) {
+	var result entity.Paylink
+	err := r.db.Where("api_id = ?", apiId).First(&result).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, dbrepo.PaylinkNotFoundError
+		}
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during paylink select: %s", err.Error())
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (r *MysqlRepository) GetPaylinkByIdempotencyKey(ctx context.Context, key string) (*entity.Paylink, error) {
+	var result entity.Paylink
+	err := r.db.Where("idempotency_key = ?", key).Order("id desc").First(&result).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, dbrepo.PaylinkNotFoundError
+		}
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during paylink select: %s", err.Error())
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (r *MysqlRepository) WritePaylink(ctx context.Context, e *entity.Paylink) error {
+	err := r.db.Save(e).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during paylink save: %s", err.Error())
+	}
+	return err
+}
+
+func (r *MysqlRepository) DeletePaylink(ctx context.Context, apiId uint) error {
+	result := r.db.Where("api_id = ?", apiId).Delete(&entity.Paylink{})
+	if result.Error != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(result.Error).Printf("mysql error during paylink delete: %s", result.Error.Error())
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return dbrepo.PaylinkNotFoundError
+	}
+	return nil
+}
+
+func (r *MysqlRepository) FindPaylinks(ctx context.Context, query dbrepo.PaylinkQuery) ([]*entity.Paylink, int64, error) {
+	result := make([]*entity.Paylink, 0)
+
+	var total int64
+	err := r.paylinkSelection(query).Count(&total).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during paylink count: %s", err.Error())
+		return result, 0, err
+	}
+
+	selection := r.paylinkSelection(query).Order("id desc").Offset(query.Offset)
+	if query.Limit > 0 {
+		selection = selection.Limit(query.Limit)
+	}
+	err = selection.Find(&result).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during paylink select: %s", err.Error())
+	}
+	return result, total, err
+}
+
+// paylinkSelection builds a fresh statement each time, because gorm statements must not be reused.
+func (r *MysqlRepository) paylinkSelection(query dbrepo.PaylinkQuery) *gorm.DB {
+	selection := r.db.Model(&entity.Paylink{})
+	if query.ReferenceId != "" {
+		selection = selection.Where("reference_id = ?", query.ReferenceId)
+	}
+	if query.DebitorId != 0 {
+		selection = selection.Where("debitor_id = ?", query.DebitorId)
+	}
+	if query.Status != "" {
+		selection = selection.Where("status = ?", query.Status)
+	}
+	if !query.CreatedAfter.IsZero() {
+		selection = selection.Where("created_at >= ?", query.CreatedAfter)
+	}
+	if !query.CreatedBefore.IsZero() {
+		selection = selection.Where("created_at < ?", query.CreatedBefore)
+	}
+	return selection
+}
+
+// --- refund bookings ---
+
+func (r *MysqlRepository) FindRefundBookings(ctx context.Context, referenceId string) ([]*entity.RefundBooking, error) {
+	result := make([]*entity.RefundBooking, 0)
+	err := r.db.Where("reference_id = ?", referenceId).Find(&result).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during refund booking select: %s", err.Error())
+	}
+	return result, err
+}
+
+func (r *MysqlRepository) WriteRefundBooking(ctx context.Context, e *entity.RefundBooking) error {
+	err := r.db.Save(e).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during refund booking save: %s", err.Error())
+	}
+	return err
+}
+
+// --- payment bookings ---
+
+func (r *MysqlRepository) FindPaymentBookings(ctx context.Context, referenceId string) ([]*entity.PaymentBooking, error) {
+	result := make([]*entity.PaymentBooking, 0)
+	err := r.db.Where("reference_id = ?", referenceId).Order("id").Find(&result).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during payment booking select: %s", err.Error())
+	}
+	return result, err
+}
+
+func (r *MysqlRepository) WritePaymentBooking(ctx context.Context, e *entity.PaymentBooking) error {
+	err := r.db.Save(e).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during payment booking save: %s", err.Error())
+	}
+	return err
+}
+
+// --- processed webhooks ---
+
+func (r *MysqlRepository) FindProcessedWebhooks(ctx context.Context, transactionId int64) ([]*entity.ProcessedWebhook, error) {
+	result := make([]*entity.ProcessedWebhook, 0)
+	err := r.db.Where("transaction_id = ?", transactionId).Find(&result).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during processed webhook select: %s", err.Error())
+	}
+	return result, err
+}
+
+func (r *MysqlRepository) WriteProcessedWebhook(ctx context.Context, e *entity.ProcessedWebhook) error {
+	err := r.db.Save(e).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during processed webhook save: %s", err.Error())
+	}
+	return err
+}
+
+func (r *MysqlRepository) UpdateProcessedWebhookIfUnchanged(ctx context.Context, e *entity.ProcessedWebhook, seen entity.ProcessedWebhook) (bool, error) {
+	now := r.Now()
+	result := r.db.Model(&entity.ProcessedWebhook{}).
+		Where("id = ? AND outcome = ? AND request_id = ? AND updated_at = ?", e.ID, seen.Outcome, seen.RequestId, seen.UpdatedAt).
+		Updates(map[string]interface{}{
+			"outcome":    e.Outcome,
+			"request_id": e.RequestId,
+			"updated_at": now,
+		})
+	if result.Error != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(result.Error).Printf("mysql error during processed webhook conditional update: %s", result.Error.Error())
+		return false, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return false, nil
+	}
+	e.UpdatedAt = now
+	return true, nil
+}
+
+// --- reference id locks ---
+
+func (r *MysqlRepository) LockReferenceId(ctx context.Context, referenceId string, timeout time.Duration) (func(), error) {
+	if config.ReferenceLockUse() != config.ReferenceLockMysql {
+		return r.locks.Lock(ctx, referenceId, timeout)
+	}
+
+	sqlDb, err := r.db.DB()
+	if err != nil {
+		return nil, err
+	}
+	// advisory locks belong to the session, so acquire and release must use the same connection
+	conn, err := sqlDb.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := advisoryLockName(referenceId)
+	acquired, err := getAdvisoryLock(ctx, conn, name, 0)
+	if err == nil && !acquired {
+		aulogging.Logger.Ctx(ctx).Info().Printf("waiting for lock reference_id=%s request_id=%s", referenceId, ctxvalues.RequestId(ctx))
+		started := time.Now()
+		acquired, err = getAdvisoryLock(ctx, conn, name, timeout)
+		if acquired {
+			aulogging.Logger.Ctx(ctx).Info().Printf("acquired lock after %v reference_id=%s request_id=%s", time.Since(started), referenceId, ctxvalues.RequestId(ctx))
+		} else if err == nil {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("timed out after %v waiting for lock reference_id=%s request_id=%s", timeout, referenceId, ctxvalues.RequestId(ctx))
+			err = dbrepo.LockTimeoutError
+		}
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			// the request context may already be cancelled, but the lock must still be released
+			if _, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name); err != nil {
+				aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("failed to release lock reference_id=%s request_id=%s: %s", referenceId, ctxvalues.RequestId(ctx), err.Error())
+			}
+			_ = conn.Close()
+		})
+	}, nil
+}
+
+// advisoryLockName keeps lock names within the 64 character limit of mysql.
+func advisoryLockName(referenceId string) string {
+	name := "cncrd_ref_" + referenceId
+	if len(name) > 64 {
+		return fmt.Sprintf("cncrd_ref_%x", sha1.Sum([]byte(referenceId)))
+	}
+	return name
+}
+
+func getAdvisoryLock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (bool, error) {
+	var result sql.NullInt64
+	seconds := int(math.Ceil(timeout.Seconds()))
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, seconds).Scan(&result); err != nil {
+		return false, err
+	}
+	if !result.Valid {
+		return false, fmt.Errorf("mysql failed to acquire lock %s", name)
+	}
+	return result.Int64 == 1, nil
+}
+
+// --- webhook outbox ---
+
+// ClaimDueOutboxEvents moves the due time of each event to until with a conditional update.
+//
+// Only one instance can win that update, so events are processed by a single instance. Events whose
+// processing is interrupted become due again at until.
+func (r *MysqlRepository) ClaimDueOutboxEvents(ctx context.Context, now time.Time, until time.Time, limit int) ([]*entity.OutboxEvent, error) {
+	due := make([]*entity.OutboxEvent, 0)
+	err := r.db.Where("status = ? AND next_attempt_at <= ?", entity.OutboxStatusPending, now).Order("id").Limit(limit).Find(&due).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during outbox select: %s", err.Error())
+		return nil, err
+	}
+
+	result := make([]*entity.OutboxEvent, 0)
+	for _, e := range due {
+		claim := r.db.Model(&entity.OutboxEvent{}).
+			Where("id = ? AND status = ? AND next_attempt_at <= ?", e.ID, entity.OutboxStatusPending, now).
+			Update("next_attempt_at", until)
+		if claim.Error != nil {
+			aulogging.Logger.Ctx(ctx).Warn().WithErr(claim.Error).Printf("mysql error during outbox claim: %s", claim.Error.Error())
+			return result, claim.Error
+		}
+		if claim.RowsAffected == 1 {
+			// claimed by us, otherwise another instance was faster
+			e.NextAttemptAt = until
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func (r *MysqlRepository) WriteOutboxEvent(ctx context.Context, e *entity.OutboxEvent) error {
+	err := r.db.Save(e).Error
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("mysql error during outbox save: %s", err.Error())
+	}
+	return err
+}
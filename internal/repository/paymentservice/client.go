@@ -93,3 +93,13 @@ func (i *Impl) GetTransactionByReferenceId(ctx context.Context, reference_id str
 	}
 	return bodyDto.Payload[0], err
 }
+
+func (i *Impl) FindTransactions(ctx context.Context, debitor_id uint) ([]Transaction, error) {
+	url := fmt.Sprintf("%s/api/rest/v1/transactions?debitor_id=%d", i.baseUrl, debitor_id)
+	bodyDto := TransactionResponse{}
+	response := aurestclientapi.ParsedResponse{
+		Body: &bodyDto,
+	}
+	err := i.client.Perform(ctx, http.MethodGet, url, nil, &response)
+	return bodyDto.Payload, errByStatus(err, response.Status)
+}
@@ -10,6 +10,7 @@ type PaymentService interface {
 	AddTransaction(ctx context.Context, transaction Transaction) error
 	UpdateTransaction(ctx context.Context, transaction Transaction) error
 	GetTransactionByReferenceId(ctx context.Context, reference_id string) (Transaction, error)
+	FindTransactions(ctx context.Context, debitor_id uint) ([]Transaction, error)
 }
 
 var (
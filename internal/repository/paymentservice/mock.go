@@ -2,6 +2,7 @@ package paymentservice
 
 import (
 	"context"
+	"fmt"
 )
 
 type Mock interface {
@@ -10,7 +11,9 @@ type Mock interface {
 	InjectTransaction(ctx context.Context, transaction Transaction) error
 	Reset()
 	Recording() []Transaction
+	SimulateGetError(err error)
 	SimulateAddError(err error)
+	SimulateGeneratedIds(generate bool)
 }
 
 type MockImpl struct {
@@ -19,6 +22,8 @@ type MockImpl struct {
 	simulateGetError    error
 	simulateAddError    error
 	simulateUpdateError error
+	generateIds         bool
+	generatedIds        int
 }
 
 var (
@@ -38,6 +43,12 @@ func (m *MockImpl) AddTransaction(ctx context.Context, transaction Transaction)
 		return m.simulateAddError
 	}
 
+	if m.generateIds {
+		// like the real payment service, which assigns its own transaction identifiers
+		m.generatedIds++
+		transaction.ID = fmt.Sprintf("mock-generated-id-%d", m.generatedIds)
+	}
+
 	_ = m.InjectTransaction(ctx, transaction)
 	m.recording = append(m.recording, transaction)
 
@@ -56,6 +67,19 @@ func (m *MockImpl) UpdateTransaction(ctx context.Context, transaction Transactio
 }
 
 func (m *MockImpl) GetTransactionByReferenceId(ctx context.Context, referenceId string) (Transaction, error) {
+	if m.simulateGetError != nil {
+		return Transaction{}, m.simulateGetError
+	}
+
+	// the most recently injected version of a transaction wins
+	for _, transactions := range m.data {
+		for i := len(transactions) - 1; i >= 0; i-- {
+			if transactions[i].ID == referenceId {
+				return transactions[i], nil
+			}
+		}
+	}
+
 	transaction := Transaction{
 		ID: "mock-transaction-id",
 	}
@@ -63,23 +87,53 @@ func (m *MockImpl) GetTransactionByReferenceId(ctx context.Context, referenceId
 	return transaction, nil
 }
 
+func (m *MockImpl) FindTransactions(ctx context.Context, debitorId uint) ([]Transaction, error) {
+	if m.simulateGetError != nil {
+		return nil, m.simulateGetError
+	}
+
+	// later versions of a transaction replace earlier ones, but keep their position
+	result := make([]Transaction, 0)
+	positions := make(map[string]int)
+	for _, transaction := range m.data[debitorId] {
+		if pos, ok := positions[transaction.ID]; ok && transaction.ID != "" {
+			result[pos] = transaction
+		} else {
+			positions[transaction.ID] = len(result)
+			result = append(result, transaction)
+		}
+	}
+	return result, nil
+}
+
 // only used in tests
 
 func (m *MockImpl) Reset() {
+	m.data = make(map[uint][]Transaction)
 	m.recording = make([]Transaction, 0)
 	m.simulateGetError = nil
 	m.simulateAddError = nil
 	m.simulateUpdateError = nil
+	m.generateIds = false
+	m.generatedIds = 0
 }
 
 func (m *MockImpl) Recording() []Transaction {
 	return m.recording
 }
 
+func (m *MockImpl) SimulateGetError(err error) {
+	m.simulateGetError = err
+}
+
 func (m *MockImpl) SimulateAddError(err error) {
 	m.simulateAddError = err
 }
 
+func (m *MockImpl) SimulateGeneratedIds(generate bool) {
+	m.generateIds = generate
+}
+
 func (m *MockImpl) InjectTransaction(_ context.Context, transaction Transaction) error {
 	existingTransactions, ok := m.data[transaction.DebitorID]
 	if !ok {
@@ -7,7 +7,9 @@ import (
 	auresthttpclient "github.com/StephanHCB/go-autumn-restclient/implementation/httpclient"
 	aurestlogging "github.com/StephanHCB/go-autumn-restclient/implementation/requestlogging"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+	"io"
 	"net/http"
 )
 
@@ -17,7 +19,7 @@ type Impl struct {
 }
 
 func newClient() (Self, error) {
-	httpClient, err := auresthttpclient.New(0, nil, nil)
+	httpClient, err := auresthttpclient.New(0, nil, signWebhookRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -40,8 +42,28 @@ func errByStatus(err error, status int) error {
 	return nil
 }
 
+// signWebhookRequest adds the signature header, so the simulator works in all webhook security modes.
+func signWebhookRequest(ctx context.Context, r *http.Request) {
+	if r.GetBody == nil {
+		return
+	}
+	body, err := r.GetBody()
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		return
+	}
+	r.Header.Set(config.WebhookSignatureHeader(), concardis.WebhookSignature(bodyBytes))
+}
+
 func (i *Impl) CallWebhook(ctx context.Context, event cncrdapi.WebhookEventDto) error {
-	url := fmt.Sprintf("%s/api/rest/v1/webhook/%s", i.baseUrl, config.WebhookSecret())
+	url := fmt.Sprintf("%s/api/rest/v1/webhook", i.baseUrl)
+	if config.WebhookSecret() != "" {
+		url = fmt.Sprintf("%s/%s", url, config.WebhookSecret())
+	}
 	response := aurestclientapi.ParsedResponse{}
 	err := i.client.Perform(ctx, http.MethodPost, url, event, &response)
 	return errByStatus(err, response.Status)
@@ -0,0 +1,175 @@
+package paymentlinksrv
+
+import (
+	"context"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (i *Impl) ListFailures(ctx context.Context, days uint) (cncrdapi.AdminFailureListDto, error) {
+	result := cncrdapi.AdminFailureListDto{
+		Failures: make([]cncrdapi.AdminFailureDto, 0),
+	}
+
+	db := database.GetRepository()
+	since := i.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	errorEntries, err := db.FindProtocolEntries(ctx, "error", since)
+	if err != nil {
+		return result, err
+	}
+
+	// the most recent error per reference id, entries without reference id are listed individually
+	lastErrors := make(map[string]*entity.ProtocolEntry)
+	for _, e := range errorEntries {
+		if e.ReferenceId == "" {
+			result.Failures = append(result.Failures, failureDto(e, []*entity.ProtocolEntry{e}))
+		} else {
+			lastErrors[e.ReferenceId] = e
+		}
+	}
+
+	for referenceId, lastError := range lastErrors {
+		history, err := db.FindProtocolEntriesByReferenceId(ctx, referenceId)
+		if err != nil {
+			return result, err
+		}
+		if resolvedLater(lastError, history) {
+			continue
+		}
+		result.Failures = append(result.Failures, failureDto(lastError, history))
+	}
+
+	sort.SliceStable(result.Failures, func(i, j int) bool {
+		return result.Failures[i].LastErrorAt > result.Failures[j].LastErrorAt
+	})
+	return result, nil
+}
+
+// resolvedLater is true if the history shows a successful booking after the error.
+//
+// Other successes do not count, a webhook protocols querying the paylink before it attempts the booking.
+func resolvedLater(lastError *entity.ProtocolEntry, history []*entity.ProtocolEntry) bool {
+	for _, e := range history {
+		if e.ID > lastError.ID && e.Kind == "success" && strings.HasPrefix(e.Message, bookingProtocolMessage+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func failureDto(lastError *entity.ProtocolEntry, history []*entity.ProtocolEntry) cncrdapi.AdminFailureDto {
+	dto := cncrdapi.AdminFailureDto{
+		ReferenceId: lastError.ReferenceId,
+		PaylinkId:   lastError.ApiId,
+		LastError:   lastError.Message,
+		LastErrorAt: lastError.CreatedAt.Format(time.RFC3339),
+		Protocol:    make([]cncrdapi.ProtocolEntryDto, 0, len(history)),
+	}
+	for _, e := range history {
+		if dto.PaylinkId == 0 {
+			dto.PaylinkId = e.ApiId
+		}
+		dto.Protocol = append(dto.Protocol, cncrdapi.ProtocolEntryDto{
+			Timestamp: e.CreatedAt.Format(time.RFC3339),
+			Kind:      e.Kind,
+			Message:   e.Message,
+			Details:   e.Details,
+			RequestId: e.RequestId,
+		})
+	}
+	return dto
+}
+
+func (i *Impl) ValidateRerunRequest(ctx context.Context, data cncrdapi.AdminRerunRequestDto) url.Values {
+	errs := url.Values{}
+
+	if (data.PaylinkId == 0) == (data.ReferenceId == "") {
+		errs.Add("paylink_id", "exactly one of paylink_id and reference_id must be set")
+	}
+	if len(data.ReferenceId) > 80 {
+		errs.Add("reference_id", "reference_id may be at most 80 characters long")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	} else {
+		for k, v := range errs {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("rerun request validation error: %s: %s", k, v[0])
+		}
+		return errs
+	}
+}
+
+func (i *Impl) RerunProcessing(ctx context.Context, request cncrdapi.AdminRerunRequestDto) (cncrdapi.AdminRerunResultDto, error) {
+	result := cncrdapi.AdminRerunResultDto{
+		ReferenceId: request.ReferenceId,
+		PaylinkId:   request.PaylinkId,
+	}
+
+	if result.PaylinkId == 0 {
+		paylinkId, err := paylinkIdForReferenceId(ctx, result.ReferenceId)
+		if err != nil {
+			return result, err
+		}
+		result.PaylinkId = paylinkId
+	}
+	if result.ReferenceId == "" {
+		paylink, err := concardis.Get().QueryPaymentLink(ctx, result.PaylinkId)
+		if err != nil {
+			return result, err
+		}
+		result.ReferenceId = paylink.ReferenceID
+	}
+
+	triggeredBy := ctxvalues.AuthorizedAs(ctx)
+	aulogging.Logger.Ctx(ctx).Info().Printf("re-running processing for paylink id=%d ref=%s, triggered by %s", result.PaylinkId, result.ReferenceId, triggeredBy)
+
+	// a webhook without transaction id is not subject to deduplication
+	webhook := cncrdapi.WebhookEventDto{
+		Transaction: cncrdapi.WebhookEventTransaction{
+			Invoice: cncrdapi.WebhookEventTransactionInvoice{
+				ReferenceId:      result.ReferenceId,
+				PaymentRequestId: int64(result.PaylinkId),
+			},
+		},
+	}
+	result.Outcome = "success"
+	if err := i.HandleWebhook(ctx, webhook); err != nil {
+		result.Outcome = "failed"
+		result.Details = err.Error()
+	}
+
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: result.ReferenceId,
+		ApiId:       result.PaylinkId,
+		Kind:        "rerun",
+		Message:     "admin rerun " + result.Outcome,
+		Details:     strings.TrimSpace(fmt.Sprintf("triggered-by=%s %s", triggeredBy, result.Details)),
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+	return result, nil
+}
+
+// paylinkIdForReferenceId finds the most recent paylink id for a reference id in the protocol.
+func paylinkIdForReferenceId(ctx context.Context, referenceId string) (uint, error) {
+	history, err := database.GetRepository().FindProtocolEntriesByReferenceId(ctx, referenceId)
+	if err != nil {
+		return 0, err
+	}
+	for n := len(history) - 1; n >= 0; n-- {
+		if history[n].ApiId != 0 {
+			return history[n].ApiId, nil
+		}
+	}
+	return 0, RerunReferenceUnknownErr
+}
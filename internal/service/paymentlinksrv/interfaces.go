@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net/url"
+	"time"
 
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
 )
@@ -18,22 +19,117 @@ type PaymentLinkService interface {
 	// CreatePaymentLink expects an already validated cncrdapi.PaymentLinkRequestDto, and makes a downstream
 	// request to create a payment link, returning the cncrdapi.PaymentLinkDto with all its information and the
 	// id under which to manage the payment link.
-	CreatePaymentLink(ctx context.Context, request cncrdapi.PaymentLinkRequestDto) (cncrdapi.PaymentLinkDto, uint, error)
+	//
+	// If a payment link was already created for the idempotency key (which defaults to the reference id),
+	// that payment link is returned instead. If it was created with different data, IdempotencyKeyConflictErr
+	// is returned.
+	//
+	// If configured, the request is checked against the payment service first, and an *AmountMismatchError
+	// is returned if it does not match.
+	CreatePaymentLink(ctx context.Context, request cncrdapi.PaymentLinkRequestDto, idempotencyKey string) (cncrdapi.PaymentLinkDto, uint, error)
 
 	// GetPaymentLink obtains the payment link information from the downstream api.
 	GetPaymentLink(ctx context.Context, id uint) (cncrdapi.PaymentLinkDto, error)
 
+	// ListPaymentLinks returns a page of the locally stored payment links matching the filter, newest first.
+	//
+	// This does not make any downstream requests, so statuses are as last reported by the webhook.
+	ListPaymentLinks(ctx context.Context, filter PaymentLinkFilter) (cncrdapi.PaymentLinkListDto, error)
+
 	// DeletePaymentLink asks the downstream api to delete the given payment link.
 	DeletePaymentLink(ctx context.Context, id uint) error
 
+	// ValidateRefundRequest checks the cncrdapi.PaymentLinkRefundRequestDto for validity.
+	//
+	// The returned url.Values contains detailed error messages that can be used to construct a meaningful response.
+	// It is nil if no validation errors were encountered. Any errors encountered are also logged.
+	ValidateRefundRequest(ctx context.Context, data cncrdapi.PaymentLinkRefundRequestDto) url.Values
+
+	// RefundPaymentLink asks the downstream api to refund confirmed payments made using the given payment link,
+	// and books a matching negative transaction in the payment service for each of them.
+	//
+	// If the request specifies no amount, everything that has not been refunded yet is refunded.
+	// A refund that would exceed the confirmed amount is rejected.
+	RefundPaymentLink(ctx context.Context, id uint, request cncrdapi.PaymentLinkRefundRequestDto) error
+
 	// HandleWebhook requests the payment link referenced in the webhook data and reacts to any new payments
 	HandleWebhook(ctx context.Context, webhook cncrdapi.WebhookEventDto) error
 
+	// ReceiveWebhook stores the webhook data in the outbox, to be processed by the background worker.
+	//
+	// If the outbox is disabled, or the data cannot possibly be processed, it calls HandleWebhook directly.
+	ReceiveWebhook(ctx context.Context, webhook cncrdapi.WebhookEventDto) error
+
+	// ProcessWebhookOutbox calls HandleWebhook for all stored webhook events that are due, and returns their number.
+	//
+	// Failed events are retried with exponential backoff, and dead-lettered after too many failed attempts.
+	ProcessWebhookOutbox(ctx context.Context) int
+
+	// ReplayTransactions fetches the confirmed transactions of the last n days from the downstream api and
+	// books each referenced payment link in the payment service, just like the webhook would have.
+	//
+	// This is a safety net in case webhook calls were lost. The returned cncrdapi.TransactionReplayDto
+	// contains one entry per reference id.
+	ReplayTransactions(ctx context.Context, days uint) (cncrdapi.TransactionReplayDto, error)
+
+	// ListFailures returns all reference ids with failed processing attempts in the last n days,
+	// together with their full protocol history. Failures that were followed by successful processing are left out.
+	ListFailures(ctx context.Context, days uint) (cncrdapi.AdminFailureListDto, error)
+
+	// ValidateRerunRequest checks the cncrdapi.AdminRerunRequestDto for validity.
+	//
+	// The returned url.Values contains detailed error messages that can be used to construct a meaningful response.
+	// It is nil if no validation errors were encountered. Any errors encountered are also logged.
+	ValidateRerunRequest(ctx context.Context, data cncrdapi.AdminRerunRequestDto) url.Values
+
+	// RerunProcessing processes a payment link again, just like the webhook would, and records the admin who asked for it.
+	//
+	// If only the reference id is given, the paylink id is taken from the protocol. Failed processing is
+	// reported in the result, an error is only returned if the paylink could not be determined.
+	RerunProcessing(ctx context.Context, request cncrdapi.AdminRerunRequestDto) (cncrdapi.AdminRerunResultDto, error)
+
 	// SendErrorNotifyMail notifies us about unexpected conditions in this service so we can look at the logs
 	SendErrorNotifyMail(ctx context.Context, operation string, referenceId string, status string) error
 }
 
+// PaymentLinkFilter selects payment links for ListPaymentLinks. Empty or zero fields do not restrict the result.
+type PaymentLinkFilter struct {
+	ReferenceId   string
+	DebitorId     uint64
+	Status        string
+	CreatedAfter  time.Time // inclusive
+	CreatedBefore time.Time // exclusive
+	Page          int       // starting at 1
+	PageSize      int
+}
+
+type BookingOutcome string
+
+const (
+	BookingCreated BookingOutcome = "created"
+	BookingUpdated BookingOutcome = "updated"
+	BookingSkipped BookingOutcome = "skipped"
+	BookingRefused BookingOutcome = "refused" // paid amount does not match amount due, see service.amount_mismatch_policy
+	BookingFailed  BookingOutcome = "failed"
+)
+
 var (
-	WebhookValidationErr    = errors.New("webhook referenced invalid invoice id, must be positive integer")
-	WebhookRefIdMismatchErr = errors.New("webhook reference_id differes from paylink reference_id")
+	WebhookValidationErr      = errors.New("webhook referenced invalid invoice id, must be positive integer")
+	WebhookRefIdMismatchErr   = errors.New("webhook reference_id differes from paylink reference_id")
+	RefundNotPossibleErr      = errors.New("paylink has no confirmed payments that could be refunded")
+	RefundAmountExceededErr   = errors.New("refund amount exceeds the confirmed amount not yet refunded")
+	RerunReferenceUnknownErr  = errors.New("no paylink id known for this reference id")
+	IdempotencyKeyConflictErr = errors.New("idempotency key was already used for a different payment link request")
 )
+
+// AmountMismatchError is returned by CreatePaymentLink if the request does not match the transaction
+// the payment service has for the reference id.
+//
+// Details contains descriptive messages keyed by request field, like the result of ValidatePaymentLinkRequest.
+type AmountMismatchError struct {
+	Details url.Values
+}
+
+func (e *AmountMismatchError) Error() string {
+	return "paylink request does not match the payment service"
+}
@@ -0,0 +1,77 @@
+package paymentlinksrv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+)
+
+// invoiceTexts picks the invoice texts for an RFC 5646 locale.
+//
+// An exact match wins, then a configured locale with the same primary language (de-CH falls back to de-DE or de),
+// then the default texts. The second return value is the matching payment page language, e.g. de, or empty
+// if it is unknown.
+func invoiceTexts(locale string) (config.InvoiceTextConfig, string) {
+	languages := config.InvoiceLanguages()
+	for key, texts := range languages {
+		if strings.EqualFold(key, locale) {
+			return texts, primaryLanguage(key)
+		}
+	}
+	if primary := primaryLanguage(locale); primary != "" {
+		// iterate in a stable order, so the choice does not depend on map ordering
+		var candidate string
+		for key := range languages {
+			if primaryLanguage(key) == primary && (candidate == "" || key < candidate) {
+				candidate = key
+			}
+		}
+		if candidate != "" {
+			return languages[candidate], primary
+		}
+	}
+
+	return config.InvoiceTextConfig{
+		Title:       config.InvoiceTitle(),
+		Description: config.InvoiceDescription(),
+		Purpose:     config.InvoicePurpose(),
+	}, primaryLanguage(config.InvoiceDefaultLanguage())
+}
+
+func primaryLanguage(locale string) string {
+	primary, _, _ := strings.Cut(locale, "-")
+	return strings.ToLower(primary)
+}
+
+// renderInvoiceTexts fills in the template variables.
+//
+// The templates are validated at config load, so failures are unexpected. They are logged and the template text is used as is.
+func renderInvoiceTexts(ctx context.Context, texts config.InvoiceTextConfig, data config.InvoiceTemplateData) config.InvoiceTextConfig {
+	return config.InvoiceTextConfig{
+		Title:       renderInvoiceText(ctx, "title", texts.Title, data),
+		Description: renderInvoiceText(ctx, "description", texts.Description, data),
+		Purpose:     renderInvoiceText(ctx, "purpose", texts.Purpose, data),
+	}
+}
+
+func renderInvoiceText(ctx context.Context, name string, text string, data config.InvoiceTemplateData) string {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("failed to parse invoice %s template, using it as is: %s", name, err.Error())
+		return text
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("failed to render invoice %s template, using it as is: %s", name, err.Error())
+		return text
+	}
+	return buf.String()
+}
+
+func formatAmount(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
@@ -0,0 +1,153 @@
+package paymentlinksrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
+	"time"
+)
+
+const outboxBatchSize = 50
+
+// outboxClaimDuration is how long a claimed event is left alone by other instances. Processing an
+// event takes a few downstream calls, so if it is still not done by then, the instance has died.
+const outboxClaimDuration = 10 * time.Minute
+
+func (i *Impl) ReceiveWebhook(ctx context.Context, webhook cncrdapi.WebhookEventDto) error {
+	if !config.WebhookOutboxEnabled() {
+		return i.HandleWebhook(ctx, webhook)
+	}
+
+	paylinkId, err := idValidate(webhook.Transaction.Invoice.PaymentRequestId)
+	if err != nil {
+		// retrying cannot help, and the test button of the back office should get an immediate response
+		return i.HandleWebhook(ctx, webhook)
+	}
+
+	payload, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+
+	event := &entity.OutboxEvent{
+		TransactionId: webhook.Transaction.Id,
+		ReferenceId:   webhook.Transaction.Invoice.ReferenceId,
+		ApiId:         paylinkId,
+		Payload:       string(payload),
+		Status:        entity.OutboxStatusPending,
+		NextAttemptAt: i.Now(),
+		RequestId:     ctxvalues.RequestId(ctx),
+	}
+	if err := database.GetRepository().WriteOutboxEvent(ctx, event); err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("failed to store webhook event for paylink id=%d ref=%s - concardis will have to retry", paylinkId, event.ReferenceId)
+		return err
+	}
+
+	aulogging.Logger.Ctx(ctx).Info().Printf("queued webhook event id=%d for paylink id=%d ref=%s", event.ID, paylinkId, event.ReferenceId)
+	return nil
+}
+
+func (i *Impl) ProcessWebhookOutbox(ctx context.Context) int {
+	now := i.Now()
+	events, err := database.GetRepository().ClaimDueOutboxEvents(ctx, now, now.Add(outboxClaimDuration), outboxBatchSize)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("failed to read webhook outbox: %s", err.Error())
+		return 0
+	}
+
+	for _, event := range events {
+		if ctx.Err() != nil {
+			break
+		}
+		i.processOutboxEvent(ctx, event)
+	}
+	return len(events)
+}
+
+// RunWebhookOutboxWorker processes the webhook outbox periodically until ctx is cancelled.
+func RunWebhookOutboxWorker(ctx context.Context, srv PaymentLinkService) {
+	aulogging.Logger.NoCtx().Info().Printf("starting webhook outbox worker, polling every %v", config.WebhookOutboxPollInterval())
+
+	ticker := time.NewTicker(config.WebhookOutboxPollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			aulogging.Logger.NoCtx().Info().Print("webhook outbox worker stopped")
+			return
+		case <-ticker.C:
+			srv.ProcessWebhookOutbox(ctx)
+		}
+	}
+}
+
+func (i *Impl) processOutboxEvent(parentCtx context.Context, event *entity.OutboxEvent) {
+	// protocol entries and mails should reference the webhook call that delivered the event
+	ctx := ctxvalues.CreateContextWithValueMap(parentCtx)
+	ctxvalues.SetRequestId(ctx, event.RequestId)
+
+	webhook := cncrdapi.WebhookEventDto{}
+	err := json.Unmarshal([]byte(event.Payload), &webhook)
+	if err == nil {
+		err = i.HandleWebhook(ctx, webhook)
+	}
+
+	event.Attempts++
+	if err == nil {
+		event.Status = entity.OutboxStatusDone
+		event.LastError = ""
+	} else {
+		event.LastError = err.Error()
+		if isPermanentWebhookError(err) || event.Attempts >= config.WebhookOutboxMaxAttempts() {
+			i.deadLetter(ctx, event)
+		} else {
+			event.NextAttemptAt = i.Now().Add(outboxBackoff(event.Attempts))
+			aulogging.Logger.Ctx(ctx).Warn().Printf("webhook event id=%d for ref=%s failed attempt %d, retrying at %v: %s", event.ID, event.ReferenceId, event.Attempts, event.NextAttemptAt, event.LastError)
+		}
+	}
+
+	if err := database.GetRepository().WriteOutboxEvent(ctx, event); err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("failed to update webhook event id=%d status=%s: %s", event.ID, event.Status, err.Error())
+	}
+}
+
+func (i *Impl) deadLetter(ctx context.Context, event *entity.OutboxEvent) {
+	event.Status = entity.OutboxStatusDead
+	aulogging.Logger.Ctx(ctx).Error().Printf("webhook event id=%d for ref=%s failed %d times, giving up: %s", event.ID, event.ReferenceId, event.Attempts, event.LastError)
+
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: event.ReferenceId,
+		ApiId:       event.ApiId,
+		Kind:        "error",
+		Message:     "webhook dead-letter",
+		Details:     fmt.Sprintf("attempts=%d error=%s", event.Attempts, event.LastError),
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+	_ = i.SendErrorNotifyMail(ctx, "webhook", event.ReferenceId, "dead-letter")
+}
+
+// isPermanentWebhookError is true for errors that will not go away by retrying.
+func isPermanentWebhookError(err error) bool {
+	return errors.Is(err, WebhookValidationErr) ||
+		errors.Is(err, WebhookRefIdMismatchErr) ||
+		errors.Is(err, concardis.NoSuchID404Error)
+}
+
+// outboxBackoff is the delay before the next attempt, after the given number of failed attempts.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := config.WebhookOutboxInitialBackoff()
+	maxBackoff := config.WebhookOutboxMaxBackoff()
+	for n := 1; n < attempts && backoff < maxBackoff; n++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
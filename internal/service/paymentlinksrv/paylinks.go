@@ -2,19 +2,26 @@ package paymentlinksrv
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/attendeeservice"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database/dbrepo"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
 )
 
+// initialPaylinkStatus is the status Concardis assigns to a newly created payment link
+const initialPaylinkStatus = "waiting"
+
 func (i *Impl) ValidatePaymentLinkRequest(ctx context.Context, data cncrdapi.PaymentLinkRequestDto) url.Values {
 	errs := url.Values{}
 
@@ -30,6 +37,17 @@ func (i *Impl) ValidatePaymentLinkRequest(ctx context.Context, data cncrdapi.Pay
 	if data.VatRate < 0.0 || data.VatRate > 50.0 {
 		errs.Add("vat_rate", "vat rate should be provided in percent and must be between 0.0 and 50.0")
 	}
+	if len(data.Title) > 256 {
+		errs.Add("title", "optional title override may be at most 256 characters long")
+	}
+	if len(data.Description) > 256 {
+		errs.Add("description", "optional description override may be at most 256 characters long")
+	}
+	if len(data.Purpose) > 256 {
+		errs.Add("purpose", "optional purpose override may be at most 256 characters long")
+	}
+	validateRedirect(errs, "success_redirect", data.SuccessRedirect)
+	validateRedirect(errs, "failure_redirect", data.FailureRedirect)
 
 	if len(errs) == 0 {
 		return nil
@@ -38,13 +56,109 @@ func (i *Impl) ValidatePaymentLinkRequest(ctx context.Context, data cncrdapi.Pay
 	}
 }
 
-func (i *Impl) CreatePaymentLink(ctx context.Context, data cncrdapi.PaymentLinkRequestDto) (cncrdapi.PaymentLinkDto, uint, error) {
+// validateRedirect prevents redirect overrides from turning this service into an open redirect.
+func validateRedirect(errs url.Values, key string, value string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		errs.Add(key, "optional redirect override must be an absolute http or https url")
+		return
+	}
+	for _, host := range config.RedirectAllowedHosts() {
+		if strings.EqualFold(host, u.Hostname()) {
+			return
+		}
+	}
+	errs.Add(key, fmt.Sprintf("redirect host %s is not allowed", u.Hostname()))
+}
+
+func (i *Impl) CreatePaymentLink(ctx context.Context, data cncrdapi.PaymentLinkRequestDto, idempotencyKey string) (cncrdapi.PaymentLinkDto, uint, error) {
+	explicitKey := idempotencyKey != ""
+
+	// a client that retries while its first request is still in flight must wait for it, or it gets a second paylink
+	lockName := data.ReferenceId
+	if explicitKey {
+		lockName = "idempotency-key " + idempotencyKey
+	}
+	unlock, err := i.lockReferenceId(ctx, lockName)
+	if err != nil {
+		return cncrdapi.PaymentLinkDto{}, 0, err
+	}
+	defer unlock()
+
+	// without an explicit key we only replay open links, and the stored status may be outdated
+	existing, err := paylinkForIdempotencyKey(ctx, data.ReferenceId, idempotencyKey)
+	var refreshedApiId uint
+	var refreshedOpen bool
+	if err == nil && !explicitKey {
+		refreshedApiId = existing.ApiId
+		if refreshedOpen, err = i.refreshOpenPaylink(ctx, existing); err != nil {
+			return cncrdapi.PaymentLinkDto{}, 0, err
+		} else if !refreshedOpen {
+			err = dbrepo.PaylinkNotFoundError
+		}
+	}
+	if err == nil {
+		if requestMatchesPaylink(data, existing) {
+			return i.existingPaymentLink(ctx, existing, "create-pay-link repeated")
+		}
+		if explicitKey {
+			return i.idempotencyConflict(ctx, data, idempotencyKey, existing)
+		}
+		// without an explicit key, a changed request for the same reference id is handled like any other
+	} else if !errors.Is(err, dbrepo.PaylinkNotFoundError) {
+		return cncrdapi.PaymentLinkDto{}, 0, err
+	}
+
+	if config.VerifyAmountDue() {
+		if err := i.verifyAmountDue(ctx, data); err != nil {
+			return cncrdapi.PaymentLinkDto{}, 0, err
+		}
+	}
+
+	// avoid leaving several payable links for the same reference id around, this has caused double payments.
+	// Concurrent creates for the reference id must not both see no open link. Without an explicit
+	// idempotency key, the lock we hold already is the reference id lock.
+	if explicitKey {
+		unlockReferenceId, err := i.lockReferenceId(ctx, data.ReferenceId)
+		if err != nil {
+			return cncrdapi.PaymentLinkDto{}, 0, err
+		}
+		defer unlockReferenceId()
+	}
+	open, err := openPaylinkForReferenceId(ctx, data.ReferenceId)
+	if err != nil {
+		return cncrdapi.PaymentLinkDto{}, 0, err
+	}
+	if open != nil {
+		stillOpen := refreshedOpen
+		if open.ApiId != refreshedApiId {
+			if stillOpen, err = i.refreshOpenPaylink(ctx, open); err != nil {
+				return cncrdapi.PaymentLinkDto{}, 0, err
+			}
+		}
+		if !stillOpen {
+			open = nil
+		}
+	}
+	if open != nil {
+		if open.AmountDue == data.AmountDue && open.Currency == data.Currency && overridesMatchPaylink(data, open) {
+			return i.existingPaymentLink(ctx, open, "create-pay-link reused")
+		}
+		aulogging.Logger.Ctx(ctx).Info().Printf("replacing open paylink id=%d ref=%s, amount changed from %d %s to %d %s or texts changed", open.ApiId, open.ReferenceId, open.AmountDue, open.Currency, data.AmountDue, data.Currency)
+		if err := i.replacePaymentLink(ctx, open); err != nil {
+			return cncrdapi.PaymentLinkDto{}, 0, err
+		}
+	}
+
 	attendee, err := attendeeservice.Get().GetAttendee(ctx, uint(data.DebitorId))
 	if err != nil {
 		return cncrdapi.PaymentLinkDto{}, 0, err
 	}
 
-	concardisRequest := i.concardisCreateRequestFromApiRequest(data, attendee)
+	concardisRequest := i.concardisCreateRequestFromApiRequest(ctx, data, attendee)
 	concardisResponse, err := concardis.Get().CreatePaymentLink(ctx, concardisRequest)
 	if err != nil {
 		db := database.GetRepository()
@@ -68,33 +182,297 @@ func (i *Impl) CreatePaymentLink(ctx context.Context, data cncrdapi.PaymentLinkR
 		Details:     concardisResponse.Link,
 		RequestId:   ctxvalues.RequestId(ctx),
 	})
+	i.storePaylink(ctx, concardisResponse, concardisRequest, data.DebitorId, idempotencyKey)
 	output := i.apiResponseFromConcardisResponse(concardisResponse, concardisRequest)
 	return output, concardisResponse.ID, nil
 }
 
-func (i *Impl) concardisCreateRequestFromApiRequest(data cncrdapi.PaymentLinkRequestDto, attendee attendeeservice.AttendeeDto) concardis.PaymentLinkCreateRequest {
+func requestMatchesPaylink(data cncrdapi.PaymentLinkRequestDto, existing *entity.Paylink) bool {
+	return existing.ReferenceId == data.ReferenceId && existing.DebitorId == data.DebitorId && existing.AmountDue == data.AmountDue &&
+		existing.Currency == data.Currency && existing.VatRate == data.VatRate && overridesMatchPaylink(data, existing)
+}
+
+// overridesMatchPaylink compares the text overrides, if any. Redirects are not stored, so they cannot be compared.
+func overridesMatchPaylink(data cncrdapi.PaymentLinkRequestDto, existing *entity.Paylink) bool {
+	return (data.Title == "" || data.Title == existing.Title) &&
+		(data.Description == "" || data.Description == existing.Description) &&
+		(data.Purpose == "" || data.Purpose == existing.Purpose)
+}
+
+// paylinkForIdempotencyKey finds the payment link that a repeated create request refers to.
+//
+// Without an explicit key, this is the newest payment link for the reference id that was also created without one,
+// as long as it is still open. A cancelled, expired or paid link must not be handed out again.
+func paylinkForIdempotencyKey(ctx context.Context, referenceId string, idempotencyKey string) (*entity.Paylink, error) {
+	if idempotencyKey != "" {
+		return database.GetRepository().GetPaylinkByIdempotencyKey(ctx, idempotencyKey)
+	}
+	candidates, _, err := database.GetRepository().FindPaylinks(ctx, dbrepo.PaylinkQuery{ReferenceId: referenceId})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range candidates {
+		if p.IdempotencyKey == nil {
+			if !isOpenPaylink(p) {
+				break
+			}
+			return p, nil
+		}
+	}
+	return nil, dbrepo.PaylinkNotFoundError
+}
+
+// existingPaymentLink answers a create request with a payment link that was created earlier.
+func (i *Impl) existingPaymentLink(ctx context.Context, existing *entity.Paylink, message string) (cncrdapi.PaymentLinkDto, uint, error) {
+	aulogging.Logger.Ctx(ctx).Info().Printf("%s, returning existing paylink id=%d ref=%s", message, existing.ApiId, existing.ReferenceId)
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: existing.ReferenceId,
+		ApiId:       existing.ApiId,
+		Kind:        "duplicate",
+		Message:     message,
+		Details:     existing.Link,
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+	return apiResponseFromStoredPaylink(existing), existing.ApiId, nil
+}
+
+// idempotencyConflict refuses a create request that reuses an idempotency key for different data.
+//
+// The caller most likely reused the idempotency key by mistake, so we refuse instead of silently
+// returning a payment link for the wrong amount.
+func (i *Impl) idempotencyConflict(ctx context.Context, data cncrdapi.PaymentLinkRequestDto, idempotencyKey string, existing *entity.Paylink) (cncrdapi.PaymentLinkDto, uint, error) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("create request with idempotency key %s differs from the request that created paylink id=%d", url.QueryEscape(idempotencyKey), existing.ApiId)
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: data.ReferenceId,
+		ApiId:       existing.ApiId,
+		Kind:        "error",
+		Message:     "create-pay-link conflict",
+		Details:     fmt.Sprintf("idempotency key %s already used for ref=%s debitor=%d amount=%d currency=%s", idempotencyKey, existing.ReferenceId, existing.DebitorId, existing.AmountDue, existing.Currency),
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+	return cncrdapi.PaymentLinkDto{}, 0, IdempotencyKeyConflictErr
+}
+
+// openPaylinkForReferenceId returns the newest stored payment link for the reference id that nobody has paid on yet,
+// or nil if there is none.
+func openPaylinkForReferenceId(ctx context.Context, referenceId string) (*entity.Paylink, error) {
+	candidates, _, err := database.GetRepository().FindPaylinks(ctx, dbrepo.PaylinkQuery{
+		ReferenceId: referenceId,
+		Status:      initialPaylinkStatus,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range candidates {
+		if isOpenPaylink(p) {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// isOpenPaylink is true for stored payment links that nobody has paid on yet, according to what we know.
+func isOpenPaylink(p *entity.Paylink) bool {
+	return p.Status == initialPaylinkStatus && p.AmountPaid == 0
+}
+
+// refreshOpenPaylink asks Concardis whether a payment link we believe to be open really still is, before we
+// hand it out again or delete it. Our stored status is only updated by webhooks, which may be late or missing.
+//
+// The stored copy is updated. If Concardis no longer knows the payment link, nothing is left that could be paid,
+// so we forget it.
+func (i *Impl) refreshOpenPaylink(ctx context.Context, p *entity.Paylink) (bool, error) {
+	current, err := concardis.Get().QueryPaymentLink(ctx, p.ApiId)
+	if errors.Is(err, concardis.NoSuchID404Error) {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("open paylink id=%d ref=%s is gone at Concardis", p.ApiId, p.ReferenceId)
+		if err := database.GetRepository().DeletePaylink(ctx, p.ApiId); err != nil && !errors.Is(err, dbrepo.PaylinkNotFoundError) {
+			return false, err
+		}
+		return false, nil
+	}
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("can't query open paylink id=%d from concardis. err=%s", p.ApiId, err.Error())
+		return false, err
+	}
+
+	i.updateStoredPaylink(ctx, p.ApiId, current)
+	p.Status = current.Status
+	p.AmountPaid = paidAmount(current)
+	return isOpenPaylink(p) && !hasPaymentAttempt(current), nil
+}
+
+// hasPaymentAttempt is true if a payment is in progress or done. Concardis keeps the paylink waiting meanwhile.
+func hasPaymentAttempt(paylink concardis.PaymentLinkQueryResponse) bool {
+	for _, invoice := range paylink.Invoices {
+		for _, tx := range invoice.Transactions {
+			if tx.Status == "confirmed" || isPendingStatus(tx.Status) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replacePaymentLink deletes an open payment link that is about to be replaced by one for a different amount.
+//
+// If Concardis no longer knows the payment link, there is nothing left that could be paid, so we just forget it.
+func (i *Impl) replacePaymentLink(ctx context.Context, open *entity.Paylink) error {
+	err := i.DeletePaymentLink(ctx, open.ApiId)
+	if errors.Is(err, concardis.NoSuchID404Error) {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("open paylink id=%d ref=%s was already gone at Concardis", open.ApiId, open.ReferenceId)
+		return database.GetRepository().DeletePaylink(ctx, open.ApiId)
+	}
+	return err
+}
+
+// storePaylink keeps a local copy of a newly created payment link.
+//
+// The payment link has already been created at this point, so failing to store it is not treated
+// as an error of the request, but it is protocolled and an error notification mail is sent.
+func (i *Impl) storePaylink(ctx context.Context, response concardis.PaymentLinkCreated, request concardis.PaymentLinkCreateRequest, debitorId uint64, idempotencyKey string) {
+	var key *string
+	if idempotencyKey != "" {
+		key = &idempotencyKey
+	}
+	db := database.GetRepository()
+	err := db.WritePaylink(ctx, &entity.Paylink{
+		IdempotencyKey: key,
+		ApiId:          response.ID,
+		ReferenceId:    response.ReferenceID,
+		DebitorId:      debitorId,
+		Title:          request.Title,
+		Description:    request.Description,
+		Purpose:        request.Purpose,
+		AmountDue:      request.Amount,
+		Currency:       request.Currency,
+		VatRate:        request.VatRate,
+		Link:           response.Link,
+		Status:         initialPaylinkStatus,
+	})
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("failed to store paylink id=%d ref=%s: %s", response.ID, response.ReferenceID, err.Error())
+		_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+			ReferenceId: response.ReferenceID,
+			ApiId:       response.ID,
+			Kind:        "error",
+			Message:     "store-pay-link failed",
+			Details:     err.Error(),
+			RequestId:   ctxvalues.RequestId(ctx),
+		})
+		_ = i.SendErrorNotifyMail(ctx, "store-pay-link", response.ReferenceID, "database-error")
+	}
+}
+
+// updateStoredPaylink records the most recent status and paid amount Concardis reported for a payment link.
+//
+// Payment links created before we started storing them locally are silently skipped.
+func (i *Impl) updateStoredPaylink(ctx context.Context, paylinkId uint, paylink concardis.PaymentLinkQueryResponse) {
+	db := database.GetRepository()
+	stored, err := db.GetPaylinkByApiId(ctx, paylinkId)
+	if err != nil {
+		if !errors.Is(err, dbrepo.PaylinkNotFoundError) {
+			aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("failed to read stored paylink id=%d: %s", paylinkId, err.Error())
+		}
+		return
+	}
+	amountPaid := paidAmount(paylink)
+	if stored.Status == paylink.Status && stored.AmountPaid == amountPaid {
+		return
+	}
+
+	stored.Status = paylink.Status
+	stored.AmountPaid = amountPaid
+	if err := db.WritePaylink(ctx, stored); err != nil {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("failed to update status of stored paylink id=%d: %s", paylinkId, err.Error())
+	}
+}
+
+func (i *Impl) concardisCreateRequestFromApiRequest(ctx context.Context, data cncrdapi.PaymentLinkRequestDto, attendee attendeeservice.AttendeeDto) concardis.PaymentLinkCreateRequest {
 	shortenedOrderId := strings.ReplaceAll(data.ReferenceId, "-", "")
 	if len(shortenedOrderId) > 30 {
 		shortenedOrderId = shortenedOrderId[:30]
 	}
+	texts, language := invoiceTexts(attendee.RegistrationLanguage)
+	texts = renderInvoiceTexts(ctx, texts, config.InvoiceTemplateData{
+		BadgeNumber: attendee.Id,
+		Nickname:    attendee.Nickname,
+		ReferenceId: data.ReferenceId,
+		Amount:      formatAmount(data.AmountDue),
+		Currency:    data.Currency,
+	})
+	if data.Title != "" {
+		texts.Title = data.Title
+	}
+	if data.Description != "" {
+		texts.Description = data.Description
+	}
+	if data.Purpose != "" {
+		texts.Purpose = data.Purpose
+	}
+	successRedirect := config.SuccessRedirect()
+	if data.SuccessRedirect != "" {
+		successRedirect = data.SuccessRedirect
+	}
+	failureRedirect := config.FailureRedirect()
+	if data.FailureRedirect != "" {
+		failureRedirect = data.FailureRedirect
+	}
 	return concardis.PaymentLinkCreateRequest{
-		Title:       config.InvoiceTitle(),
-		Description: config.InvoiceDescription(),
+		Title:       texts.Title,
+		Description: texts.Description,
 		PSP:         1,
 		ReferenceId: data.ReferenceId,
 		OrderId:     shortenedOrderId,
-		Purpose:     config.InvoicePurpose(),
+		Purpose:     texts.Purpose,
 		Amount:      data.AmountDue,
 		VatRate:     data.VatRate,
 		Currency:    data.Currency,
 		SKU:         "registration",
 		Email:       attendee.Email,
+		Fields:      paymentPageFields(attendee),
+		Language:    language,
 
-		SuccessRedirectUrl: config.SuccessRedirect(),
-		FailedRedirectUrl:  config.FailureRedirect(),
+		SuccessRedirectUrl: successRedirect,
+		FailedRedirectUrl:  failureRedirect,
 	}
 }
 
+// paymentPageFields lists the configured address fields in a fixed order, prefilled from the attendee where configured.
+func paymentPageFields(attendee attendeeservice.AttendeeDto) []concardis.PaymentLinkField {
+	values := []struct {
+		name  string
+		value string
+	}{
+		{"forename", attendee.FirstName},
+		{"surname", attendee.LastName},
+		{"street", attendee.Street},
+		{"postcode", attendee.Zip},
+		{"place", attendee.City},
+		{"country", attendee.Country},
+	}
+
+	configured := config.InvoiceFields()
+	result := make([]concardis.PaymentLinkField, 0)
+	for _, v := range values {
+		fieldConfig, ok := configured[v.name]
+		if !ok {
+			continue
+		}
+		field := concardis.PaymentLinkField{
+			Name:      v.name,
+			Active:    fieldConfig.Show,
+			Mandatory: fieldConfig.Mandatory,
+		}
+		if fieldConfig.Prefill {
+			field.DefaultValue = v.value
+		}
+		result = append(result, field)
+	}
+	return result
+}
+
 func (i *Impl) apiResponseFromConcardisResponse(response concardis.PaymentLinkCreated, request concardis.PaymentLinkCreateRequest) cncrdapi.PaymentLinkDto {
 	return cncrdapi.PaymentLinkDto{
 		Title:       request.Title,
@@ -106,6 +484,7 @@ func (i *Impl) apiResponseFromConcardisResponse(response concardis.PaymentLinkCr
 		Currency:    request.Currency,
 		VatRate:     request.VatRate,
 		Link:        response.Link,
+		Status:      normalizedStatus(initialPaylinkStatus, request.Amount, 0),
 	}
 }
 
@@ -135,20 +514,135 @@ func (i *Impl) GetPaymentLink(ctx context.Context, id uint) (cncrdapi.PaymentLin
 		RequestId:   ctxvalues.RequestId(ctx),
 	})
 
-	// TODO lots of missing fields, can we get them from downstream?
-
+	amountPaid := paidAmount(data)
 	result := cncrdapi.PaymentLinkDto{
-		ReferenceId: data.ReferenceID,
-		Purpose:     data.Purpose["1"],
-		AmountDue:   data.Amount,
-		AmountPaid:  0,
-		Currency:    data.Currency,
-		Link:        data.Link,
+		ReferenceId:  data.ReferenceID,
+		Purpose:      data.Purpose["1"],
+		AmountDue:    data.Amount,
+		AmountPaid:   amountPaid,
+		Currency:     data.Currency,
+		Link:         data.Link,
+		Status:       normalizedStatus(data.Status, data.Amount, amountPaid),
+		Transactions: transactionDtos(data),
+	}
+
+	// the Concardis api does not give us title, description and vat rate, but we remember what we sent
+	stored, err := db.GetPaylinkByApiId(ctx, id)
+	if err == nil {
+		result.Title = stored.Title
+		result.Description = stored.Description
+		result.Purpose = stored.Purpose
+		result.VatRate = stored.VatRate
+	} else if !errors.Is(err, dbrepo.PaylinkNotFoundError) {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("failed to read stored paylink id=%d, returning incomplete data: %s", id, err.Error())
 	}
 
 	return result, nil
 }
 
+func (i *Impl) ListPaymentLinks(ctx context.Context, filter PaymentLinkFilter) (cncrdapi.PaymentLinkListDto, error) {
+	result := cncrdapi.PaymentLinkListDto{
+		Paylinks: make([]cncrdapi.PaymentLinkListEntryDto, 0),
+		Page:     filter.Page,
+		PageSize: filter.PageSize,
+	}
+
+	paylinks, total, err := database.GetRepository().FindPaylinks(ctx, dbrepo.PaylinkQuery{
+		ReferenceId:   filter.ReferenceId,
+		DebitorId:     filter.DebitorId,
+		Status:        filter.Status,
+		CreatedAfter:  filter.CreatedAfter,
+		CreatedBefore: filter.CreatedBefore,
+		Offset:        (filter.Page - 1) * filter.PageSize,
+		Limit:         filter.PageSize,
+	})
+	if err != nil {
+		return result, err
+	}
+
+	result.Total = total
+	for _, p := range paylinks {
+		result.Paylinks = append(result.Paylinks, cncrdapi.PaymentLinkListEntryDto{
+			Id:        p.ApiId,
+			DebitorId: p.DebitorId,
+			Status:    p.Status,
+			CreatedAt: p.CreatedAt.Format(time.RFC3339),
+			Paylink:   apiResponseFromStoredPaylink(p),
+		})
+	}
+	return result, nil
+}
+
+func apiResponseFromStoredPaylink(p *entity.Paylink) cncrdapi.PaymentLinkDto {
+	return cncrdapi.PaymentLinkDto{
+		Title:       p.Title,
+		Description: p.Description,
+		ReferenceId: p.ReferenceId,
+		Purpose:     p.Purpose,
+		AmountDue:   p.AmountDue,
+		AmountPaid:  p.AmountPaid,
+		Currency:    p.Currency,
+		VatRate:     p.VatRate,
+		Link:        p.Link,
+		Status:      normalizedStatus(p.Status, p.AmountDue, p.AmountPaid),
+	}
+}
+
+// paidAmount is the sum of all confirmed transactions, minus anything that has since been refunded.
+func paidAmount(paylink concardis.PaymentLinkQueryResponse) int64 {
+	paid := int64(0)
+	for _, invoice := range paylink.Invoices {
+		for _, tx := range invoice.Transactions {
+			if tx.Status == "confirmed" || isRefundStatus(tx.Status) {
+				remaining := tx.Amount - reportedRefundAmount(tx)
+				if remaining > 0 {
+					paid += remaining
+				}
+			}
+		}
+	}
+	return paid
+}
+
+// normalizedStatus maps the Concardis paylink status and the amounts to one of our own statuses,
+// see the PaymentLink schema in the openapi spec.
+//
+// Concardis reports "waiting" both for links nobody has tried to pay yet and for payments in progress,
+// so without a paid amount we treat it as open.
+func normalizedStatus(paylinkStatus string, amountDue int64, amountPaid int64) string {
+	switch {
+	case isRefundStatus(paylinkStatus) && amountPaid == 0:
+		return "refunded"
+	case isRefundStatus(paylinkStatus):
+		return "partially-refunded"
+	case amountPaid > 0 && amountPaid >= amountDue:
+		return "paid"
+	case amountPaid > 0:
+		return "partially-paid"
+	case paylinkStatus != initialPaylinkStatus && isPendingStatus(paylinkStatus):
+		return "pending"
+	default:
+		return "open"
+	}
+}
+
+func transactionDtos(paylink concardis.PaymentLinkQueryResponse) []cncrdapi.PaymentLinkTransactionDto {
+	result := make([]cncrdapi.PaymentLinkTransactionDto, 0)
+	for _, invoice := range paylink.Invoices {
+		for _, tx := range invoice.Transactions {
+			result = append(result, cncrdapi.PaymentLinkTransactionDto{
+				Uuid:   tx.UUID,
+				Time:   tx.Time,
+				Amount: tx.Amount,
+				Status: tx.Status,
+				Brand:  tx.Payment.Brand,
+				Psp:    tx.Psp,
+			})
+		}
+	}
+	return result
+}
+
 func (i *Impl) DeletePaymentLink(ctx context.Context, id uint) error {
 	err := concardis.Get().DeletePaymentLink(ctx, id)
 	if err != nil {
@@ -166,6 +660,9 @@ func (i *Impl) DeletePaymentLink(ctx context.Context, id uint) error {
 	}
 
 	db := database.GetRepository()
+	if err := db.DeletePaylink(ctx, id); err != nil && !errors.Is(err, dbrepo.PaylinkNotFoundError) {
+		aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("failed to delete stored paylink id=%d: %s", id, err.Error())
+	}
 	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
 		ReferenceId: "",
 		ApiId:       id,
@@ -0,0 +1,432 @@
+package paymentlinksrv
+
+import (
+	"context"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/paymentservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
+	"net/url"
+)
+
+func (i *Impl) ValidateRefundRequest(ctx context.Context, data cncrdapi.PaymentLinkRefundRequestDto) url.Values {
+	errs := url.Values{}
+
+	if data.Amount < 0 {
+		errs.Add("amount", "must be a positive integer (the amount to refund in cents), or 0 or missing to refund everything")
+	}
+	if len(data.Reason) > 255 {
+		errs.Add("reason", "reason may be at most 255 characters long")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	} else {
+		for k, v := range errs {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("refund request validation error: %s: %s", k, v[0])
+		}
+		return errs
+	}
+}
+
+func (i *Impl) RefundPaymentLink(ctx context.Context, id uint, request cncrdapi.PaymentLinkRefundRequestDto) error {
+	paylink, err := concardis.Get().QueryPaymentLink(ctx, id)
+	if err != nil {
+		i.refundFailed(ctx, "", id, err.Error(), fmt.Sprintf("paylink id %d", id), err.Error())
+		return err
+	}
+
+	// held until the refunds are booked, so concurrent refunds or refund webhooks see our bookings
+	unlock, err := i.lockReferenceId(ctx, paylink.ReferenceID)
+	if err != nil {
+		i.refundFailed(ctx, paylink.ReferenceID, id, err.Error(), paylink.ReferenceID, "lock-error")
+		return err
+	}
+	defer unlock()
+
+	bookings, err := database.GetRepository().FindRefundBookings(ctx, paylink.ReferenceID)
+	if err != nil {
+		i.refundFailed(ctx, paylink.ReferenceID, id, err.Error(), paylink.ReferenceID, "db-error")
+		return err
+	}
+	booked := bookedRefunds(bookings)
+
+	refundable := refundableTransactions(paylink)
+	remaining := int64(0)
+	for _, tx := range refundable {
+		remaining += refundableAmount(tx, booked[tx.ID])
+	}
+
+	if remaining == 0 {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("refund requested for paylink id=%d ref=%s without confirmed transactions", id, paylink.ReferenceID)
+		i.refundRejected(ctx, paylink.ReferenceID, id, RefundNotPossibleErr.Error())
+		return RefundNotPossibleErr
+	}
+
+	toRefund := request.Amount
+	if toRefund == 0 {
+		toRefund = remaining
+	}
+	if toRefund > remaining {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("refund requested for paylink id=%d ref=%s exceeds refundable amount, requested=%d remaining=%d", id, paylink.ReferenceID, toRefund, remaining)
+		i.refundRejected(ctx, paylink.ReferenceID, id, fmt.Sprintf("%s: requested=%d remaining=%d", RefundAmountExceededErr.Error(), toRefund, remaining))
+		return RefundAmountExceededErr
+	}
+
+	for _, tx := range refundable {
+		if toRefund == 0 {
+			break
+		}
+		amount := refundableAmount(tx, booked[tx.ID])
+		if amount > toRefund {
+			amount = toRefund
+		}
+
+		refunded, err := concardis.Get().RefundTransaction(ctx, tx.ID, amount)
+		if err != nil {
+			i.refundFailed(ctx, paylink.ReferenceID, id, fmt.Sprintf("transaction id=%d: %s", tx.ID, err.Error()), paylink.ReferenceID, err.Error())
+			return err
+		}
+		toRefund -= amount
+
+		aulogging.Logger.Ctx(ctx).Info().Printf("refunded transaction id=%d of paylink id=%d ref=%s amount=%d status=%s refunded=%d", tx.ID, id, paylink.ReferenceID, amount, refunded.Status, refunded.Invoice.RefundedAmount)
+		db := database.GetRepository()
+		_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+			ReferenceId: paylink.ReferenceID,
+			ApiId:       id,
+			Kind:        "success",
+			Message:     "refund-pay-link",
+			Details:     fmt.Sprintf("transaction id=%d status=%s amount=%d refunded=%d reason=%s", tx.ID, refunded.Status, amount, refunded.Invoice.RefundedAmount, request.Reason),
+			RequestId:   ctxvalues.RequestId(ctx),
+		})
+
+		comment := "CC refund orderId " + refunded.UUID
+		if request.Reason != "" {
+			comment += " - " + request.Reason
+		}
+		if err := i.bookRefund(ctx, "refund-pay-link", id, paylink, refunded, amount, comment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *Impl) refundRejected(ctx context.Context, referenceId string, id uint, details string) {
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: referenceId,
+		ApiId:       id,
+		Kind:        "error",
+		Message:     "refund-pay-link failed",
+		Details:     details,
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+}
+
+func (i *Impl) refundFailed(ctx context.Context, referenceId string, id uint, details string, mailReference string, mailStatus string) {
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: referenceId,
+		ApiId:       id,
+		Kind:        "error",
+		Message:     "refund-pay-link failed",
+		Details:     details,
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+	_ = i.SendErrorNotifyMail(ctx, "refund-pay-link", mailReference, mailStatus)
+}
+
+// bookReportedRefunds books refunds and chargebacks reported by the webhook. These may have been made
+// in the Concardis back office or by the card holder's bank. Refunds that were already booked are skipped.
+func (i *Impl) bookReportedRefunds(ctx context.Context, paylinkId uint, paylink concardis.PaymentLinkQueryResponse) error {
+	unlock, err := i.lockReferenceId(ctx, paylink.ReferenceID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	db := database.GetRepository()
+	bookings, err := db.FindRefundBookings(ctx, paylink.ReferenceID)
+	if err != nil {
+		_ = i.SendErrorNotifyMail(ctx, "webhook", fmt.Sprintf("refId: %s", paylink.ReferenceID), "db-error")
+		return err
+	}
+	booked := bookedRefunds(bookings)
+	pending := make(map[int64]bool)
+	for _, b := range bookings {
+		pending[b.TransactionId] = isPendingRefund(b)
+	}
+
+	found := false
+	for _, invoice := range paylink.Invoices {
+		for _, tx := range invoice.Transactions {
+			if !isRefundStatus(tx.Status) {
+				continue
+			}
+			found = true
+
+			reported := reportedRefundAmount(tx)
+			details := fmt.Sprintf("transaction id=%d amount=%d refunded=%d booked=%d", tx.ID, tx.Amount, reported, booked[tx.ID])
+			amount := reported - booked[tx.ID]
+			if amount <= 0 && pending[tx.ID] {
+				// a refund we booked as pending has now been confirmed by the bank
+				if err := i.bookRefund(ctx, "webhook", paylinkId, paylink, tx, 0, ""); err != nil {
+					return err
+				}
+
+				aulogging.Logger.Ctx(ctx).Info().Printf("webhook confirmed pending refund for transaction id=%d ref=%s", tx.ID, paylink.ReferenceID)
+				_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+					ReferenceId: paylink.ReferenceID,
+					ApiId:       paylinkId,
+					Kind:        tx.Status,
+					Message:     "webhook confirm-refund",
+					Details:     details,
+					RequestId:   ctxvalues.RequestId(ctx),
+				})
+				continue
+			}
+			if amount <= 0 {
+				aulogging.Logger.Ctx(ctx).Info().Printf("webhook refund for transaction id=%d ref=%s already booked", tx.ID, paylink.ReferenceID)
+				_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+					ReferenceId: paylink.ReferenceID,
+					ApiId:       paylinkId,
+					Kind:        tx.Status,
+					Message:     "webhook refund already booked",
+					Details:     details,
+					RequestId:   ctxvalues.RequestId(ctx),
+				})
+				continue
+			}
+
+			comment := fmt.Sprintf("CC refund orderId %s (reported by webhook)", tx.UUID)
+			if tx.Status == "chargeback" {
+				comment = fmt.Sprintf("CC chargeback orderId %s", tx.UUID)
+			}
+			if err := i.bookRefund(ctx, "webhook", paylinkId, paylink, tx, amount, comment); err != nil {
+				return err
+			}
+
+			aulogging.Logger.Ctx(ctx).Info().Printf("webhook booked %s for transaction id=%d ref=%s amount=%d", tx.Status, tx.ID, paylink.ReferenceID, amount)
+			_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+				ReferenceId: paylink.ReferenceID,
+				ApiId:       paylinkId,
+				Kind:        tx.Status,
+				Message:     "webhook book-refund",
+				Details:     details,
+				RequestId:   ctxvalues.RequestId(ctx),
+			})
+		}
+	}
+
+	if !found {
+		// the paylink claims a refund, but none of its transactions agree, so a human needs to look at it
+		aulogging.Logger.Ctx(ctx).Warn().Printf("webhook paylink ref=%s in status %s has no refunded transactions", paylink.ReferenceID, paylink.Status)
+		_ = i.SendErrorNotifyMail(ctx, "webhook", paylink.ReferenceID, paylink.Status)
+	}
+	return nil
+}
+
+// bookRefund adds a negative payment to the payment service, so the balance of the attendee stays correct.
+//
+// Refunds the bank has not confirmed yet are booked as pending, and promoted to valid once a refund status is
+// reported for the transaction. Further refunds of a transaction with a pending refund are added to it.
+//
+// Also records the booked amount, so the refund is not booked a second time when it is reported by the webhook.
+func (i *Impl) bookRefund(ctx context.Context, operation string, paylinkId uint, paylink concardis.PaymentLinkQueryResponse, refunded concardis.TransactionData, amount int64, comment string) error {
+	status := paymentservice.Valid
+	if !isRefundStatus(refunded.Status) {
+		// refund_pending - the bank has not confirmed yet
+		status = paymentservice.Pending
+	}
+
+	booking, err := i.refundBooking(ctx, paylinkId, paylink.ReferenceID, refunded.ID)
+	if err != nil {
+		_ = i.SendErrorNotifyMail(ctx, operation, fmt.Sprintf("refId: %s", paylink.ReferenceID), "db-error")
+		return err
+	}
+
+	if isPendingRefund(booking) {
+		err = i.updatePendingRefund(ctx, operation, paylink.ReferenceID, booking.PendingTxId, status, amount)
+	} else {
+		effective := i.Now().Format(isoDateFormat)
+		transaction := paymentservice.Transaction{
+			DebitorID: i.debitorIdForRefund(ctx, operation, paylinkId, paylink.ReferenceID),
+			Type:      paymentservice.Payment,
+			Method:    transactionPaymentMethod(refunded),
+			Amount: paymentservice.Amount{
+				GrossCent: -amount,
+				Currency:  paylink.Currency,
+				VatRate:   paylink.VatRate,
+			},
+			Comment:       comment,
+			Status:        status,
+			EffectiveDate: effective,
+			DueDate:       effective,
+		}
+
+		err = paymentservice.Get().AddTransaction(ctx, transaction)
+		if err != nil {
+			aulogging.Logger.Ctx(ctx).Error().Printf("refund could not create transaction in payment service! (money was refunded, but the balance is now wrong) reference_id=%s", paylink.ReferenceID)
+			_ = i.SendErrorNotifyMail(ctx, operation, fmt.Sprintf("refId: %s", paylink.ReferenceID), "create-refund-err")
+		} else if status == paymentservice.Pending {
+			// so we can find it again when the refund is confirmed
+			booking.PendingTxId = i.pendingRefundId(ctx, operation, paylink.ReferenceID, transaction)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	booking.BookedAmount += amount
+	booking.Status = string(status)
+	if status == paymentservice.Valid {
+		booking.PendingTxId = ""
+	}
+	i.recordRefundBooking(ctx, operation, booking)
+	return nil
+}
+
+// updatePendingRefund sets the status of a pending refund transaction, and adds amount to it.
+func (i *Impl) updatePendingRefund(ctx context.Context, operation string, referenceId string, pendingTxId string, status paymentservice.TransactionStatus, amount int64) error {
+	transaction, err := paymentservice.Get().GetTransactionByReferenceId(ctx, pendingTxId)
+	if err == nil {
+		transaction.Amount.GrossCent -= amount
+		transaction.Status = status
+		err = paymentservice.Get().UpdateTransaction(ctx, transaction)
+	}
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("refund could not update pending refund transaction %s in payment service! reference_id=%s", pendingTxId, referenceId)
+		_ = i.SendErrorNotifyMail(ctx, operation, fmt.Sprintf("refId: %s", referenceId), "update-refund-err")
+		return err
+	}
+	return nil
+}
+
+// pendingRefundId finds the identifier the payment service has assigned to a pending refund we just added.
+//
+// The payment service chooses transaction identifiers itself, so we look for the newest pending transaction
+// of the debitor with our amount and comment. The comment contains the Concardis order id.
+//
+// Failure is not returned, because the booking in the payment service already happened. Without the identifier,
+// the refund stays pending in the payment service, and someone has to confirm it manually.
+func (i *Impl) pendingRefundId(ctx context.Context, operation string, referenceId string, added paymentservice.Transaction) string {
+	transactions, err := paymentservice.Get().FindTransactions(ctx, added.DebitorID)
+	if err == nil {
+		for k := len(transactions) - 1; k >= 0; k-- {
+			tx := transactions[k]
+			if tx.ID != "" && tx.Status == paymentservice.Pending && tx.Type == added.Type &&
+				tx.Amount.GrossCent == added.Amount.GrossCent && tx.Comment == added.Comment {
+				return tx.ID
+			}
+		}
+		err = paymentservice.NotFoundError
+	}
+	aulogging.Logger.Ctx(ctx).Error().Printf("refund could not find pending refund transaction in payment service, it needs to be confirmed manually: %s reference_id=%s", err.Error(), referenceId)
+	_ = i.SendErrorNotifyMail(ctx, operation, fmt.Sprintf("refId: %s", referenceId), "find-refund-err")
+	return ""
+}
+
+// refundBooking returns the refund booking for a transaction, or a new one if nothing has been booked yet.
+func (i *Impl) refundBooking(ctx context.Context, paylinkId uint, referenceId string, transactionId int64) (*entity.RefundBooking, error) {
+	bookings, err := database.GetRepository().FindRefundBookings(ctx, referenceId)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bookings {
+		if b.TransactionId == transactionId {
+			return b, nil
+		}
+	}
+	return &entity.RefundBooking{
+		ReferenceId:   referenceId,
+		ApiId:         paylinkId,
+		TransactionId: transactionId,
+	}, nil
+}
+
+// recordRefundBooking saves the booked refunds of a transaction.
+//
+// Failure is not returned, because the booking in the payment service already happened, and
+// failing would cause a retry and thus a double booking.
+func (i *Impl) recordRefundBooking(ctx context.Context, operation string, booking *entity.RefundBooking) {
+	err := database.GetRepository().WriteRefundBooking(ctx, booking)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("could not record refund booking for transaction id=%d ref=%s booked=%d - it may get booked twice", booking.TransactionId, booking.ReferenceId, booking.BookedAmount)
+		_ = i.SendErrorNotifyMail(ctx, operation, fmt.Sprintf("refId: %s", booking.ReferenceId), "refund-booking-err")
+	}
+}
+
+// debitorIdForRefund prefers the debitor of the original upstream transaction over parsing the reference id.
+func (i *Impl) debitorIdForRefund(ctx context.Context, operation string, paylinkId uint, referenceId string) uint {
+	original, err := paymentservice.Get().GetTransactionByReferenceId(ctx, referenceId)
+	if err == nil && original.DebitorID != 0 {
+		return original.DebitorID
+	}
+
+	debitorId, err := debitorIdFromReferenceID(referenceId)
+	if err != nil {
+		i.debitorIdParseFailed(ctx, operation, referenceId, paylinkId, err)
+	}
+	return debitorId
+}
+
+// refundableTransactions returns all transactions that were confirmed, and possibly already partially refunded.
+func refundableTransactions(paylink concardis.PaymentLinkQueryResponse) []concardis.TransactionData {
+	result := make([]concardis.TransactionData, 0)
+	for _, invoice := range paylink.Invoices {
+		for _, tx := range invoice.Transactions {
+			if tx.Status == "confirmed" || tx.Status == "partially-refunded" {
+				result = append(result, tx)
+			}
+		}
+	}
+	return result
+}
+
+// refundableAmount is what is left of a transaction after the refunds reported by Concardis or booked by us.
+//
+// Both are totals for the transaction, so the larger one counts. Concardis does not always report the refunded
+// amount for the transactions of a payment link, and our bookings miss refunds nobody told us about yet.
+func refundableAmount(tx concardis.TransactionData, booked int64) int64 {
+	refunded := tx.Invoice.RefundedAmount
+	if booked > refunded {
+		refunded = booked
+	}
+	remaining := tx.Amount - refunded
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// bookedRefunds maps transaction ids to the refund amounts booked for them so far.
+func bookedRefunds(bookings []*entity.RefundBooking) map[int64]int64 {
+	booked := make(map[int64]int64)
+	for _, b := range bookings {
+		booked[b.TransactionId] = b.BookedAmount
+	}
+	return booked
+}
+
+func isPendingRefund(booking *entity.RefundBooking) bool {
+	return booking.Status == string(paymentservice.Pending) && booking.PendingTxId != ""
+}
+
+func isRefundStatus(status string) bool {
+	return status == "refunded" || status == "partially-refunded" || status == "chargeback"
+}
+
+// reportedRefundAmount is the total amount Concardis reports as refunded for a transaction.
+//
+// A chargeback may not set the refunded amount, in that case the whole transaction is gone.
+func reportedRefundAmount(tx concardis.TransactionData) int64 {
+	if tx.Status == "chargeback" && tx.Invoice.RefundedAmount == 0 {
+		return tx.Amount
+	}
+	return tx.Invoice.RefundedAmount
+}
@@ -0,0 +1,141 @@
+package paymentlinksrv
+
+import (
+	"context"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/paymentservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
+	"time"
+)
+
+// ReplayTransactions books the confirmed paylinks of the last days.
+//
+// The replay runs while the caller waits for the response, so it stops processing paylinks once
+// replayTimeBudget has passed, and marks the result as incomplete. Replaying again is safe, because
+// paylinks that were already booked are skipped.
+func (i *Impl) ReplayTransactions(ctx context.Context, days uint) (cncrdapi.TransactionReplayDto, error) {
+	result := cncrdapi.TransactionReplayDto{
+		Results: make([]cncrdapi.TransactionReplayResultDto, 0),
+	}
+
+	timeLessThan := i.Now()
+	deadline := timeLessThan.Add(replayTimeBudget())
+	timeGreaterThan := timeLessThan.Add(-time.Duration(days) * 24 * time.Hour)
+
+	transactions, err := concardis.Get().QueryTransactions(ctx, timeGreaterThan, timeLessThan)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("can't query transactions from concardis. err=%s", err.Error())
+		db := database.GetRepository()
+		_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+			ReferenceId: "",
+			Kind:        "error",
+			Message:     "replay query-transactions failed",
+			Details:     err.Error(),
+			RequestId:   ctxvalues.RequestId(ctx),
+		})
+		_ = i.SendErrorNotifyMail(ctx, "replay", fmt.Sprintf("last %d days", days), "api-error")
+		return result, err
+	}
+
+	aulogging.Logger.Ctx(ctx).Info().Printf("replaying %d transactions from the last %d days", len(transactions), days)
+
+	// a payment link may have more than one confirmed transaction, but we book each paylink only once
+	seen := make(map[uint]bool)
+	for _, tx := range transactions {
+		if tx.Status != "confirmed" {
+			continue
+		}
+		paylinkId := tx.Invoice.PaymentRequestId
+		if seen[paylinkId] {
+			continue
+		}
+		if i.Now().After(deadline) {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("replay stopped after %d paylinks to answer before the write timeout, replay again to process the rest", len(result.Results))
+			result.Incomplete = true
+			break
+		}
+		seen[paylinkId] = true
+
+		entry := i.replayTransaction(ctx, tx)
+		result.Results = append(result.Results, entry)
+
+		db := database.GetRepository()
+		_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+			ReferenceId: entry.ReferenceId,
+			ApiId:       entry.PaylinkId,
+			Kind:        "replay",
+			Message:     "replay " + entry.Outcome,
+			Details:     entry.Details,
+			RequestId:   ctxvalues.RequestId(ctx),
+		})
+	}
+
+	return result, nil
+}
+
+// replayTimeBudget is how long a replay may process paylinks. It leaves part of the server write
+// timeout for the paylink that is being processed when it runs out, and for writing the response.
+func replayTimeBudget() time.Duration {
+	return config.ServerWriteTimeout() / 2
+}
+
+func (i *Impl) replayTransaction(ctx context.Context, tx concardis.TransactionData) cncrdapi.TransactionReplayResultDto {
+	entry := cncrdapi.TransactionReplayResultDto{
+		ReferenceId: tx.Invoice.ReferenceID,
+		PaylinkId:   tx.Invoice.PaymentRequestId,
+	}
+	if entry.ReferenceId == "" {
+		entry.ReferenceId = tx.ReferenceID
+	}
+
+	if entry.PaylinkId == 0 {
+		entry.Outcome = string(BookingSkipped)
+		entry.Details = fmt.Sprintf("transaction id=%d does not belong to a paylink", tx.ID)
+		return entry
+	}
+
+	paylink, err := concardis.Get().QueryPaymentLink(ctx, entry.PaylinkId)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("replay can't query payment link from concardis. err=%s", err.Error())
+		entry.Outcome = string(BookingFailed)
+		entry.Details = "query-pay-link failed: " + err.Error()
+		return entry
+	}
+
+	if paylink.ReferenceID != entry.ReferenceId {
+		aulogging.Logger.Ctx(ctx).Error().Printf("replay reference_id mismatch, ref_id in transaction=%s, ref_id in paylink data=%s", entry.ReferenceId, paylink.ReferenceID)
+		entry.Outcome = string(BookingFailed)
+		entry.Details = fmt.Sprintf("response ref-id=%s vs transaction ref-id=%s", paylink.ReferenceID, entry.ReferenceId)
+		return entry
+	}
+
+	if !isOwnReferenceId(paylink.ReferenceID) {
+		// transactions for other installations (previous years, etc.) are expected in the time window
+		entry.Outcome = string(BookingSkipped)
+		entry.Details = "ref-id-prefix"
+		return entry
+	}
+
+	if paylink.Status != "confirmed" {
+		entry.Outcome = string(BookingSkipped)
+		entry.Details = "paylink status=" + paylink.Status
+		return entry
+	}
+
+	outcome, err := i.bookPaylink(ctx, entry.PaylinkId, paylink, tx.ID, paymentservice.Valid)
+	entry.Outcome = string(outcome)
+	if err != nil {
+		entry.Details = err.Error()
+	} else if outcome == BookingSkipped {
+		entry.Details = "already valid"
+	} else if outcome == BookingRefused {
+		entry.Details = "paid amount does not match amount due"
+	}
+	return entry
+}
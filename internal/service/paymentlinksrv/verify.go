@@ -0,0 +1,60 @@
+package paymentlinksrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/paymentservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
+	"math"
+	"net/url"
+)
+
+// verifyAmountDue checks the request against the transaction the payment service has for the reference id,
+// so a compromised or buggy caller cannot create payment links for the wrong sum.
+//
+// Returns an *AmountMismatchError if the request does not match, or the error from the payment service.
+func (i *Impl) verifyAmountDue(ctx context.Context, data cncrdapi.PaymentLinkRequestDto) error {
+	tx, err := paymentservice.Get().GetTransactionByReferenceId(ctx, data.ReferenceId)
+	if err != nil && !errors.Is(err, paymentservice.NotFoundError) {
+		aulogging.Logger.Ctx(ctx).Error().WithErr(err).Printf("failed to look up ref=%s in payment service for amount verification: %s", data.ReferenceId, err.Error())
+		return err
+	}
+
+	errs := url.Values{}
+	if err != nil || (tx.Type != paymentservice.Due && tx.Status != paymentservice.Tentative) {
+		errs.Add("reference_id", "the payment service has no due or tentative transaction for this reference id")
+	} else {
+		if tx.Amount.GrossCent != data.AmountDue {
+			errs.Add("amount_due", fmt.Sprintf("does not match the amount the payment service expects (%d)", tx.Amount.GrossCent))
+		}
+		if tx.Amount.Currency != data.Currency {
+			errs.Add("currency", fmt.Sprintf("does not match the currency the payment service expects (%s)", tx.Amount.Currency))
+		}
+		if math.Abs(tx.Amount.VatRate-data.VatRate) > 0.001 {
+			errs.Add("vat_rate", fmt.Sprintf("does not match the vat rate the payment service expects (%g)", tx.Amount.VatRate))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	for k, v := range errs {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("paylink request for ref=%s does not match payment service: %s: %s", data.ReferenceId, k, v[0])
+	}
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: data.ReferenceId,
+		Kind:        "error",
+		Message:     "create-pay-link amount mismatch",
+		Details:     fmt.Sprintf("requested amount=%d currency=%s vat=%g, payment service has id=%s type=%s status=%s amount=%d currency=%s vat=%g", data.AmountDue, data.Currency, data.VatRate, tx.ID, tx.Type, tx.Status, tx.Amount.GrossCent, tx.Amount.Currency, tx.Amount.VatRate),
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+	_ = i.SendErrorNotifyMail(ctx, "create-pay-link", data.ReferenceId, "amount-mismatch")
+	return &AmountMismatchError{Details: errs}
+}
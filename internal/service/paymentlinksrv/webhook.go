@@ -2,7 +2,6 @@ package paymentlinksrv
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
@@ -20,8 +19,119 @@ import (
 
 const isoDateFormat = "2006-01-02"
 
+// bookingProtocolMessage starts the protocol messages about bookings in the payment service.
+const bookingProtocolMessage = "booking"
+
+// webhookProcessingTimeout is how long a delivery that is still being processed blocks repeated deliveries.
+//
+// After this time, we assume the instance that was processing it has died.
+const webhookProcessingTimeout = 5 * time.Minute
+
 func (i *Impl) HandleWebhook(ctx context.Context, webhook cncrdapi.WebhookEventDto) error {
-	aulogging.Logger.Ctx(ctx).Info().Printf("webhook id=%d invoice.paymentRequestId=%d invoice.referenceId=%s", webhook.Transaction.Id, webhook.Transaction.Invoice.PaymentRequestId, webhook.Transaction.Invoice.ReferenceId)
+	aulogging.Logger.Ctx(ctx).Info().Printf("webhook id=%d status=%s invoice.paymentRequestId=%d invoice.referenceId=%s", webhook.Transaction.Id, webhook.Transaction.Status, webhook.Transaction.Invoice.PaymentRequestId, webhook.Transaction.Invoice.ReferenceId)
+
+	delivery, duplicate := i.claimWebhookDelivery(ctx, webhook)
+	if duplicate != nil {
+		aulogging.Logger.Ctx(ctx).Info().Printf("duplicate webhook delivery for transaction id=%d status=%s, first seen in request %s", webhook.Transaction.Id, webhook.Transaction.Status, duplicate.RequestId)
+		db := database.GetRepository()
+		_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+			ReferenceId: webhook.Transaction.Invoice.ReferenceId,
+			ApiId:       duplicate.ApiId,
+			Kind:        "duplicate",
+			Message:     "webhook duplicate",
+			Details:     fmt.Sprintf("transaction id=%d status=%s refunded=%d outcome=%s", duplicate.TransactionId, duplicate.Status, duplicate.RefundedAmount, duplicate.Outcome),
+			RequestId:   ctxvalues.RequestId(ctx),
+		})
+		return nil
+	}
+
+	err := i.handleWebhook(ctx, webhook)
+	i.finishWebhookDelivery(ctx, delivery, err)
+	return err
+}
+
+// claimWebhookDelivery records that we are processing a webhook delivery, unless it has already been
+// processed successfully, or is being processed right now. In that case the earlier delivery is returned.
+//
+// Deduplication is best effort. If the database fails us, we process the delivery anyway.
+func (i *Impl) claimWebhookDelivery(ctx context.Context, webhook cncrdapi.WebhookEventDto) (*entity.ProcessedWebhook, *entity.ProcessedWebhook) {
+	if webhook.Transaction.Id <= 0 {
+		return nil, nil
+	}
+
+	db := database.GetRepository()
+	delivery, err := i.findWebhookDelivery(ctx, webhook)
+	if err != nil {
+		return nil, nil
+	}
+	if delivery != nil {
+		if delivery.Outcome == entity.WebhookOutcomeSuccess ||
+			(delivery.Outcome == entity.WebhookOutcomeProcessing && i.Now().Sub(delivery.UpdatedAt) < webhookProcessingTimeout) {
+			return nil, delivery
+		}
+
+		// retry after an error, or after processing was interrupted - but only one concurrent delivery may do it
+		seen := *delivery
+		delivery.Outcome = entity.WebhookOutcomeProcessing
+		delivery.RequestId = ctxvalues.RequestId(ctx)
+		claimed, err := db.UpdateProcessedWebhookIfUnchanged(ctx, delivery, seen)
+		if err != nil {
+			return nil, nil
+		}
+		if !claimed {
+			if concurrent, err := i.findWebhookDelivery(ctx, webhook); err == nil && concurrent != nil {
+				return nil, concurrent
+			}
+			return nil, nil
+		}
+		return delivery, nil
+	}
+
+	delivery = &entity.ProcessedWebhook{
+		TransactionId:  webhook.Transaction.Id,
+		Status:         webhook.Transaction.Status,
+		RefundedAmount: webhook.Transaction.Invoice.RefundedAmount,
+		ReferenceId:    webhook.Transaction.Invoice.ReferenceId,
+		ApiId:          uint(max(webhook.Transaction.Invoice.PaymentRequestId, 0)),
+		Outcome:        entity.WebhookOutcomeProcessing,
+		RequestId:      ctxvalues.RequestId(ctx),
+	}
+	if err := db.WriteProcessedWebhook(ctx, delivery); err != nil {
+		// lost the race against a concurrent delivery?
+		if concurrent, err := i.findWebhookDelivery(ctx, webhook); err == nil && concurrent != nil && concurrent.ID != delivery.ID {
+			return nil, concurrent
+		}
+		return nil, nil
+	}
+	return delivery, nil
+}
+
+func (i *Impl) findWebhookDelivery(ctx context.Context, webhook cncrdapi.WebhookEventDto) (*entity.ProcessedWebhook, error) {
+	deliveries, err := database.GetRepository().FindProcessedWebhooks(ctx, webhook.Transaction.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deliveries {
+		if d.Status == webhook.Transaction.Status && d.RefundedAmount == webhook.Transaction.Invoice.RefundedAmount {
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// finishWebhookDelivery records the outcome. Failed deliveries will be processed again when retried.
+func (i *Impl) finishWebhookDelivery(ctx context.Context, delivery *entity.ProcessedWebhook, err error) {
+	if delivery == nil {
+		return
+	}
+	delivery.Outcome = entity.WebhookOutcomeSuccess
+	if err != nil {
+		delivery.Outcome = entity.WebhookOutcomeError
+	}
+	_ = database.GetRepository().WriteProcessedWebhook(ctx, delivery)
+}
+
+func (i *Impl) handleWebhook(ctx context.Context, webhook cncrdapi.WebhookEventDto) error {
 
 	paylinkId, err := idValidate(webhook.Transaction.Invoice.PaymentRequestId)
 	if err != nil {
@@ -71,16 +181,15 @@ func (i *Impl) HandleWebhook(ctx context.Context, webhook cncrdapi.WebhookEventD
 		return WebhookRefIdMismatchErr
 	}
 
-	prefix := config.TransactionIDPrefix()
-	if prefix != "" && !strings.HasPrefix(paylink.ReferenceID, prefix) {
-		aulogging.Logger.Ctx(ctx).Warn().Printf("webhook with wrong ref id prefix, ref_id=%s", paylink.ReferenceID)
+	if !isOwnReferenceId(paylink.ReferenceID) {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("webhook with ref id not matching reference_id_pattern, ref_id=%s", paylink.ReferenceID)
 		db := database.GetRepository()
 		_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
 			ReferenceId: webhook.Transaction.Invoice.ReferenceId,
 			ApiId:       paylinkId,
 			Kind:        "error",
 			Message:     "webhook ref-id-prefix",
-			Details:     fmt.Sprintf("ref-id=%s", paylink.ReferenceID),
+			Details:     fmt.Sprintf("ref-id=%s does not match reference_id_pattern", paylink.ReferenceID),
 			RequestId:   ctxvalues.RequestId(ctx),
 		})
 		_ = i.SendErrorNotifyMail(ctx, "webhook", paylink.ReferenceID, "ref-id-prefix")
@@ -89,6 +198,7 @@ func (i *Impl) HandleWebhook(ctx context.Context, webhook cncrdapi.WebhookEventD
 	}
 
 	aulogging.Logger.Ctx(ctx).Info().Printf("webhook call for paylink id=%d ref=%s status=%s amount=%d", paylink.ID, paylink.ReferenceID, paylink.Status, paylink.Amount)
+	i.updateStoredPaylink(ctx, paylinkId, paylink)
 	db := database.GetRepository()
 	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
 		ReferenceId: paylink.ReferenceID,
@@ -104,12 +214,105 @@ func (i *Impl) HandleWebhook(ctx context.Context, webhook cncrdapi.WebhookEventD
 		return nil
 	}
 
+	if isRefundStatus(paylink.Status) {
+		return i.bookReportedRefunds(ctx, paylinkId, paylink)
+	}
+
+	if isPendingStatus(paylink.Status) {
+		// a paylink stays waiting after a declined attempt, so only the transaction tells us a payment is in progress.
+		// If the webhook does not tell us the transaction status, we go by the paylink status.
+		if webhook.Transaction.Status != "" && !isPendingStatus(webhook.Transaction.Status) {
+			aulogging.Logger.Ctx(ctx).Info().Printf("transaction status %s leaves paylink in status %s, ignoring as successful", webhook.Transaction.Status, paylink.Status)
+			return nil
+		}
+		outcome, err := i.bookPaylink(ctx, paylinkId, paylink, webhook.Transaction.Id, paymentservice.Pending)
+		if outcome == BookingSkipped {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("not moving transaction back to pending - already in status valid! reference_id=%s status=%s", paylink.ReferenceID, paylink.Status)
+		}
+		return err
+	}
+
 	if paylink.Status != "confirmed" {
 		_ = i.SendErrorNotifyMail(ctx, "webhook", paylink.ReferenceID, paylink.Status)
 		// send 200 so concardis doesn't keep trying the webhook - we've done all we can
 		return nil
 	}
 
+	outcome, err := i.bookPaylink(ctx, paylinkId, paylink, webhook.Transaction.Id, paymentservice.Valid)
+	if outcome == BookingSkipped {
+		aulogging.Logger.Ctx(ctx).Warn().Printf("aborting transaction update - already in status valid! reference_id=%s", paylink.ReferenceID)
+		_ = i.SendErrorNotifyMail(ctx, "webhook", fmt.Sprintf("refId: %s", paylink.ReferenceID), "abort-update-for-valid")
+	}
+	return err
+}
+
+// bookPaylink performs the create or update of the upstream transaction for a paylink.
+//
+// status is Valid for confirmed paylinks, and Pending for paylinks with a payment in progress. The upstream
+// transaction is booked with the sum of all confirmed Concardis transactions. A transaction that is already
+// Valid is never touched, confirmed Concardis transactions that arrive later are added as separate payments.
+// Each confirmed Concardis transaction is booked exactly once.
+//
+// paylinkId is the payment link id (the invoice's paymentRequestId), paylink.ID is something else.
+// txId is the Concardis transaction that triggered the booking, if known. It supplies order id, date and brand.
+//
+// This is the part of the webhook logic that is shared with the transaction replay. It holds the
+// reference id lock, so concurrent webhooks and replays cannot both create a transaction.
+//
+// Failed and successful bookings are written to the protocol, see ListFailures.
+func (i *Impl) bookPaylink(ctx context.Context, paylinkId uint, paylink concardis.PaymentLinkQueryResponse, txId int64, status paymentservice.TransactionStatus) (BookingOutcome, error) {
+	outcome, err := i.bookPaylinkUnprotocolled(ctx, paylinkId, paylink, txId, status)
+	i.protocolBooking(ctx, paylinkId, paylink.ReferenceID, status, outcome, err)
+	return outcome, err
+}
+
+// protocolBooking writes the result of a booking to the protocol. status is the status that was requested, an
+// amount mismatch may have downgraded it. Skipped and refused bookings are left out, they did not change
+// anything, and a refused booking has already been protocolled as a mismatch.
+func (i *Impl) protocolBooking(ctx context.Context, paylinkId uint, referenceId string, status paymentservice.TransactionStatus, outcome BookingOutcome, err error) {
+	entry := &entity.ProtocolEntry{
+		ReferenceId: referenceId,
+		ApiId:       paylinkId,
+		RequestId:   ctxvalues.RequestId(ctx),
+	}
+	switch {
+	case err != nil:
+		entry.Kind = "error"
+		entry.Message = bookingProtocolMessage + " failed"
+		entry.Details = fmt.Sprintf("requested=%s %s", status, err.Error())
+	case outcome == BookingCreated || outcome == BookingUpdated:
+		entry.Kind = "success"
+		entry.Message = bookingProtocolMessage + " " + string(outcome)
+		entry.Details = fmt.Sprintf("requested=%s", status)
+	default:
+		return
+	}
+	_ = database.GetRepository().WriteProtocolEntry(ctx, entry)
+}
+
+func (i *Impl) bookPaylinkUnprotocolled(ctx context.Context, paylinkId uint, paylink concardis.PaymentLinkQueryResponse, txId int64, status paymentservice.TransactionStatus) (BookingOutcome, error) {
+	unlock, err := i.lockReferenceId(ctx, paylink.ReferenceID)
+	if err != nil {
+		return BookingFailed, err
+	}
+	defer unlock()
+
+	trigger := bookingTransaction(paylink, txId, status)
+	// determined before a mismatch may downgrade the status, so what was paid is booked even then
+	amount := bookingAmount(paylink, status)
+
+	var unbooked []concardis.TransactionData
+	var booked int
+	if status == paymentservice.Valid {
+		bookings, err := database.GetRepository().FindPaymentBookings(ctx, paylink.ReferenceID)
+		if err != nil {
+			_ = i.SendErrorNotifyMail(ctx, "webhook", fmt.Sprintf("refId: %s", paylink.ReferenceID), "db-error")
+			return BookingFailed, err
+		}
+		booked = len(bookings)
+		unbooked = unbookedPayments(paylink, bookings)
+	}
+
 	// fetch transaction data from payment service
 	transaction, err := paymentservice.Get().GetTransactionByReferenceId(ctx, paylink.ReferenceID)
 	if err != nil {
@@ -118,36 +321,105 @@ func (i *Impl) HandleWebhook(ctx context.Context, webhook cncrdapi.WebhookEventD
 			// Note: this should never happen, but we try to recover because someone paid us money for somthing.
 			aulogging.Logger.Ctx(ctx).Error().Printf("webhook reference_id not found in payment service. Creating new transaction. reference_id=%s", paylink.ReferenceID)
 
-			return i.createTransaction(ctx, paylink)
+			var note string
+			if status == paymentservice.Valid {
+				if note = i.paidAmountMismatch(ctx, paylinkId, paylink, nil); note != "" && config.PaidAmountMismatchPolicy() == config.AmountMismatchRefuse {
+					return BookingRefused, nil
+				}
+			}
+			if err := i.createTransaction(ctx, paylinkId, paylink, trigger, amount, note); err != nil {
+				return BookingFailed, err
+			}
+			i.recordPaymentBookings(ctx, paylinkId, paylink, unbooked)
+			return BookingCreated, nil
 		} else {
 			aulogging.Logger.Ctx(ctx).Error().Printf("error fetching transaction from payment service. err=%s", err.Error())
-			return err
+			return BookingFailed, err
+		}
+	}
+
+	if transaction.Status == paymentservice.Valid {
+		if status != paymentservice.Valid || len(unbooked) == 0 || booked == 0 {
+			// without earlier bookings, we cannot tell whether the upstream transaction already covers these payments
+			return BookingSkipped, nil
+		}
+		// the upstream transaction only knows what was booked before, so we can only compare with our stored paylink
+		paymentStatus := paymentservice.Valid
+		note := i.paidAmountMismatch(ctx, paylinkId, paylink, nil)
+		if note != "" {
+			switch config.PaidAmountMismatchPolicy() {
+			case config.AmountMismatchRefuse:
+				return BookingRefused, nil
+			case config.AmountMismatchPending:
+				paymentStatus = paymentservice.Pending
+			default:
+				// book as is, the alert has been sent
+				note = ""
+			}
+		}
+		for _, tx := range unbooked {
+			if err := i.addPayment(ctx, paylink, transaction, tx, paymentStatus, note); err != nil {
+				return BookingFailed, err
+			}
+			i.recordPaymentBookings(ctx, paylinkId, paylink, []concardis.TransactionData{tx})
+		}
+		return BookingCreated, nil
+	}
+
+	var note string
+	if status == paymentservice.Valid {
+		if note = i.paidAmountMismatch(ctx, paylinkId, paylink, &transaction); note != "" {
+			switch config.PaidAmountMismatchPolicy() {
+			case config.AmountMismatchRefuse:
+				return BookingRefused, nil
+			case config.AmountMismatchPending:
+				status = paymentservice.Pending
+			default:
+				// book as is, the alert has been sent
+				note = ""
+			}
 		}
 	}
 
 	// matching transaction was found in the payment service database.
 	// update the values with data from Concardis.
-	return i.updateTransaction(ctx, paylink, transaction)
+	if err := i.updateTransaction(ctx, paylink, trigger, transaction, status, amount, note); err != nil {
+		return BookingFailed, err
+	}
+	i.recordPaymentBookings(ctx, paylinkId, paylink, unbooked)
+	return BookingUpdated, nil
 }
 
-func (i *Impl) createTransaction(ctx context.Context, paylink concardis.PaymentLinkQueryResponse) error {
+// lockReferenceId serializes all bookings for a reference id. Waits and timeouts are logged by the repository.
+func (i *Impl) lockReferenceId(ctx context.Context, referenceId string) (func(), error) {
+	unlock, err := database.GetRepository().LockReferenceId(ctx, referenceId, config.ReferenceLockTimeout())
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("failed to lock reference_id=%s request_id=%s: %s", referenceId, ctxvalues.RequestId(ctx), err.Error())
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// createTransaction adds the missing transaction as pending, because we do not know what the money was for.
+//
+// amount is the amount to book, note explains an amount mismatch, if any.
+func (i *Impl) createTransaction(ctx context.Context, paylinkId uint, paylink concardis.PaymentLinkQueryResponse, trigger concardis.TransactionData, amount int64, note string) error {
 	debitor_id, err := debitorIdFromReferenceID(paylink.ReferenceID)
 	if err != nil {
-		aulogging.Logger.Ctx(ctx).Warn().Printf("webhook couldn't parse debitor_id from reference_id. reference_id=%s", paylink.ReferenceID)
-		_ = i.SendErrorNotifyMail(ctx, "webhook", fmt.Sprintf("refId: %s", paylink.ReferenceID), "parse-refid-err")
+		i.debitorIdParseFailed(ctx, "webhook", paylink.ReferenceID, paylinkId, err)
 		// we log a warning, but we continue anyway
 	}
 
-	effective := i.effectiveISODateOrToday(paylink)
-	comment := "CC orderId " + i.transactionUuid(paylink) + " (auto created)"
+	effective := i.effectiveISODateOrToday(trigger)
+	comment := i.transactionComment(trigger) + " (auto created)"
 
 	transaction := paymentservice.Transaction{
 		ID:        paylink.ReferenceID,
 		DebitorID: debitor_id,
 		Type:      paymentservice.Payment,
-		Method:    paymentservice.Credit, // we use paylink for credit cards only, atm.
+		Method:    transactionPaymentMethod(trigger),
 		Amount: paymentservice.Amount{
-			GrossCent: paylink.Amount,
+			GrossCent: amount,
 			Currency:  paylink.Currency,
 			VatRate:   paylink.VatRate,
 		},
@@ -157,6 +429,9 @@ func (i *Impl) createTransaction(ctx context.Context, paylink concardis.PaymentL
 		DueDate:       effective,
 		// omitting Deletion
 	}
+	if isPendingStatus(paylink.Status) || note != "" {
+		transaction.StatusHistory = append(transaction.StatusHistory, i.concardisStatusHistory(paylink, trigger, note))
+	}
 
 	err = paymentservice.Get().AddTransaction(ctx, transaction)
 	if err != nil {
@@ -166,21 +441,20 @@ func (i *Impl) createTransaction(ctx context.Context, paylink concardis.PaymentL
 	return err
 }
 
-func (i *Impl) updateTransaction(ctx context.Context, paylink concardis.PaymentLinkQueryResponse, transaction paymentservice.Transaction) error {
-	if transaction.Status == paymentservice.Valid {
-		aulogging.Logger.Ctx(ctx).Warn().Printf("aborting transaction update - already in status valid! reference_id=%s", paylink.ReferenceID)
-		_ = i.SendErrorNotifyMail(ctx, "webhook", fmt.Sprintf("refId: %s", paylink.ReferenceID), "abort-update-for-valid")
-		return nil // not an error
-	}
+// updateTransaction books amount on the upstream transaction. note explains an amount mismatch, if any.
+func (i *Impl) updateTransaction(ctx context.Context, paylink concardis.PaymentLinkQueryResponse, trigger concardis.TransactionData, transaction paymentservice.Transaction, status paymentservice.TransactionStatus, amount int64, note string) error {
+	effective := i.effectiveISODateOrToday(trigger)
+	comment := i.transactionComment(trigger)
 
-	effective := i.effectiveISODateOrToday(paylink)
-	comment := "CC orderId " + i.transactionUuid(paylink)
-
-	transaction.Amount.GrossCent = paylink.Amount
+	transaction.Method = transactionPaymentMethod(trigger)
+	transaction.Amount.GrossCent = amount
 	transaction.Amount.Currency = paylink.Currency
-	transaction.Status = paymentservice.Valid
+	transaction.Status = status
 	transaction.EffectiveDate = effective
 	transaction.Comment = comment
+	if status == paymentservice.Pending {
+		transaction.StatusHistory = append(transaction.StatusHistory, i.concardisStatusHistory(paylink, trigger, note))
+	}
 
 	err := paymentservice.Get().UpdateTransaction(ctx, transaction)
 	if err != nil {
@@ -192,70 +466,268 @@ func (i *Impl) updateTransaction(ctx context.Context, paylink concardis.PaymentL
 	return nil
 }
 
-func (i *Impl) effectiveISODateOrToday(paylink concardis.PaymentLinkQueryResponse) string {
-	today := time.Now().Format(isoDateFormat)
-	effective := today
+// paidAmountMismatch compares the sum of the confirmed transactions with the amount due according to the
+// upstream transaction (if known) and our stored paylink (if any). paylinkId is the payment link id.
+//
+// A mismatch is written to the protocol and alerted by mail, and described in the return value. No mismatch returns "".
+func (i *Impl) paidAmountMismatch(ctx context.Context, paylinkId uint, paylink concardis.PaymentLinkQueryResponse, upstream *paymentservice.Transaction) string {
+	paid := bookingAmount(paylink, paymentservice.Valid)
+	mismatches := make([]string, 0)
+	if upstream != nil && upstream.Amount.GrossCent > 0 &&
+		(upstream.Amount.GrossCent != paid || (upstream.Amount.Currency != "" && upstream.Amount.Currency != paylink.Currency)) {
+		mismatches = append(mismatches, fmt.Sprintf("payment service due=%d %s", upstream.Amount.GrossCent, upstream.Amount.Currency))
+	}
+	if stored, err := database.GetRepository().GetPaylinkByApiId(ctx, paylinkId); err == nil &&
+		(stored.AmountDue != paid || stored.Currency != paylink.Currency) {
+		mismatches = append(mismatches, fmt.Sprintf("paylink due=%d %s", stored.AmountDue, stored.Currency))
+	}
+	if len(mismatches) == 0 {
+		return ""
+	}
+
+	note := fmt.Sprintf("amount mismatch paid=%d %s %s", paid, paylink.Currency, strings.Join(mismatches, " "))
+	policy := config.PaidAmountMismatchPolicy()
+	aulogging.Logger.Ctx(ctx).Warn().Printf("webhook %s ref=%s policy=%s", note, paylink.ReferenceID, policy)
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: paylink.ReferenceID,
+		ApiId:       paylinkId,
+		Kind:        "mismatch",
+		Message:     "webhook amount-mismatch",
+		Details:     fmt.Sprintf("%s policy=%s", note, policy),
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+	_ = i.SendErrorNotifyMail(ctx, "webhook", paylink.ReferenceID, "paid-amount-mismatch")
+	return note
+}
+
+// addPayment books a confirmed Concardis transaction that arrived after the upstream transaction became valid,
+// for example the second of two partial payments. note explains an amount mismatch, if any.
+func (i *Impl) addPayment(ctx context.Context, paylink concardis.PaymentLinkQueryResponse, original paymentservice.Transaction, tx concardis.TransactionData, status paymentservice.TransactionStatus, note string) error {
+	effective := i.effectiveISODateOrToday(tx)
+	transaction := paymentservice.Transaction{
+		DebitorID: original.DebitorID,
+		Type:      paymentservice.Payment,
+		Method:    transactionPaymentMethod(tx),
+		Amount: paymentservice.Amount{
+			GrossCent: tx.Amount,
+			Currency:  paylink.Currency,
+			VatRate:   paylink.VatRate,
+		},
+		Comment:       i.transactionComment(tx) + " (additional payment)",
+		Status:        status,
+		EffectiveDate: effective,
+		DueDate:       effective,
+	}
+	if status == paymentservice.Pending {
+		transaction.StatusHistory = append(transaction.StatusHistory, i.concardisStatusHistory(paylink, tx, note))
+	}
 
-	if len(paylink.Invoices) > 0 {
-		lastInvoice := paylink.Invoices[len(paylink.Invoices)-1]
+	err := paymentservice.Get().AddTransaction(ctx, transaction)
+	if err != nil {
+		aulogging.Logger.Ctx(ctx).Error().Printf("webhook could not add payment for transaction id=%d to payment service. reference_id=%s", tx.ID, paylink.ReferenceID)
+		_ = i.SendErrorNotifyMail(ctx, "webhook", fmt.Sprintf("refId: %s", paylink.ReferenceID), "create-payment-err")
+	}
+	return err
+}
 
-		if len(lastInvoice.Transactions) > 0 {
-			lastTransaction := lastInvoice.Transactions[len(lastInvoice.Transactions)-1]
+// recordPaymentBookings remembers that the transactions have been booked.
+//
+// Failure is not returned, because the booking in the payment service already happened, and
+// failing would cause a retry and thus a double booking.
+func (i *Impl) recordPaymentBookings(ctx context.Context, paylinkId uint, paylink concardis.PaymentLinkQueryResponse, transactions []concardis.TransactionData) {
+	db := database.GetRepository()
+	for _, tx := range transactions {
+		err := db.WritePaymentBooking(ctx, &entity.PaymentBooking{
+			ReferenceId:   paylink.ReferenceID,
+			ApiId:         paylinkId,
+			TransactionId: tx.ID,
+			BookedAmount:  tx.Amount,
+		})
+		if err != nil {
+			aulogging.Logger.Ctx(ctx).Error().Printf("could not record payment booking for transaction id=%d ref=%s amount=%d - it may get booked twice", tx.ID, paylink.ReferenceID, tx.Amount)
+			_ = i.SendErrorNotifyMail(ctx, "webhook", fmt.Sprintf("refId: %s", paylink.ReferenceID), "payment-booking-err")
+		}
+	}
+}
 
-			if len(lastTransaction.Time) >= 10 {
-				effective = lastTransaction.Time[0:10]
+// bookingAmount is the sum of all confirmed transactions of a confirmed paylink.
+//
+// Pending paylinks, and paylinks whose transactions we do not know, are booked with the paylink amount.
+func bookingAmount(paylink concardis.PaymentLinkQueryResponse, status paymentservice.TransactionStatus) int64 {
+	if status != paymentservice.Valid {
+		return paylink.Amount
+	}
+	sum := int64(0)
+	found := false
+	for _, invoice := range paylink.Invoices {
+		for _, tx := range invoice.Transactions {
+			if tx.Status == "confirmed" {
+				sum += tx.Amount
+				found = true
 			}
 		}
 	}
+	if !found {
+		return paylink.Amount
+	}
+	return sum
+}
+
+// unbookedPayments lists the confirmed transactions that have not been booked yet.
+func unbookedPayments(paylink concardis.PaymentLinkQueryResponse, bookings []*entity.PaymentBooking) []concardis.TransactionData {
+	booked := make(map[int64]bool)
+	for _, b := range bookings {
+		booked[b.TransactionId] = true
+	}
 
-	return effective
+	result := make([]concardis.TransactionData, 0)
+	for _, invoice := range paylink.Invoices {
+		for _, tx := range invoice.Transactions {
+			if tx.Status == "confirmed" && !booked[tx.ID] {
+				result = append(result, tx)
+			}
+		}
+	}
+	return result
 }
 
-func (i *Impl) transactionUuid(paylink concardis.PaymentLinkQueryResponse) string {
-	result := "unknown"
+// bookingTransaction finds the Concardis transaction that triggered a booking.
+//
+// If txId is unknown, or names a transaction that does not fit the booking (a declined attempt for a confirmed
+// paylink), we fall back to the last confirmed transaction, then to the last transaction.
+// The result is empty if the paylink has no transactions at all.
+func bookingTransaction(paylink concardis.PaymentLinkQueryResponse, txId int64, status paymentservice.TransactionStatus) concardis.TransactionData {
+	var last, lastConfirmed concardis.TransactionData
+	for _, invoice := range paylink.Invoices {
+		for _, tx := range invoice.Transactions {
+			if txId != 0 && tx.ID == txId && (status != paymentservice.Valid || tx.Status == "confirmed") {
+				return tx
+			}
+			last = tx
+			if tx.Status == "confirmed" {
+				lastConfirmed = tx
+			}
+		}
+	}
+	if status == paymentservice.Valid && lastConfirmed.ID != 0 {
+		return lastConfirmed
+	}
+	return last
+}
 
-	if len(paylink.Invoices) > 0 {
-		lastInvoice := paylink.Invoices[len(paylink.Invoices)-1]
+// concardisStatusHistory explains why a transaction is pending, so it can be seen in the payment service.
+func (i *Impl) concardisStatusHistory(paylink concardis.PaymentLinkQueryResponse, tx concardis.TransactionData, note string) paymentservice.StatusHistory {
+	comment := "Concardis status " + paylink.Status
+	if brand := displayBrand(tx); brand != "" {
+		comment += " brand " + brand
+	}
+	if note != "" {
+		comment += " - " + note
+	}
+	return paymentservice.StatusHistory{
+		Status:     paymentservice.Pending,
+		Comment:    comment,
+		ChangeDate: i.Now(),
+	}
+}
 
-		if len(lastInvoice.Transactions) > 0 {
-			lastTransaction := lastInvoice.Transactions[len(lastInvoice.Transactions)-1]
+// transactionComment identifies the payment attempt, and the brand used, in the payment service.
+func (i *Impl) transactionComment(tx concardis.TransactionData) string {
+	comment := "CC orderId " + i.transactionUuid(tx)
+	if brand := displayBrand(tx); brand != "" {
+		comment += " brand " + brand
+	}
+	return comment
+}
 
-			if lastTransaction.UUID != "" {
-				result = lastTransaction.UUID
+// transactionPaymentMethod maps the brand or psp of a transaction to a payment method, see service.payment_methods.
+func transactionPaymentMethod(tx concardis.TransactionData) paymentservice.PaymentMethod {
+	methods := config.PaymentMethods()
+	for _, name := range []string{tx.Payment.Brand, tx.Psp} {
+		if name == "" {
+			continue
+		}
+		for key, method := range methods {
+			if strings.EqualFold(key, name) {
+				return paymentservice.PaymentMethod(method)
 			}
 		}
 	}
+	// the paylink was originally used for credit cards only
+	return paymentservice.Credit
+}
 
-	return result
+// displayBrand is the brand (or psp, if the brand is unknown) for display, which may be empty.
+func displayBrand(tx concardis.TransactionData) string {
+	if tx.Payment.Brand != "" {
+		return tx.Payment.Brand
+	}
+	return tx.Psp
 }
 
-func debitorIdFromReferenceID(ref_id string) (uint, error) {
-	// reference_id is generated internally in the payment service.
-	// See  reg-payment-service/internal/interaction/transaction.go:generateTransactionID()
+func (i *Impl) effectiveISODateOrToday(tx concardis.TransactionData) string {
+	if len(tx.Time) >= 10 {
+		return tx.Time[0:10]
+	}
+	return time.Now().Format(isoDateFormat)
+}
+
+func (i *Impl) transactionUuid(tx concardis.TransactionData) string {
+	if tx.UUID != "" {
+		return tx.UUID
+	}
+	return "unknown"
+}
 
-	// The format is:  "%s-%06d-%s-%s"
-	// Fields:
-	//   - prefix (hopefully without hyphens)
-	//   - debitor_id
-	//   - timestamp in format "0102-150405" (hyphen!)
-	//   - random digits
+// isOwnReferenceId checks that a reference id belongs to this installation, e.g. not to a previous year.
+func isOwnReferenceId(ref_id string) bool {
+	return config.ReferenceIdRegexp().MatchString(ref_id)
+}
 
-	tokens := strings.Split(ref_id, "-")
-	if len(tokens) != 5 {
-		return 0, errors.New("error parsing reference_id")
+// debitorIdFromReferenceID extracts the debitor group of the configured reference id pattern.
+//
+// reference_id is generated internally in the payment service, see
+// reg-payment-service/internal/interaction/transaction.go:generateTransactionID(). The error says exactly why
+// parsing failed, so it can go into the protocol.
+func debitorIdFromReferenceID(ref_id string) (uint, error) {
+	pattern := config.ReferenceIdRegexp()
+	match := pattern.FindStringSubmatch(ref_id)
+	if match == nil {
+		return 0, fmt.Errorf("reference_id %s does not match reference_id_pattern", ref_id)
 	}
 
-	debitor_id, err := strconv.ParseUint(tokens[1], 10, 32)
+	debitor := match[pattern.SubexpIndex(config.ReferenceIdDebitorGroup)]
+	debitor_id, err := strconv.ParseUint(debitor, 10, 32)
 	if err != nil {
-		return 0, errors.New("error parsing debitor_id as uint: " + err.Error())
+		return 0, fmt.Errorf("debitor group '%s' of reference_id %s is not a valid debitor id", debitor, ref_id)
 	}
 
 	return uint(debitor_id), nil
 }
 
+func (i *Impl) debitorIdParseFailed(ctx context.Context, operation string, referenceId string, apiId uint, err error) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("%s couldn't parse debitor_id from reference_id: %s", operation, err.Error())
+	db := database.GetRepository()
+	_ = db.WriteProtocolEntry(ctx, &entity.ProtocolEntry{
+		ReferenceId: referenceId,
+		ApiId:       apiId,
+		Kind:        "error",
+		Message:     operation + " parse-refid-err",
+		Details:     err.Error(),
+		RequestId:   ctxvalues.RequestId(ctx),
+	})
+	_ = i.SendErrorNotifyMail(ctx, operation, fmt.Sprintf("refId: %s", referenceId), "parse-refid-err")
+}
+
 func idValidate(value int64) (uint, error) {
 	if value < 1 {
 		return 0, WebhookValidationErr
 	}
 	return uint(value), nil
 }
+
+// isPendingStatus is true for paylink statuses that mean a payment is in progress, but not yet complete.
+func isPendingStatus(status string) bool {
+	return status == "waiting" || status == "authorized" || status == "reserved" || status == "uncaptured"
+}
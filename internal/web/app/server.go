@@ -8,10 +8,12 @@ import (
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/self"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/service/paymentlinksrv"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/controller/adminctl"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/controller/fallbackctl"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/controller/infoctl"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/controller/paylinkctl"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/controller/simulatorctl"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/controller/transactionctl"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/controller/webhookctl"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/middleware"
 	"github.com/go-chi/chi/v5"
@@ -40,6 +42,8 @@ func CreateRouter(ctx context.Context) (chi.Router, error) {
 	// add your controllers here
 	paylinkctl.Create(server, paymentLinkService)
 	webhookctl.Create(server, paymentLinkService)
+	transactionctl.Create(server, paymentLinkService)
+	adminctl.Create(server, paymentLinkService)
 	if config.ServicePublicURL() != "" {
 		aulogging.Logger.NoCtx().Warn().Printf("service.public_url is configured. Enabling local paylink simulator at %s/simulator (not useful for production!)", config.ServicePublicURL())
 		err := self.Create()
@@ -69,6 +73,7 @@ func newServer(ctx context.Context, router chi.Router) *http.Server {
 
 func runServerWithGracefulShutdown() error {
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
@@ -79,6 +84,10 @@ func runServerWithGracefulShutdown() error {
 	}
 	srv := newServer(ctx, handler)
 
+	if config.WebhookOutboxEnabled() {
+		go paymentlinksrv.RunWebhookOutboxWorker(ctx, paymentlinksrv.New())
+	}
+
 	go func() {
 		<-sig
 		defer cancel()
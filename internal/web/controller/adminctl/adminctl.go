@@ -0,0 +1,152 @@
+package adminctl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/service/paymentlinksrv"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctlutil"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var paymentLinkService paymentlinksrv.PaymentLinkService
+
+// maxFailureDays limits how far back the failure list may reach
+const maxFailureDays = 90
+
+func Create(server chi.Router, paymentLinkSrv paymentlinksrv.PaymentLinkService) {
+	paymentLinkService = paymentLinkSrv
+
+	server.Get("/api/rest/v1/admin/failures", listFailuresHandler)
+	server.Post("/api/rest/v1/admin/rerun", rerunHandler)
+}
+
+func listFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+
+	days, err := daysFromQuery(ctx, w, r)
+	if err != nil {
+		return
+	}
+
+	dto, err := paymentLinkService.ListFailures(ctx, days)
+	if err != nil {
+		ctlutil.UnexpectedError(ctx, w, r, err)
+		return
+	}
+
+	ctlutil.WriteJson(ctx, w, dto)
+}
+
+func rerunHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+
+	request, err := parseBodyToAdminRerunRequestDto(ctx, w, r)
+	if err != nil {
+		return
+	}
+	validationErrs := paymentLinkService.ValidateRerunRequest(ctx, request)
+	if len(validationErrs) != 0 {
+		adminRequestInvalidErrorHandler(ctx, w, r, validationErrs)
+		return
+	}
+
+	dto, err := paymentLinkService.RerunProcessing(ctx, request)
+	if err != nil {
+		if errors.Is(err, paymentlinksrv.RerunReferenceUnknownErr) {
+			referenceNotFoundErrorHandler(ctx, w, r, request.ReferenceId)
+		} else if errors.Is(err, concardis.NoSuchID404Error) {
+			paylinkNotFoundErrorHandler(ctx, w, r, request.PaylinkId)
+		} else if errors.Is(err, concardis.DownstreamError) || errors.Is(err, concardis.NotSuccessful) {
+			downstreamErrorHandler(ctx, w, r, "paylink", err)
+		} else {
+			ctlutil.UnexpectedError(ctx, w, r, err)
+		}
+		return
+	}
+
+	ctlutil.WriteJson(ctx, w, dto)
+}
+
+// requireAdmin only lets admins through. The api token is for backends and is not enough.
+func requireAdmin(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if ctxvalues.HasAdminToken(ctx) {
+		return true
+	}
+	if ctxvalues.HasApiToken(ctx) {
+		ctlutil.UnauthorizedError(ctx, w, r, "you need an admin token for this operation", "api token used for admin operation, denying")
+	} else {
+		ctlutil.UnauthenticatedError(ctx, w, r, "you must be logged in for this operation", "anonymous access attempt")
+	}
+	return false
+}
+
+func daysFromQuery(ctx context.Context, w http.ResponseWriter, r *http.Request) (uint, error) {
+	daysStr := r.URL.Query().Get("days")
+	if daysStr == "" {
+		return 7, nil
+	}
+	days, err := strconv.ParseUint(daysStr, 10, 32)
+	if err == nil && (days < 1 || days > maxFailureDays) {
+		err = fmt.Errorf("days must be between 1 and %d", maxFailureDays)
+	}
+	if err != nil {
+		invalidDaysErrorHandler(ctx, w, r, daysStr)
+	}
+	return uint(days), err
+}
+
+func parseBodyToAdminRerunRequestDto(ctx context.Context, w http.ResponseWriter, r *http.Request) (cncrdapi.AdminRerunRequestDto, error) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	dto := cncrdapi.AdminRerunRequestDto{}
+	err := decoder.Decode(&dto)
+	if err != nil {
+		adminRequestParseErrorHandler(ctx, w, r, err)
+	}
+	return dto, err
+}
+
+func adminRequestParseErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("admin body could not be parsed: %s", err.Error())
+	ctlutil.ErrorHandler(ctx, w, r, "admin.parse.error", http.StatusBadRequest, nil)
+}
+
+func adminRequestInvalidErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, validationErrors url.Values) {
+	// validation already logged each individual error
+	ctlutil.ErrorHandler(ctx, w, r, "admin.data.invalid", http.StatusBadRequest, validationErrors)
+}
+
+func invalidDaysErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, days string) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("received invalid number of days '%s'", url.QueryEscape(days))
+	ctlutil.ErrorHandler(ctx, w, r, "admin.days.invalid", http.StatusBadRequest, url.Values{"details": []string{fmt.Sprintf("days must be an integer between 1 and %d", maxFailureDays)}})
+}
+
+func referenceNotFoundErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, referenceId string) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("no paylink known for reference id %s", url.QueryEscape(referenceId))
+	ctlutil.ErrorHandler(ctx, w, r, "admin.reference.notfound", http.StatusNotFound, url.Values{})
+}
+
+func paylinkNotFoundErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, id uint) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("paylink id %d not found", id)
+	ctlutil.ErrorHandler(ctx, w, r, "paylink.id.notfound", http.StatusNotFound, url.Values{})
+}
+
+func downstreamErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, sysname string, err error) {
+	aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("%s downstream error: %s", sysname, err.Error())
+	ctlutil.ErrorHandler(ctx, w, r, fmt.Sprintf("%s.downstream.error", sysname), http.StatusBadGateway, nil)
+}
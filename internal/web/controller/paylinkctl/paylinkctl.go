@@ -9,24 +9,32 @@ import (
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/attendeeservice"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/paymentservice"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/service/paymentlinksrv"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctlutil"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-http-utils/headers"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 var paymentLinkService paymentlinksrv.PaymentLinkService
 
+// IdempotencyKeyHeader lets callers safely retry paylink creation. It defaults to the reference id.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
 func Create(server chi.Router, paymentLinkSrv paymentlinksrv.PaymentLinkService) {
 	paymentLinkService = paymentLinkSrv
 
+	server.Get("/api/rest/v1/paylinks", listPaylinksHandler)
 	server.Post("/api/rest/v1/paylinks", createPaylinkHandler)
 	server.Get("/api/rest/v1/paylinks/{id}", getPaylinkHandler)
 	server.Delete("/api/rest/v1/paylinks/{id}", deletePaylinkHandler)
+	server.Post("/api/rest/v1/paylinks/{id}/refund", refundPaylinkHandler)
 }
 
 func createPaylinkHandler(w http.ResponseWriter, r *http.Request) {
@@ -41,18 +49,32 @@ func createPaylinkHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
 	errs := paymentLinkService.ValidatePaymentLinkRequest(ctx, request)
+	if len(idempotencyKey) > 255 {
+		if errs == nil {
+			errs = url.Values{}
+		}
+		errs.Add("idempotency_key", "the Idempotency-Key header may be at most 255 characters long")
+	}
 	if errs != nil {
 		paylinkRequestInvalidErrorHandler(ctx, w, r, errs)
 		return
 	}
 
-	dto, id, err := paymentLinkService.CreatePaymentLink(ctx, request)
+	dto, id, err := paymentLinkService.CreatePaymentLink(ctx, request, idempotencyKey)
 	if err != nil {
-		if errors.Is(err, concardis.DownstreamError) {
+		var mismatchErr *paymentlinksrv.AmountMismatchError
+		if errors.As(err, &mismatchErr) {
+			paylinkRequestInvalidErrorHandler(ctx, w, r, mismatchErr.Details)
+		} else if errors.Is(err, paymentlinksrv.IdempotencyKeyConflictErr) {
+			idempotencyConflictErrorHandler(ctx, w, r, err)
+		} else if errors.Is(err, concardis.DownstreamError) {
 			downstreamErrorHandler(ctx, w, r, "paylink", err)
 		} else if errors.Is(err, attendeeservice.DownstreamError) {
 			downstreamErrorHandler(ctx, w, r, "attsrv", err)
+		} else if errors.Is(err, paymentservice.DownstreamError) {
+			downstreamErrorHandler(ctx, w, r, "paysrv", err)
 		} else {
 			ctlutil.UnexpectedError(ctx, w, r, err)
 		}
@@ -64,6 +86,28 @@ func createPaylinkHandler(w http.ResponseWriter, r *http.Request) {
 	ctlutil.WriteJson(ctx, w, dto)
 }
 
+func listPaylinksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !ctxvalues.HasApiToken(ctx) {
+		ctlutil.UnauthenticatedError(ctx, w, r, "you must be logged in for this operation", "anonymous access attempt")
+		return
+	}
+
+	filter, errs := filterFromQuery(ctx, r.URL.Query())
+	if errs != nil {
+		paylinkRequestInvalidErrorHandler(ctx, w, r, errs)
+		return
+	}
+
+	dto, err := paymentLinkService.ListPaymentLinks(ctx, filter)
+	if err != nil {
+		ctlutil.UnexpectedError(ctx, w, r, err)
+		return
+	}
+
+	ctlutil.WriteJson(ctx, w, dto)
+}
+
 func getPaylinkHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	if !ctxvalues.HasApiToken(ctx) {
@@ -118,6 +162,48 @@ func deletePaylinkHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func refundPaylinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !ctxvalues.HasApiToken(ctx) {
+		ctlutil.UnauthenticatedError(ctx, w, r, "you must be logged in for this operation", "anonymous access attempt")
+		return
+	}
+
+	id, err := idFromVars(ctx, w, r)
+	if err != nil {
+		return
+	}
+
+	request, err := parseBodyToPaymentLinkRefundRequestDto(ctx, w, r)
+	if err != nil {
+		return
+	}
+
+	errs := paymentLinkService.ValidateRefundRequest(ctx, request)
+	if errs != nil {
+		paylinkRequestInvalidErrorHandler(ctx, w, r, errs)
+		return
+	}
+
+	err = paymentLinkService.RefundPaymentLink(ctx, id, request)
+	if err != nil {
+		if errors.Is(err, concardis.DownstreamError) || errors.Is(err, concardis.NotSuccessful) {
+			downstreamErrorHandler(ctx, w, r, "paylink", err)
+		} else if errors.Is(err, concardis.NoSuchID404Error) {
+			paylinkNotFoundErrorHandler(ctx, w, r, id)
+		} else if errors.Is(err, paymentlinksrv.RefundNotPossibleErr) || errors.Is(err, paymentlinksrv.RefundAmountExceededErr) {
+			refundConflictErrorHandler(ctx, w, r, err)
+		} else if errors.Is(err, paymentservice.DownstreamError) {
+			downstreamErrorHandler(ctx, w, r, "paysrv", err)
+		} else {
+			ctlutil.UnexpectedError(ctx, w, r, err)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func parseBodyToPaymentLinkRequestDto(ctx context.Context, w http.ResponseWriter, r *http.Request) (cncrdapi.PaymentLinkRequestDto, error) {
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
@@ -129,6 +215,21 @@ func parseBodyToPaymentLinkRequestDto(ctx context.Context, w http.ResponseWriter
 	return dto, err
 }
 
+// parseBodyToPaymentLinkRefundRequestDto accepts an empty body, which means a full refund.
+func parseBodyToPaymentLinkRefundRequestDto(ctx context.Context, w http.ResponseWriter, r *http.Request) (cncrdapi.PaymentLinkRefundRequestDto, error) {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	dto := cncrdapi.PaymentLinkRefundRequestDto{}
+	err := decoder.Decode(&dto)
+	if errors.Is(err, io.EOF) {
+		return dto, nil
+	}
+	if err != nil {
+		paylinkRequestParseErrorHandler(ctx, w, r, err)
+	}
+	return dto, err
+}
+
 func idFromVars(ctx context.Context, w http.ResponseWriter, r *http.Request) (uint, error) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
@@ -138,6 +239,66 @@ func idFromVars(ctx context.Context, w http.ResponseWriter, r *http.Request) (ui
 	return uint(id), err
 }
 
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+func filterFromQuery(ctx context.Context, query url.Values) (paymentlinksrv.PaymentLinkFilter, url.Values) {
+	errs := url.Values{}
+	filter := paymentlinksrv.PaymentLinkFilter{
+		ReferenceId: query.Get("reference_id"),
+		Status:      query.Get("status"),
+		Page:        1,
+		PageSize:    defaultPageSize,
+	}
+
+	if v := query.Get("debitor_id"); v != "" {
+		debitorId, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || debitorId == 0 {
+			errs.Add("debitor_id", "must be a positive integer (the badge number)")
+		}
+		filter.DebitorId = debitorId
+	}
+	if v := query.Get("created_after"); v != "" {
+		createdAfter, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errs.Add("created_after", "must be a date-time in RFC 3339 format, e.g. 2006-01-02T15:04:05Z")
+		}
+		filter.CreatedAfter = createdAfter
+	}
+	if v := query.Get("created_before"); v != "" {
+		createdBefore, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errs.Add("created_before", "must be a date-time in RFC 3339 format, e.g. 2006-01-02T15:04:05Z")
+		}
+		filter.CreatedBefore = createdBefore
+	}
+	if v := query.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			errs.Add("page", "must be a positive integer")
+		}
+		filter.Page = page
+	}
+	if v := query.Get("page_size"); v != "" {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil || pageSize < 1 || pageSize > maxPageSize {
+			errs.Add("page_size", fmt.Sprintf("must be an integer between 1 and %d", maxPageSize))
+		}
+		filter.PageSize = pageSize
+	}
+
+	if len(errs) == 0 {
+		return filter, nil
+	} else {
+		for k, v := range errs {
+			aulogging.Logger.Ctx(ctx).Warn().Printf("paylink list query validation error: %s: %s", k, v[0])
+		}
+		return filter, errs
+	}
+}
+
 func paylinkRequestParseErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
 	aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("paylink body could not be parsed: %s", err.Error())
 	ctlutil.ErrorHandler(ctx, w, r, "paylink.parse.error", http.StatusBadRequest, nil)
@@ -158,6 +319,16 @@ func invalidPaylinkIdErrorHandler(ctx context.Context, w http.ResponseWriter, r
 	ctlutil.ErrorHandler(ctx, w, r, "paylink.id.invalid", http.StatusBadRequest, url.Values{})
 }
 
+func refundConflictErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("paylink refund not possible: %s", err.Error())
+	ctlutil.ErrorHandler(ctx, w, r, "paylink.refund.conflict", http.StatusConflict, url.Values{"details": []string{err.Error()}})
+}
+
+func idempotencyConflictErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("paylink creation refused: %s", err.Error())
+	ctlutil.ErrorHandler(ctx, w, r, "paylink.idempotency.conflict", http.StatusConflict, url.Values{"details": []string{err.Error()}})
+}
+
 func paylinkNotFoundErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, id uint) {
 	aulogging.Logger.Ctx(ctx).Warn().Printf("paylink id %d not found", id)
 	ctlutil.ErrorHandler(ctx, w, r, "paylink.id.notfound", http.StatusNotFound, url.Values{})
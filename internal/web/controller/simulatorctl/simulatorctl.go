@@ -65,7 +65,8 @@ func useSimulator(w http.ResponseWriter, r *http.Request) {
 	selfCaller := self.Get()
 	event := cncrdapi.WebhookEventDto{
 		Transaction: cncrdapi.WebhookEventTransaction{
-			Id: tx.ID,
+			Id:     tx.ID,
+			Status: tx.Status,
 			Invoice: cncrdapi.WebhookEventTransactionInvoice{
 				ReferenceId:      paylink.ReferenceId,
 				PaymentRequestId: int64(id),
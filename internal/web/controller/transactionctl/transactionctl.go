@@ -0,0 +1,77 @@
+package transactionctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	aulogging "github.com/StephanHCB/go-autumn-logging"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/service/paymentlinksrv"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctlutil"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/web/util/ctxvalues"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var paymentLinkService paymentlinksrv.PaymentLinkService
+
+// maxReplayDays limits how far back a replay may reach, the downstream api is slow for large time windows
+const maxReplayDays = 90
+
+func Create(server chi.Router, paymentLinkSrv paymentlinksrv.PaymentLinkService) {
+	paymentLinkService = paymentLinkSrv
+
+	server.Post("/api/rest/v1/transactions/replay", replayTransactionsHandler)
+}
+
+func replayTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !ctxvalues.HasApiToken(ctx) {
+		ctlutil.UnauthenticatedError(ctx, w, r, "you must be logged in for this operation", "anonymous access attempt")
+		return
+	}
+
+	days, err := daysFromQuery(ctx, w, r)
+	if err != nil {
+		return
+	}
+
+	dto, err := paymentLinkService.ReplayTransactions(ctx, days)
+	if err != nil {
+		if errors.Is(err, concardis.DownstreamError) || errors.Is(err, concardis.NotSuccessful) {
+			downstreamErrorHandler(ctx, w, r, "paylink", err)
+		} else {
+			ctlutil.UnexpectedError(ctx, w, r, err)
+		}
+		return
+	}
+
+	ctlutil.WriteJson(ctx, w, dto)
+}
+
+func daysFromQuery(ctx context.Context, w http.ResponseWriter, r *http.Request) (uint, error) {
+	daysStr := r.URL.Query().Get("days")
+	if daysStr == "" {
+		return 1, nil
+	}
+	days, err := strconv.ParseUint(daysStr, 10, 32)
+	if err == nil && (days < 1 || days > maxReplayDays) {
+		err = fmt.Errorf("days must be between 1 and %d", maxReplayDays)
+	}
+	if err != nil {
+		invalidDaysErrorHandler(ctx, w, r, daysStr)
+	}
+	return uint(days), err
+}
+
+func downstreamErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, sysname string, err error) {
+	aulogging.Logger.Ctx(ctx).Warn().WithErr(err).Printf("%s downstream error: %s", sysname, err.Error())
+	ctlutil.ErrorHandler(ctx, w, r, fmt.Sprintf("%s.downstream.error", sysname), http.StatusBadGateway, nil)
+}
+
+func invalidDaysErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, days string) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("received invalid number of days '%s'", url.QueryEscape(days))
+	ctlutil.ErrorHandler(ctx, w, r, "replay.days.invalid", http.StatusBadRequest, url.Values{"details": []string{fmt.Sprintf("days must be an integer between 1 and %d", maxReplayDays)}})
+}
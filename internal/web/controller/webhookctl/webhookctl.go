@@ -3,6 +3,7 @@ package webhookctl
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	aulogging "github.com/StephanHCB/go-autumn-logging"
@@ -14,6 +15,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
@@ -23,21 +25,27 @@ func Create(server chi.Router, paymentLinkSrv paymentlinksrv.PaymentLinkService)
 	paymentLinkService = paymentLinkSrv
 
 	server.Post("/api/rest/v1/webhook/{secret}", webhookHandler)
+	server.Post("/api/rest/v1/webhook", webhookHandler) // signature mode only
 }
 
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	if !secretFromVarsOk(ctx, w, r) {
-		ctlutil.UnauthenticatedError(ctx, w, r, "invalid secret supplied", "invalid secret for webhook")
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		webhookRequestParseErrorHandler(ctx, w, r, err)
+		return
+	}
+
+	if !webhookAuthenticated(ctx, w, r, bodyBytes) {
 		return
 	}
 
-	request, err := parseBodyToWebhookEventDtoTolerant(ctx, w, r)
+	request, err := parseBodyToWebhookEventDtoTolerant(ctx, w, r, bodyBytes)
 	if err != nil {
 		return
 	}
 
-	err = paymentLinkService.HandleWebhook(ctx, request)
+	err = paymentLinkService.ReceiveWebhook(ctx, request)
 	if err != nil {
 		if errors.Is(err, paymentlinksrv.WebhookValidationErr) {
 			webhookRequestInvalidErrorHandler(ctx, w, r, err)
@@ -53,15 +61,9 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func parseBodyToWebhookEventDtoTolerant(ctx context.Context, w http.ResponseWriter, r *http.Request) (cncrdapi.WebhookEventDto, error) {
+func parseBodyToWebhookEventDtoTolerant(ctx context.Context, w http.ResponseWriter, r *http.Request, bodyBytes []byte) (cncrdapi.WebhookEventDto, error) {
 	dto := cncrdapi.WebhookEventDto{}
 
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		webhookRequestParseErrorHandler(ctx, w, r, err)
-		return dto, err
-	}
-
 	if config.LogFullRequests() {
 		bodyStr := string(bodyBytes)
 		bodyStr = strings.ReplaceAll(bodyStr, "\r", "")
@@ -70,7 +72,7 @@ func parseBodyToWebhookEventDtoTolerant(ctx context.Context, w http.ResponseWrit
 	}
 
 	decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
-	err = decoder.Decode(&dto)
+	err := decoder.Decode(&dto)
 	if err != nil {
 		webhookRequestParseErrorHandler(ctx, w, r, err)
 		return dto, err
@@ -79,9 +81,54 @@ func parseBodyToWebhookEventDtoTolerant(ctx context.Context, w http.ResponseWrit
 	return dto, nil
 }
 
+// webhookAuthenticated checks the path secret and/or the signature header, depending on the configured mode.
+//
+// Writes the error response if the request is rejected.
+func webhookAuthenticated(ctx context.Context, w http.ResponseWriter, r *http.Request, bodyBytes []byte) bool {
+	signature := r.Header.Get(config.WebhookSignatureHeader())
+
+	switch config.WebhookSecurityMode() {
+	case config.WebhookModeSignature:
+		return signatureOk(ctx, w, r, bodyBytes, signature)
+	case config.WebhookModeBoth:
+		if signature != "" {
+			return signatureOk(ctx, w, r, bodyBytes, signature)
+		}
+		if !secretFromVarsOk(ctx, w, r) {
+			ctlutil.UnauthenticatedError(ctx, w, r, "invalid secret supplied", "invalid secret for webhook")
+			return false
+		}
+		aulogging.Logger.Ctx(ctx).Warn().Print("unsigned webhook accepted based on path secret alone")
+		return true
+	default:
+		if !secretFromVarsOk(ctx, w, r) {
+			ctlutil.UnauthenticatedError(ctx, w, r, "invalid secret supplied", "invalid secret for webhook")
+			return false
+		}
+		return true
+	}
+}
+
+func signatureOk(ctx context.Context, w http.ResponseWriter, r *http.Request, bodyBytes []byte, signature string) bool {
+	if signature == "" {
+		webhookSignatureErrorHandler(ctx, w, r, "missing signature")
+		return false
+	}
+	if !concardis.VerifyWebhookSignature(bodyBytes, signature) {
+		webhookSignatureErrorHandler(ctx, w, r, "invalid signature")
+		return false
+	}
+	return true
+}
+
 func secretFromVarsOk(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
 	secretReceived := chi.URLParam(r, "secret")
-	return secretReceived == config.WebhookSecret()
+	return subtle.ConstantTimeCompare([]byte(secretReceived), []byte(config.WebhookSecret())) == 1
+}
+
+func webhookSignatureErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, details string) {
+	aulogging.Logger.Ctx(ctx).Warn().Printf("webhook rejected: %s", details)
+	ctlutil.ErrorHandler(ctx, w, r, "webhook.signature.invalid", http.StatusUnauthorized, url.Values{"details": []string{details}})
 }
 
 func webhookRequestParseErrorHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
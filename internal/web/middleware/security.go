@@ -25,6 +25,9 @@ func TokenValidator(next http.Handler) http.Handler {
 			if apiTokenValue == config.FixedApiToken() {
 				ctxvalues.SetApiToken(ctx, apiTokenValue)
 				next.ServeHTTP(w, r)
+			} else if adminName := config.AdminForToken(apiTokenValue); adminName != "" {
+				ctxvalues.SetAuthorizedAs(ctx, adminName)
+				next.ServeHTTP(w, r)
 			} else {
 				ctlutil.UnauthenticatedError(ctx, w, r, "invalid api token", "request supplied invalid api token, denying")
 			}
@@ -61,3 +61,16 @@ func HasApiToken(ctx context.Context) bool {
 func SetApiToken(ctx context.Context, apiToken string) {
 	setValue(ctx, ContextApiToken, apiToken)
 }
+
+// AuthorizedAs is the name of the admin whose token was supplied, or "" if none was.
+func AuthorizedAs(ctx context.Context) string {
+	return valueOrDefault(ctx, ContextAuthorizedAs, "")
+}
+
+func HasAdminToken(ctx context.Context) bool {
+	return AuthorizedAs(ctx) != ""
+}
+
+func SetAuthorizedAs(ctx context.Context, adminName string) {
+	setValue(ctx, ContextAuthorizedAs, adminName)
+}
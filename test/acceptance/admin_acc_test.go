@@ -0,0 +1,348 @@
+package acceptance
+
+import (
+	"github.com/eurofurence/reg-payment-cncrd-adapter/docs"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/paymentservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/service/paymentlinksrv"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// --- list failures ---
+
+func TestAdmin_ListFailures_Success(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a webhook delivery that failed because the payment provider was down")
+	tstFailWebhookDelivery(t)
+
+	docs.Given("and an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request the list of failures")
+	response := tstPerformGet("/api/rest/v1/admin/failures?days=3", token)
+
+	docs.Then("then the request is successful and the failure is listed with its protocol")
+	require.Equal(t, http.StatusOK, response.status)
+	actual := cncrdapi.AdminFailureListDto{}
+	tstParseJson(response.body, &actual)
+	require.Equal(t, 1, len(actual.Failures))
+	failure := actual.Failures[0]
+	require.Equal(t, "221216-122218-000001", failure.ReferenceId)
+	require.Equal(t, uint(42), failure.PaylinkId)
+	require.Equal(t, "webhook query-pay-link failed", failure.LastError)
+	require.NotEmpty(t, failure.LastErrorAt)
+	require.Equal(t, 1, len(failure.Protocol))
+	require.Equal(t, "error", failure.Protocol[0].Kind)
+	require.Equal(t, "webhook query-pay-link failed", failure.Protocol[0].Message)
+}
+
+func TestAdmin_ListFailures_Empty(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request the list of failures while nothing has failed")
+	response := tstPerformGet("/api/rest/v1/admin/failures", token)
+
+	docs.Then("then the request is successful and the list is empty")
+	require.Equal(t, http.StatusOK, response.status)
+	actual := cncrdapi.AdminFailureListDto{}
+	tstParseJson(response.body, &actual)
+	require.Equal(t, 0, len(actual.Failures))
+}
+
+func TestAdmin_ListFailures_InvalidDays(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request the list of failures for too many days")
+	response := tstPerformGet("/api/rest/v1/admin/failures?days=91", token)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "admin.days.invalid", url.Values{
+		"details": []string{"days must be an integer between 1 and 90"},
+	})
+}
+
+func TestAdmin_ListFailures_ResolvedLater(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a webhook delivery that failed because the payment provider was down")
+	tstFailWebhookDelivery(t)
+
+	docs.Given("and the webhook was delivered again successfully after the payment provider was back")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.When("when an admin requests the list of failures")
+	response = tstPerformGet("/api/rest/v1/admin/failures", tstValidAdminToken())
+
+	docs.Then("then the request is successful and the resolved failure is not listed")
+	require.Equal(t, http.StatusOK, response.status)
+	actual := cncrdapi.AdminFailureListDto{}
+	tstParseJson(response.body, &actual)
+	require.Equal(t, 0, len(actual.Failures))
+}
+
+func TestAdmin_ListFailures_BookingFailedLater(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a webhook delivery that failed because the payment provider was down")
+	tstFailWebhookDelivery(t)
+
+	docs.Given("and the webhook was delivered again while the payment service was down")
+	paymentMock.SimulateGetError(paymentservice.DownstreamError)
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+	require.NotEqual(t, http.StatusOK, response.status)
+	paymentMock.Reset()
+
+	docs.When("when an admin requests the list of failures")
+	response = tstPerformGet("/api/rest/v1/admin/failures", tstValidAdminToken())
+
+	docs.Then("then the request is successful and the failure is still listed because nothing was booked")
+	require.Equal(t, http.StatusOK, response.status)
+	actual := cncrdapi.AdminFailureListDto{}
+	tstParseJson(response.body, &actual)
+	require.Equal(t, 1, len(actual.Failures))
+	failure := actual.Failures[0]
+	require.Equal(t, "221216-122218-000001", failure.ReferenceId)
+	require.Equal(t, "booking failed", failure.LastError)
+	require.Equal(t, 3, len(failure.Protocol))
+	require.Equal(t, "webhook query-pay-link failed", failure.Protocol[0].Message)
+	require.Equal(t, "webhook query-pay-link", failure.Protocol[1].Message)
+	require.Equal(t, "booking failed", failure.Protocol[2].Message)
+}
+
+func TestAdmin_ListFailures_ApiToken(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token, but no admin token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to request the list of failures")
+	response := tstPerformGet("/api/rest/v1/admin/failures", token)
+
+	docs.Then("then the request is denied as unauthorized (403) and the correct error is returned")
+	tstRequireErrorResponse(t, response, http.StatusForbidden, "auth.forbidden", "you need an admin token for this operation")
+}
+
+func TestAdmin_ListFailures_Anonymous(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an anonymous caller")
+	token := tstNoToken()
+
+	docs.When("when they attempt to request the list of failures")
+	response := tstPerformGet("/api/rest/v1/admin/failures", token)
+
+	docs.Then("then the request is denied as unauthenticated (401) and the correct error is returned")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "you must be logged in for this operation")
+}
+
+// --- rerun ---
+
+func TestAdmin_Rerun_ByPaylinkId(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a webhook delivery that failed because the payment provider was down")
+	tstFailWebhookDelivery(t)
+
+	docs.Given("and an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request a re-run for the paylink id after the payment provider is back")
+	response := tstPerformPost("/api/rest/v1/admin/rerun", `{"paylink_id":42}`, token)
+
+	docs.Then("then the request is successful and the re-run succeeded")
+	tstRequireRerunResponse(t, response, cncrdapi.AdminRerunResultDto{
+		ReferenceId: "221216-122218-000001",
+		PaylinkId:   42,
+		Outcome:     "success",
+	})
+
+	docs.Then("and the payment has been booked")
+	require.Equal(t, 1, len(paymentMock.Recording()))
+
+	docs.Then("and the re-run has been recorded in the protocol")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "error",
+		Message:     "webhook query-pay-link failed",
+		Details:     "downstream unavailable - see log for details",
+	}, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "webhook query-pay-link",
+		Details:     "status=confirmed amount=390",
+	}, tstBookingProtocol(paymentservice.Valid, paymentlinksrv.BookingUpdated), entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "rerun",
+		Message:     "admin rerun success",
+		Details:     "triggered-by=squirrel",
+	})
+}
+
+func TestAdmin_Rerun_ByReferenceId(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a webhook delivery that failed because the payment provider was down")
+	tstFailWebhookDelivery(t)
+
+	docs.Given("and an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request a re-run for the reference id after the payment provider is back")
+	response := tstPerformPost("/api/rest/v1/admin/rerun", `{"reference_id":"221216-122218-000001"}`, token)
+
+	docs.Then("then the request is successful and the re-run succeeded for the paylink id from the protocol")
+	tstRequireRerunResponse(t, response, cncrdapi.AdminRerunResultDto{
+		ReferenceId: "221216-122218-000001",
+		PaylinkId:   42,
+		Outcome:     "success",
+	})
+
+	docs.Then("and the payment has been booked")
+	require.Equal(t, 1, len(paymentMock.Recording()))
+}
+
+func TestAdmin_Rerun_Failed(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a webhook delivery that failed because the payment provider was down")
+	tstFailWebhookDelivery(t)
+
+	docs.Given("and an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request a re-run for the reference id while the payment provider is still down")
+	concardisMock.SimulateError(concardis.DownstreamError)
+	response := tstPerformPost("/api/rest/v1/admin/rerun", `{"reference_id":"221216-122218-000001"}`, token)
+
+	docs.Then("then the request is successful but the re-run is reported as failed")
+	tstRequireRerunResponse(t, response, cncrdapi.AdminRerunResultDto{
+		ReferenceId: "221216-122218-000001",
+		PaylinkId:   42,
+		Outcome:     "failed",
+		Details:     "downstream unavailable - see log for details",
+	})
+}
+
+func TestAdmin_Rerun_UnknownReference(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request a re-run for a reference id that is not in the protocol")
+	response := tstPerformPost("/api/rest/v1/admin/rerun", `{"reference_id":"221216-122218-000001"}`, token)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusNotFound, "admin.reference.notfound", nil)
+}
+
+func TestAdmin_Rerun_InvalidData(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request a re-run with both ids")
+	response := tstPerformPost("/api/rest/v1/admin/rerun", `{"paylink_id":42,"reference_id":"221216-122218-000001"}`, token)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "admin.data.invalid", url.Values{
+		"paylink_id": []string{"exactly one of paylink_id and reference_id must be set"},
+	})
+
+	docs.Then("and no downstream requests have been made")
+	tstRequireConcardisRecording(t)
+}
+
+func TestAdmin_Rerun_InvalidJson(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an admin who supplies their admin token")
+	token := tstValidAdminToken()
+
+	docs.When("when they request a re-run with an invalid body")
+	response := tstPerformPost("/api/rest/v1/admin/rerun", `{"paylink_id":"forty-two"}`, token)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "admin.parse.error", nil)
+}
+
+func TestAdmin_Rerun_ApiToken(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token, but no admin token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to request a re-run")
+	response := tstPerformPost("/api/rest/v1/admin/rerun", `{"paylink_id":42}`, token)
+
+	docs.Then("then the request is denied as unauthorized (403) and the correct error is returned")
+	tstRequireErrorResponse(t, response, http.StatusForbidden, "auth.forbidden", "you need an admin token for this operation")
+
+	docs.Then("and no downstream requests have been made")
+	tstRequireConcardisRecording(t)
+}
+
+func TestAdmin_Rerun_Anonymous(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an anonymous caller")
+	token := tstNoToken()
+
+	docs.When("when they attempt to request a re-run")
+	response := tstPerformPost("/api/rest/v1/admin/rerun", `{"paylink_id":42}`, token)
+
+	docs.Then("then the request is denied as unauthenticated (401) and the correct error is returned")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "you must be logged in for this operation")
+
+	docs.Then("and no downstream requests have been made")
+	tstRequireConcardisRecording(t)
+}
+
+// --- helpers ---
+
+func tstFailWebhookDelivery(t *testing.T) {
+	concardisMock.SimulateError(concardis.DownstreamError)
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+	require.Equal(t, http.StatusBadGateway, response.status)
+	concardisMock.Reset()
+	mailMock.Reset()
+}
+
+func tstRequireRerunResponse(t *testing.T, response tstWebResponse, expectedBody cncrdapi.AdminRerunResultDto) {
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	actualBody := cncrdapi.AdminRerunResultDto{}
+	tstParseJson(response.body, &actualBody)
+	require.EqualValues(t, expectedBody, actualBody)
+}
@@ -0,0 +1,203 @@
+package acceptance
+
+import (
+	"context"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/docs"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/mailservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/service/paymentlinksrv"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutbox_Success(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstEnableWebhookOutbox()
+
+	docs.Given("given an anonymous caller who knows the secret url")
+	url := "/api/rest/v1/webhook/demosecret"
+
+	docs.When("when they trigger our webhook endpoint with valid information")
+	response := tstPerformPost(url, tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+
+	docs.Then("then the request is acknowledged immediately")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and no downstream requests have been made yet")
+	tstRequireConcardisRecording(t)
+	require.Equal(t, 0, len(paymentMock.Recording()))
+
+	docs.When("when the background worker runs")
+	processed := tstProcessWebhookOutbox(0)
+
+	docs.Then("then the event has been processed")
+	require.Equal(t, 1, processed)
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+	)
+	require.Equal(t, 1, len(paymentMock.Recording()))
+
+	docs.Then("and it is not processed a second time")
+	require.Equal(t, 0, tstProcessWebhookOutbox(time.Hour))
+}
+
+func TestOutbox_RetryWithBackoff(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstEnableWebhookOutbox()
+
+	docs.Given("given a webhook event was received while the payment provider is down")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+	concardisMock.SimulateError(concardis.DownstreamError)
+
+	docs.When("when the background worker runs")
+	require.Equal(t, 1, tstProcessWebhookOutbox(0))
+
+	docs.Then("then the event is not retried before the initial backoff has passed")
+	require.Equal(t, 0, tstProcessWebhookOutbox(29*time.Second))
+
+	docs.When("when the payment provider is back, and the initial backoff has passed")
+	concardisMock.Reset()
+	require.Equal(t, 1, tstProcessWebhookOutbox(30*time.Second))
+
+	docs.Then("then the event has been processed")
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+	)
+	require.Equal(t, 1, len(paymentMock.Recording()))
+}
+
+func TestOutbox_DeadLetter(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstEnableWebhookOutbox()
+	config.Configuration().Service.WebhookOutbox.MaxAttempts = 2
+
+	docs.Given("given a webhook event was received while the payment provider is down")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+	concardisMock.SimulateError(concardis.DownstreamError)
+
+	docs.When("when the background worker fails to process it the maximum number of times")
+	require.Equal(t, 1, tstProcessWebhookOutbox(0))
+	require.Equal(t, 1, tstProcessWebhookOutbox(30*time.Second))
+
+	docs.Then("then the event is not retried any more")
+	require.Equal(t, 0, tstProcessWebhookOutbox(24*time.Hour))
+
+	docs.Then("and an error notification email has been sent for each attempt and for giving up")
+	attemptFailedMail := tstExpectedMailNotification("webhook", "api-error")
+	attemptFailedMail.Variables["referenceId"] = "paylinkId: 42"
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{
+		attemptFailedMail,
+		attemptFailedMail,
+		tstExpectedMailNotification("webhook", "dead-letter"),
+	})
+
+	docs.Then("and the expected protocol entries have been written")
+	attemptFailedEntry := entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "error",
+		Message:     "webhook query-pay-link failed",
+		Details:     "downstream unavailable - see log for details",
+	}
+	tstRequireProtocolEntries(t, attemptFailedEntry, attemptFailedEntry, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "error",
+		Message:     "webhook dead-letter",
+		Details:     "attempts=2 error=downstream unavailable - see log for details",
+	})
+}
+
+func TestOutbox_ConcurrentWorkers(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstEnableWebhookOutbox()
+
+	docs.Given("given a webhook event was received")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.When("when the background workers of several instances run at the same time")
+	processed := make([]int, 3)
+	var wg sync.WaitGroup
+	for n := range processed {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			processed[n] = tstProcessWebhookOutbox(0)
+		}(n)
+	}
+	wg.Wait()
+
+	docs.Then("then the event has been processed by exactly one of them")
+	require.Equal(t, 1, processed[0]+processed[1]+processed[2])
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+	)
+	require.Equal(t, 1, len(paymentMock.Recording()))
+}
+
+func TestOutbox_ClaimedByDeadInstance(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstEnableWebhookOutbox()
+
+	docs.Given("given a webhook event was claimed by an instance that died before processing it")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+	claimed, err := database.GetRepository().ClaimDueOutboxEvents(context.Background(), tstMockNow(), tstMockNow().Add(10*time.Minute), 50)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(claimed))
+
+	docs.Then("then the event is left alone by the other instances while the claim lasts")
+	require.Equal(t, 0, tstProcessWebhookOutbox(9*time.Minute))
+
+	docs.Then("and it is processed once the claim has run out")
+	require.Equal(t, 1, tstProcessWebhookOutbox(10*time.Minute))
+	require.Equal(t, 1, len(paymentMock.Recording()))
+}
+
+func TestOutbox_InvalidPaylinkIdIsNotQueued(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstEnableWebhookOutbox()
+
+	docs.Given("given an anonymous caller who knows the secret url")
+	url := "/api/rest/v1/webhook/demosecret"
+
+	docs.When("when they trigger our webhook endpoint with an invalid paylink id")
+	response := tstPerformPost(url, `{"transaction":{"id":1,"invoice":{"paymentRequestId":0,"referenceId":"221216-122218-000001"}}}`, tstNoToken())
+
+	docs.Then("then the request fails immediately with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "webhook.data.invalid", nil)
+
+	docs.Then("and nothing has been queued")
+	require.Equal(t, 0, tstProcessWebhookOutbox(time.Hour))
+}
+
+// --- helpers ---
+
+func tstEnableWebhookOutbox() {
+	config.Configuration().Service.WebhookOutbox.Disable = false
+}
+
+// tstProcessWebhookOutbox runs the background worker once, at a time offset relative to the mock time
+func tstProcessWebhookOutbox(offset time.Duration) int {
+	worker := &paymentlinksrv.Impl{
+		Now: func() time.Time {
+			return tstMockNow().Add(offset)
+		},
+	}
+	return worker.ProcessWebhookOutbox(context.Background())
+}
@@ -1,16 +1,25 @@
 package acceptance
 
 import (
+	"context"
+	"fmt"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/docs"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/attendeeservice"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database/dbrepo"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/mailservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/paymentservice"
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // --- create ---
@@ -31,7 +40,7 @@ func TestCreatePaylink_Success(t *testing.T) {
 
 	docs.Then("and the expected request for a payment link has been made")
 	tstRequireConcardisRecording(t,
-		"CreatePaymentLink {some page title some page description 1 221216-122218-000001 221216122218000001 some payment purpose 390 19 EUR registration jsquirrel_github_9a6d@packetloss.de  }",
+		"CreatePaymentLink {some page title some page description 1 221216-122218-000001 221216122218000001 some payment purpose 390 19 EUR registration jsquirrel_github_9a6d@packetloss.de []   }",
 	)
 
 	docs.Then("and the expected protocol entries have been written")
@@ -42,6 +51,661 @@ func TestCreatePaylink_Success(t *testing.T) {
 		Message:     "create-pay-link",
 		Details:     "http://localhost:1111/some/paylink/101",
 	})
+
+	docs.Then("and the payment link has been stored locally")
+	tstRequireStoredPaylink(t, 101, tstBuildValidStoredPaylink())
+}
+
+func TestCreatePaylink_PrefillFields(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service is configured to show name and address fields, some of them prefilled and mandatory")
+	config.Configuration().Invoice.Fields = map[string]config.InvoiceFieldConfig{
+		"forename": {Show: true, Mandatory: true, Prefill: true},
+		"surname":  {Show: true, Mandatory: true, Prefill: true},
+		"street":   {Show: true},
+		"country":  {Show: true, Prefill: true},
+		"place":    {},
+	}
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to create a payment link with valid information")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request is successful and the response is as expected")
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, tstBuildValidPaymentLink())
+
+	docs.Then("and the configured fields have been requested in a fixed order, prefilled from the attendee data")
+	tstRequireConcardisRecording(t,
+		"CreatePaymentLink {some page title some page description 1 221216-122218-000001 221216122218000001 some payment purpose 390 19 EUR registration jsquirrel_github_9a6d@packetloss.de "+
+			"[{forename true true John} {surname true true Squirrel} {street true false } {place false false } {country true false DE}]   }",
+	)
+}
+
+func TestCreatePaylink_Localized(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service is configured with german invoice texts")
+	config.Configuration().Invoice.Languages = map[string]config.InvoiceTextConfig{
+		"de-DE": {Title: "Seitentitel", Description: "Seitenbeschreibung", Purpose: "Zahlungszweck"},
+		"fr-FR": {Title: "titre", Description: "description", Purpose: "objet"},
+	}
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they create a payment link for an attendee who registered in german")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request is successful and the response contains the german texts")
+	expected := tstBuildValidPaymentLink()
+	expected.Title = "Seitentitel"
+	expected.Description = "Seitenbeschreibung"
+	expected.Purpose = "Zahlungszweck"
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, expected)
+
+	docs.Then("and a german payment page has been requested")
+	tstRequireConcardisRecording(t,
+		"CreatePaymentLink {Seitentitel Seitenbeschreibung 1 221216-122218-000001 221216122218000001 Zahlungszweck 390 19 EUR registration jsquirrel_github_9a6d@packetloss.de [] de  }",
+	)
+}
+
+func TestCreatePaylink_LocalizedFallback(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service is configured with english default texts and french invoice texts only")
+	config.Configuration().Invoice.DefaultLanguage = "en-US"
+	config.Configuration().Invoice.Languages = map[string]config.InvoiceTextConfig{
+		"fr-FR": {Title: "titre", Description: "description", Purpose: "objet"},
+	}
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they create a payment link for an attendee who registered in german")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request is successful and the response contains the default texts")
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, tstBuildValidPaymentLink())
+
+	docs.Then("and an english payment page has been requested")
+	tstRequireConcardisRecording(t,
+		"CreatePaymentLink {some page title some page description 1 221216-122218-000001 221216122218000001 some payment purpose 390 19 EUR registration jsquirrel_github_9a6d@packetloss.de [] en  }",
+	)
+}
+
+func TestCreatePaylink_TemplatedTexts(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service is configured with invoice text templates")
+	config.Configuration().Invoice.Title = "Attendee Fee for {{ .Nickname }} ({{ .BadgeNumber }})"
+	config.Configuration().Invoice.Description = "{{ .Amount }} {{ .Currency }} due"
+	config.Configuration().Invoice.Purpose = "{{ .ReferenceId }}"
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they create a payment link with valid information")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request is successful and the response contains the rendered texts")
+	expected := tstBuildValidPaymentLink()
+	expected.Title = "Attendee Fee for Squirrel (1)"
+	expected.Description = "3.90 EUR due"
+	expected.Purpose = "221216-122218-000001"
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, expected)
+
+	docs.Then("and the rendered texts have been sent to the payment provider")
+	tstRequireConcardisRecording(t,
+		"CreatePaymentLink {Attendee Fee for Squirrel (1) 3.90 EUR due 1 221216-122218-000001 221216122218000001 221216-122218-000001 390 19 EUR registration jsquirrel_github_9a6d@packetloss.de []   }",
+	)
+}
+
+func TestCreatePaylink_Overrides(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service allows redirects to the shop")
+	config.Configuration().Service.RedirectAllowedHosts = []string{"shop.example.com"}
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they create a payment link with their own texts and redirects")
+	requestBody := tstBuildValidPaymentLinkRequest()
+	requestBody.Title = "Dealers' Den Table"
+	requestBody.Description = "one full table"
+	requestBody.Purpose = "dealer fee"
+	requestBody.SuccessRedirect = "https://shop.example.com/paid"
+	requestBody.FailureRedirect = "https://SHOP.example.com/failed?again=1"
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is successful and the response contains their texts")
+	expected := tstBuildValidPaymentLink()
+	expected.Title = "Dealers' Den Table"
+	expected.Description = "one full table"
+	expected.Purpose = "dealer fee"
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, expected)
+
+	docs.Then("and their texts and redirects have been sent to the payment provider")
+	tstRequireConcardisRecording(t,
+		"CreatePaymentLink {Dealers' Den Table one full table 1 221216-122218-000001 221216122218000001 dealer fee 390 19 EUR registration jsquirrel_github_9a6d@packetloss.de []  https://shop.example.com/paid https://SHOP.example.com/failed?again=1}",
+	)
+
+	docs.When("when they repeat the request with different texts")
+	requestBody.Title = "Two Dealers' Den Tables"
+	response = tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+
+	docs.Then("then the open payment link is replaced instead of reused")
+	require.Equal(t, http.StatusCreated, response.status)
+	require.Equal(t, "/api/rest/v1/paylinks/102", response.location)
+}
+
+func TestCreatePaylink_OverrideRedirectNotAllowed(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service allows redirects to the shop")
+	config.Configuration().Service.RedirectAllowedHosts = []string{"shop.example.com"}
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to create a payment link with redirects to other hosts")
+	requestBody := tstBuildValidPaymentLinkRequest()
+	requestBody.SuccessRedirect = "https://evil.example.com/shop.example.com"
+	requestBody.FailureRedirect = "javascript:alert(1)"
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is denied with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "paylink.data.invalid", url.Values{
+		"success_redirect": []string{"redirect host evil.example.com is not allowed"},
+		"failure_redirect": []string{"optional redirect override must be an absolute http or https url"},
+	})
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
+}
+
+func TestCreatePaylink_Repeated(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link they have already created")
+	requestBody := tstBuildValidPaymentLinkRequest()
+	first := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+	require.Equal(t, http.StatusCreated, first.status)
+
+	docs.When("when they repeat the identical request without an idempotency key")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is successful and the original payment link is returned")
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, tstBuildValidPaymentLink())
+	require.Equal(t, "/api/rest/v1/paylinks/101", response.location)
+
+	docs.Then("and only one payment link has been created at the payment provider")
+	require.Equal(t, 1, tstCountConcardisRecording("CreatePaymentLink"))
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       101,
+		Kind:        "success",
+		Message:     "create-pay-link",
+		Details:     "http://localhost:1111/some/paylink/101",
+	}, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       101,
+		Kind:        "duplicate",
+		Message:     "create-pay-link repeated",
+		Details:     "http://localhost:1111/some/paylink/101",
+	})
+}
+
+func TestCreatePaylink_RepeatedAfterCancel(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link they have created that has since been cancelled")
+	requestBody := tstBuildValidPaymentLinkRequest()
+	first := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+	require.Equal(t, http.StatusCreated, first.status)
+	concardisMock.ManipulateStatus(101, "cancelled")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", `{"transaction":{"id":1892362737,"status":"cancelled","invoice":{"paymentRequestId":101,"referenceId":"221216-122218-000001"}}}`, tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.When("when they repeat the identical request without an idempotency key")
+	response = tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is successful and a new payment link is returned")
+	require.Equal(t, http.StatusCreated, response.status)
+	require.Equal(t, "/api/rest/v1/paylinks/102", response.location)
+}
+
+func TestCreatePaylink_RepeatedWithIdempotencyKey(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and two payment links they created with different idempotency keys")
+	requestBody := tstRenderJson(tstBuildValidPaymentLinkRequest())
+	response := tstPerformPostWithHeader("/api/rest/v1/paylinks", requestBody, "Idempotency-Key", "first-attempt", token)
+	require.Equal(t, "/api/rest/v1/paylinks/101", response.location)
+	otherRequest := tstBuildValidPaymentLinkRequest()
+	otherRequest.ReferenceId = "221216-122218-000002"
+	response = tstPerformPostWithHeader("/api/rest/v1/paylinks", tstRenderJson(otherRequest), "Idempotency-Key", "second-attempt", token)
+	require.Equal(t, "/api/rest/v1/paylinks/102", response.location)
+
+	docs.When("when they repeat the request with the first idempotency key")
+	response = tstPerformPostWithHeader("/api/rest/v1/paylinks", requestBody, "Idempotency-Key", "first-attempt", token)
+
+	docs.Then("then the request is successful and the first payment link is returned")
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, tstBuildValidPaymentLink())
+	require.Equal(t, "/api/rest/v1/paylinks/101", response.location)
+
+	docs.Then("and only two payment links have been created at the payment provider")
+	require.Equal(t, 2, len(concardisMock.Recording()))
+}
+
+func TestCreatePaylink_ConcurrentWithIdempotencyKey(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and the payment provider is slow to respond")
+	concardisMock.SimulateLatency(50 * time.Millisecond)
+
+	docs.When("when they retry a create request with an idempotency key while the first attempt is still in flight")
+	requestBody := tstRenderJson(tstBuildValidPaymentLinkRequest())
+	responses := make([]tstWebResponse, 3)
+	var wg sync.WaitGroup
+	for n := range responses {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			responses[n] = tstPerformPostWithHeader("/api/rest/v1/paylinks", requestBody, "Idempotency-Key", "first-attempt", token)
+		}(n)
+	}
+	wg.Wait()
+
+	docs.Then("then all requests are successful and return the same payment link")
+	for _, response := range responses {
+		require.Equal(t, http.StatusCreated, response.status)
+		require.Equal(t, "/api/rest/v1/paylinks/101", response.location)
+	}
+
+	docs.Then("and only one payment link has been created at the payment provider")
+	require.Equal(t, 1, tstCountConcardisRecording("CreatePaymentLink"))
+}
+
+func TestCreatePaylink_ConcurrentForReferenceId(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and the payment provider is slow to respond")
+	concardisMock.SimulateLatency(50 * time.Millisecond)
+
+	docs.When("when several create requests for the same reference id arrive at the same time, with different idempotency keys")
+	requestBody := tstRenderJson(tstBuildValidPaymentLinkRequest())
+	responses := make([]tstWebResponse, 3)
+	var wg sync.WaitGroup
+	for n := range responses {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			responses[n] = tstPerformPostWithHeader("/api/rest/v1/paylinks", requestBody, "Idempotency-Key", fmt.Sprintf("attempt-%d", n), token)
+		}(n)
+	}
+	wg.Wait()
+
+	docs.Then("then all requests are successful and return the same open payment link")
+	for _, response := range responses {
+		require.Equal(t, http.StatusCreated, response.status)
+		require.Equal(t, "/api/rest/v1/paylinks/101", response.location)
+	}
+
+	docs.Then("and only one payment link has been created at the payment provider")
+	require.Equal(t, 1, tstCountConcardisRecording("CreatePaymentLink"))
+}
+
+func TestCreatePaylink_IdempotencyConflict(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link they have already created with an idempotency key")
+	requestBody := tstBuildValidPaymentLinkRequest()
+	response := tstPerformPostWithHeader("/api/rest/v1/paylinks", tstRenderJson(requestBody), "Idempotency-Key", "some-key", token)
+	require.Equal(t, http.StatusCreated, response.status)
+
+	docs.When("when they reuse the idempotency key for a different amount")
+	requestBody.AmountDue = 500
+	response = tstPerformPostWithHeader("/api/rest/v1/paylinks", tstRenderJson(requestBody), "Idempotency-Key", "some-key", token)
+
+	docs.Then("then the request is denied with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusConflict, "paylink.idempotency.conflict", url.Values{
+		"details": []string{"idempotency key was already used for a different payment link request"},
+	})
+
+	docs.Then("and no second payment link has been created at the payment provider")
+	require.Equal(t, 1, tstCountConcardisRecording("CreatePaymentLink"))
+}
+
+func TestCreatePaylink_ReuseOpen(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and an open payment link nobody has paid on yet")
+	requestBody := tstRenderJson(tstBuildValidPaymentLinkRequest())
+	response := tstPerformPostWithHeader("/api/rest/v1/paylinks", requestBody, "Idempotency-Key", "first-checkout", token)
+	require.Equal(t, http.StatusCreated, response.status)
+
+	docs.When("when a new payment link for the same reference id, amount and currency is requested")
+	response = tstPerformPostWithHeader("/api/rest/v1/paylinks", requestBody, "Idempotency-Key", "second-checkout", token)
+
+	docs.Then("then the request is successful and the open payment link is returned")
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, tstBuildValidPaymentLink())
+	require.Equal(t, "/api/rest/v1/paylinks/101", response.location)
+
+	docs.Then("and no second payment link has been created at the payment provider")
+	require.Equal(t, 1, tstCountConcardisRecording("CreatePaymentLink"))
+
+	docs.Then("and the reuse has been protocolled")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       101,
+		Kind:        "success",
+		Message:     "create-pay-link",
+		Details:     "http://localhost:1111/some/paylink/101",
+	}, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       101,
+		Kind:        "duplicate",
+		Message:     "create-pay-link reused",
+		Details:     "http://localhost:1111/some/paylink/101",
+	})
+}
+
+func TestCreatePaylink_ReplaceOpenWithDifferentAmount(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and an open payment link nobody has paid on yet")
+	requestBody := tstBuildValidPaymentLinkRequest()
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+	require.Equal(t, http.StatusCreated, response.status)
+
+	docs.When("when a new payment link for the same reference id but a different amount is requested")
+	requestBody.AmountDue = 500
+	response = tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is successful and a new payment link is returned")
+	expected := tstBuildValidPaymentLink()
+	expected.AmountDue = 500
+	expected.Link = "http://localhost:1111/some/paylink/102"
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, expected)
+	require.Equal(t, "/api/rest/v1/paylinks/102", response.location)
+
+	docs.Then("and the old payment link has been deleted before creating the new one")
+	require.Equal(t, 4, len(concardisMock.Recording()))
+	require.Equal(t, []string{"QueryPaymentLink 101", "DeletePaymentLink 101"}, concardisMock.Recording()[1:3])
+
+	docs.Then("and only the new payment link is still stored")
+	_, err := database.GetRepository().GetPaylinkByApiId(context.Background(), 101)
+	require.ErrorIs(t, err, dbrepo.PaylinkNotFoundError)
+	stored, err := database.GetRepository().GetPaylinkByApiId(context.Background(), 102)
+	require.Nil(t, err)
+	require.Equal(t, int64(500), stored.AmountDue)
+}
+
+func TestCreatePaylink_NoReuseOfPaidLink(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link that has been paid")
+	requestBody := tstBuildValidPaymentLinkRequest()
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+	require.Equal(t, http.StatusCreated, response.status)
+	concardisMock.ManipulateStatus(101, "confirmed")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", `{"transaction":{"id":1892362737,"status":"confirmed","invoice":{"paymentRequestId":101,"referenceId":"221216-122218-000001"}}}`, tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+	concardisMock.Reset()
+
+	docs.When("when a new payment link for the same reference id but a different amount is requested")
+	requestBody.AmountDue = 500
+	response = tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is successful and a new payment link is created without deleting the paid one")
+	require.Equal(t, http.StatusCreated, response.status)
+	require.Equal(t, "/api/rest/v1/paylinks/102", response.location)
+	require.Equal(t, 1, len(concardisMock.Recording()))
+}
+
+func TestCreatePaylink_NoReuseOfPaidLinkWebhookMissed(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link that has been paid, but the webhook has not reached us")
+	requestBody := tstRenderJson(tstBuildValidPaymentLinkRequest())
+	response := tstPerformPost("/api/rest/v1/paylinks", requestBody, token)
+	require.Equal(t, http.StatusCreated, response.status)
+	concardisMock.ManipulateStatus(101, "confirmed")
+
+	docs.When("when a new payment link for the same reference id, amount and currency is requested")
+	response = tstPerformPostWithHeader("/api/rest/v1/paylinks", requestBody, "Idempotency-Key", "second-checkout", token)
+
+	docs.Then("then the request is successful and a new payment link is returned")
+	require.Equal(t, http.StatusCreated, response.status)
+	require.Equal(t, "/api/rest/v1/paylinks/102", response.location)
+
+	docs.Then("and the paid payment link has been checked with the payment provider, but not deleted")
+	require.Equal(t, "QueryPaymentLink 101", concardisMock.Recording()[1])
+	require.Equal(t, 0, tstCountConcardisRecording("DeletePaymentLink"))
+
+	docs.Then("and the stored status of the paid payment link has been updated")
+	stored, err := database.GetRepository().GetPaylinkByApiId(context.Background(), 101)
+	require.Nil(t, err)
+	require.Equal(t, "confirmed", stored.Status)
+}
+
+func TestCreatePaylink_NoReplaceOfLinkWithPaymentInProgress(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a waiting payment link with a payment in progress, that we have not been told about")
+	stored := tstBuildValidStoredPaylink()
+	stored.ApiId = 43
+	stored.ReferenceId = "221216-122218-000002"
+	_ = database.GetRepository().WritePaylink(context.Background(), &stored)
+	concardisMock.ManipulateStatus(43, "waiting")
+	concardisMock.ManipulateTransaction(43, 4714, "authorized")
+
+	docs.When("when a new payment link for the same reference id but a different amount is requested")
+	requestBody := tstBuildValidPaymentLinkRequest()
+	requestBody.ReferenceId = "221216-122218-000002"
+	requestBody.AmountDue = 500
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is successful and a new payment link is returned")
+	require.Equal(t, http.StatusCreated, response.status)
+	require.Equal(t, "/api/rest/v1/paylinks/101", response.location)
+
+	docs.Then("and the payment link with the payment in progress has been checked, but not deleted")
+	require.Equal(t, "QueryPaymentLink 43", concardisMock.Recording()[0])
+	require.Equal(t, 0, tstCountConcardisRecording("DeletePaymentLink"))
+}
+
+func TestCreatePaylink_ForgetOpenLinkGoneAtProvider(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a stored open payment link that the payment provider no longer knows")
+	stored := tstBuildValidStoredPaylink()
+	stored.ApiId = 99
+	_ = database.GetRepository().WritePaylink(context.Background(), &stored)
+
+	docs.When("when a new payment link for the same reference id is requested")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request is successful and a new payment link is returned")
+	require.Equal(t, http.StatusCreated, response.status)
+	require.Equal(t, "/api/rest/v1/paylinks/101", response.location)
+
+	docs.Then("and the stale payment link has been forgotten")
+	_, err := database.GetRepository().GetPaylinkByApiId(context.Background(), 99)
+	require.ErrorIs(t, err, dbrepo.PaylinkNotFoundError)
+}
+
+func TestCreatePaylink_IdempotencyKeyTooLong(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to create a payment link with an overly long idempotency key")
+	response := tstPerformPostWithHeader("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), "Idempotency-Key", strings.Repeat("k", 256), token)
+
+	docs.Then("then the request is denied with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "paylink.data.invalid", url.Values{
+		"idempotency_key": []string{"the Idempotency-Key header may be at most 255 characters long"},
+	})
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
+}
+
+func TestCreatePaylink_VerifyAmount_Success(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service is configured to verify the amount due with the payment service")
+	config.Configuration().Service.VerifyAmountDue = true
+
+	docs.Given("and the payment service has a matching tentative transaction for the reference id")
+	tstInjectTentativeTransaction(390, "EUR", 19.0)
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to create a payment link with valid information")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request is successful and the response is as expected")
+	tstRequirePaymentLinkResponse(t, response, http.StatusCreated, tstBuildValidPaymentLink())
+}
+
+func TestCreatePaylink_VerifyAmount_Mismatch(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service is configured to verify the amount due with the payment service")
+	config.Configuration().Service.VerifyAmountDue = true
+
+	docs.Given("and the payment service has a tentative transaction for a different amount and vat rate")
+	tstInjectTentativeTransaction(500, "EUR", 7.0)
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to create a payment link")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request is denied with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "paylink.data.invalid", url.Values{
+		"amount_due": []string{"does not match the amount the payment service expects (500)"},
+		"vat_rate":   []string{"does not match the vat rate the payment service expects (7)"},
+	})
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
+
+	docs.Then("and an error notification mail has been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{
+		tstExpectedMailNotification("create-pay-link", "amount-mismatch"),
+	})
+}
+
+func TestCreatePaylink_VerifyAmount_UnknownReference(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service is configured to verify the amount due with the payment service")
+	config.Configuration().Service.VerifyAmountDue = true
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to create a payment link for a reference id without a due or tentative transaction")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request is denied with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "paylink.data.invalid", url.Values{
+		"reference_id": []string{"the payment service has no due or tentative transaction for this reference id"},
+	})
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
+}
+
+func TestCreatePaylink_VerifyAmount_DownstreamError(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service is configured to verify the amount due with the payment service")
+	config.Configuration().Service.VerifyAmountDue = true
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to create a payment link while the payment service is down")
+	paymentMock.SimulateGetError(paymentservice.DownstreamError)
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadGateway, "paysrv.downstream.error", nil)
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
 }
 
 func TestCreatePaylink_InvalidJson(t *testing.T) {
@@ -209,6 +873,135 @@ func TestCreatePaylink_DownstreamErrorCncrd(t *testing.T) {
 	})
 }
 
+// --- list ---
+
+func TestListPaylinks_FilterByDebitor(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and payment links for several attendees that were created through this service")
+	tstCreatePaylinks(t, token)
+
+	docs.When("when they list the payment links for one badge number")
+	response := tstPerformGet("/api/rest/v1/paylinks?debitor_id=1", token)
+
+	docs.Then("then the request is successful and only the payment links for that attendee are returned, newest first")
+	actual := tstRequirePaymentLinkListResponse(t, response, 2)
+	require.Equal(t, uint(103), actual.Paylinks[0].Id)
+	require.Equal(t, "221216-122218-000003", actual.Paylinks[0].Paylink.ReferenceId)
+	require.Equal(t, uint(101), actual.Paylinks[1].Id)
+	require.Equal(t, uint64(1), actual.Paylinks[1].DebitorId)
+	require.Equal(t, "waiting", actual.Paylinks[1].Status)
+	require.Equal(t, tstBuildValidPaymentLink(), actual.Paylinks[1].Paylink)
+
+	docs.Then("and no downstream requests have been made to list them")
+	require.Equal(t, 3, len(concardisMock.Recording()))
+}
+
+func TestListPaylinks_FilterByReferenceAndStatus(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and payment links for several attendees that were created through this service")
+	tstCreatePaylinks(t, token)
+
+	docs.When("when they search for a reference id in a status")
+	response := tstPerformGet("/api/rest/v1/paylinks?reference_id=221216-122218-000002&status=waiting", token)
+
+	docs.Then("then the request is successful and only the matching payment link is returned")
+	actual := tstRequirePaymentLinkListResponse(t, response, 1)
+	require.Equal(t, uint(102), actual.Paylinks[0].Id)
+
+	docs.When("when they search for a status no payment link is in")
+	response = tstPerformGet("/api/rest/v1/paylinks?status=confirmed", token)
+
+	docs.Then("then the request is successful and the result is empty")
+	tstRequirePaymentLinkListResponse(t, response, 0)
+}
+
+func TestListPaylinks_FilterByCreationDate(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and payment links for several attendees that were created through this service")
+	tstCreatePaylinks(t, token)
+
+	docs.When("when they list the payment links created in a time window in the distant past")
+	response := tstPerformGet("/api/rest/v1/paylinks?created_after=2000-01-01T00:00:00Z&created_before=2001-01-01T00:00:00Z", token)
+
+	docs.Then("then the request is successful and the result is empty")
+	tstRequirePaymentLinkListResponse(t, response, 0)
+
+	docs.When("when they list the payment links created since then")
+	response = tstPerformGet("/api/rest/v1/paylinks?created_after=2000-01-01T00:00:00Z", token)
+
+	docs.Then("then the request is successful and all payment links are returned")
+	tstRequirePaymentLinkListResponse(t, response, 3)
+}
+
+func TestListPaylinks_Pagination(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and payment links for several attendees that were created through this service")
+	tstCreatePaylinks(t, token)
+
+	docs.When("when they request the second page with a page size of 2")
+	response := tstPerformGet("/api/rest/v1/paylinks?page=2&page_size=2", token)
+
+	docs.Then("then the request is successful and the last payment link is returned together with the total count")
+	actual := tstRequirePaymentLinkListResponse(t, response, 1)
+	require.Equal(t, uint(101), actual.Paylinks[0].Id)
+	require.Equal(t, 2, actual.Page)
+	require.Equal(t, 2, actual.PageSize)
+	require.Equal(t, int64(3), actual.Total)
+}
+
+func TestListPaylinks_InvalidParameters(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to list payment links with invalid filters and pagination")
+	response := tstPerformGet("/api/rest/v1/paylinks?debitor_id=squirrel&created_after=yesterday&page=0&page_size=1000", token)
+
+	docs.Then("then the request is denied with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "paylink.data.invalid", url.Values{
+		"debitor_id":    []string{"must be a positive integer (the badge number)"},
+		"created_after": []string{"must be a date-time in RFC 3339 format, e.g. 2006-01-02T15:04:05Z"},
+		"page":          []string{"must be a positive integer"},
+		"page_size":     []string{"must be an integer between 1 and 100"},
+	})
+}
+
+func TestListPaylinks_Anonymous(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an unauthenticated caller")
+	token := tstNoToken()
+
+	docs.When("when they attempt to list payment links")
+	response := tstPerformGet("/api/rest/v1/paylinks", token)
+
+	docs.Then("then the request is denied as unauthenticated (401) and the correct error is returned")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "you must be logged in for this operation")
+}
+
 // --- get ---
 
 func TestGetPaylink_Success(t *testing.T) {
@@ -239,6 +1032,66 @@ func TestGetPaylink_Success(t *testing.T) {
 	})
 }
 
+func TestGetPaylink_Stored(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link that was created through this service")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+	require.Equal(t, http.StatusCreated, response.status)
+
+	docs.When("when they attempt to get the payment link")
+	response = tstPerformGet("/api/rest/v1/paylinks/101", token)
+
+	docs.Then("then the request is successful and the response includes the locally stored fields")
+	tstRequirePaymentLinkResponse(t, response, http.StatusOK, tstBuildValidPaymentLink())
+}
+
+func TestGetPaylink_PartiallyRefunded(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link whose payment has been partially refunded")
+	concardisMock.ManipulateTransactions(42, "partially-refunded", 100)
+
+	docs.When("when they attempt to get the payment link")
+	response := tstPerformGet("/api/rest/v1/paylinks/42", token)
+
+	docs.Then("then the request is successful and the refund is reflected in the amount paid and the status")
+	expected := tstBuildValidPaymentLinkGetResponse()
+	expected.AmountPaid = 290
+	expected.Status = "partially-refunded"
+	expected.Transactions[0].Status = "partially-refunded"
+	tstRequirePaymentLinkResponse(t, response, http.StatusOK, expected)
+}
+
+func TestGetPaylink_Pending(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link whose payment is still in progress")
+	concardisMock.ManipulateTransactions(42, "authorized", 0)
+
+	docs.When("when they attempt to get the payment link")
+	response := tstPerformGet("/api/rest/v1/paylinks/42", token)
+
+	docs.Then("then the request is successful and nothing is reported as paid yet")
+	expected := tstBuildValidPaymentLinkGetResponse()
+	expected.AmountPaid = 0
+	expected.Status = "pending"
+	expected.Transactions[0].Status = "authorized"
+	tstRequirePaymentLinkResponse(t, response, http.StatusOK, expected)
+}
+
 func TestGetPaylink_InvalidId(t *testing.T) {
 	tstSetup(tstConfigFile)
 	defer tstShutdown()
@@ -387,6 +1240,28 @@ func TestDeletePaylink_Success(t *testing.T) {
 	})
 }
 
+func TestDeletePaylink_Stored(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and a payment link that was created through this service")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), token)
+	require.Equal(t, http.StatusCreated, response.status)
+
+	docs.When("when they attempt to delete the payment link")
+	response = tstPerformDelete("/api/rest/v1/paylinks/101", token)
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusNoContent, response.status)
+
+	docs.Then("and the locally stored payment link has been removed")
+	_, err := database.GetRepository().GetPaylinkByApiId(context.Background(), 101)
+	require.ErrorIs(t, err, dbrepo.PaylinkNotFoundError)
+}
+
 func TestDeletePaylink_InvalidId(t *testing.T) {
 	tstSetup(tstConfigFile)
 	defer tstShutdown()
@@ -503,3 +1378,382 @@ func TestDeletePaylink_DownstreamError(t *testing.T) {
 		Details:     "downstream unavailable - see log for details",
 	})
 }
+
+// --- refund ---
+
+func TestRefundPaylink_Success(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a paylink with a confirmed payment, which the payment service knows about")
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Status:    paymentservice.Valid,
+	})
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to refund the payment link")
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", "", token)
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusNoContent, response.status)
+	require.Equal(t, "", response.body)
+
+	docs.Then("and the expected requests to the payment provider have been made")
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+		"RefundTransaction 4711 390",
+	)
+
+	docs.Then("and a matching negative transaction has been booked in the payment service")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			DebitorID: 1,
+			Type:      paymentservice.Payment,
+			Method:    paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: -390,
+			},
+			Comment:       "CC refund orderId d3adb33f",
+			Status:        paymentservice.Valid,
+			EffectiveDate: "2022-12-16",
+			DueDate:       "2022-12-16",
+		},
+	})
+
+	docs.Then("and no error notification emails have been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "refund-pay-link",
+		Details:     "transaction id=4711 status=refunded amount=390 refunded=390 reason=",
+	})
+}
+
+func TestRefundPaylink_AlreadyRefunded(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a paylink whose payment has already been refunded")
+	token := tstValidApiToken()
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", "", token)
+	require.Equal(t, http.StatusNoContent, response.status)
+	concardisMock.Reset()
+	paymentMock.Reset()
+
+	docs.When("when a caller who supplies a correct api token attempts to refund it again")
+	response = tstPerformPost("/api/rest/v1/paylinks/42/refund", "", token)
+
+	docs.Then("then the request fails with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusConflict, "paylink.refund.conflict", "paylink has no confirmed payments that could be refunded")
+
+	docs.Then("and no refund request has been made to the payment provider")
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+	)
+
+	docs.Then("and no requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, nil)
+}
+
+func TestRefundPaylink_Partial(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a paylink with a confirmed payment, which the payment service knows about")
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Status:    paymentservice.Valid,
+	})
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to refund part of the payment, giving a reason")
+	requestBody := cncrdapi.PaymentLinkRefundRequestDto{
+		Amount: 150,
+		Reason: "dropped sponsor upgrade",
+	}
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusNoContent, response.status)
+
+	docs.Then("and the expected requests to the payment provider have been made")
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+		"RefundTransaction 4711 150",
+	)
+
+	docs.Then("and a matching negative transaction including the reason has been booked in the payment service")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			DebitorID: 1,
+			Type:      paymentservice.Payment,
+			Method:    paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: -150,
+			},
+			Comment:       "CC refund orderId d3adb33f - dropped sponsor upgrade",
+			Status:        paymentservice.Valid,
+			EffectiveDate: "2022-12-16",
+			DueDate:       "2022-12-16",
+		},
+	})
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "refund-pay-link",
+		Details:     "transaction id=4711 status=partially-refunded amount=150 refunded=150 reason=dropped sponsor upgrade",
+	})
+
+	docs.When("when they then attempt to refund more than what is left, even though the payment provider does not report the earlier refund")
+	concardisMock.Reset()
+	concardisMock.ManipulateTransactions(42, "partially-refunded", 0)
+	paymentMock.Reset()
+	requestBody.Amount = 241
+	response = tstPerformPost("/api/rest/v1/paylinks/42/refund", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request fails with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusConflict, "paylink.refund.conflict", "refund amount exceeds the confirmed amount not yet refunded")
+
+	docs.Then("and no refund request has been made to the payment provider")
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+	)
+
+	docs.Then("and no requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, nil)
+
+	docs.When("when they then refund exactly what is left")
+	concardisMock.Reset()
+	requestBody.Amount = 240
+	response = tstPerformPost("/api/rest/v1/paylinks/42/refund", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusNoContent, response.status)
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+		"RefundTransaction 4711 240",
+	)
+}
+
+func TestRefundPaylink_Concurrent(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a paylink with a confirmed payment, which the payment service knows about")
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Status:    paymentservice.Valid,
+	})
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.Given("and the payment provider is slow to respond")
+	concardisMock.SimulateLatency(50 * time.Millisecond)
+
+	docs.When("when they send two partial refunds at the same time, which together exceed the payment")
+	requestBody := tstRenderJson(cncrdapi.PaymentLinkRefundRequestDto{
+		Amount: 200,
+	})
+	responses := make([]tstWebResponse, 2)
+	var wg sync.WaitGroup
+	for n := range responses {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			responses[n] = tstPerformPost("/api/rest/v1/paylinks/42/refund", requestBody, token)
+		}(n)
+	}
+	wg.Wait()
+
+	docs.Then("then exactly one of them is successful, and the other one is rejected")
+	statuses := []int{responses[0].status, responses[1].status}
+	require.ElementsMatch(t, []int{http.StatusNoContent, http.StatusConflict}, statuses)
+
+	docs.Then("and only one refund request has been made to the payment provider")
+	require.Contains(t, concardisMock.Recording(), "RefundTransaction 4711 200")
+	require.Equal(t, 3, len(concardisMock.Recording()))
+
+	docs.Then("and only one negative transaction has been booked in the payment service")
+	require.Equal(t, 1, len(paymentMock.Recording()))
+}
+
+func TestRefundPaylink_InvalidData(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to refund a payment link but supply invalid field values")
+	requestBody := cncrdapi.PaymentLinkRefundRequestDto{
+		Amount: -53,
+	}
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", tstRenderJson(requestBody), token)
+
+	docs.Then("then the request is denied with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "paylink.data.invalid", url.Values{
+		"amount": []string{"must be a positive integer (the amount to refund in cents), or 0 or missing to refund everything"},
+	})
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
+
+	docs.Then("and no protocol entries have been written")
+	tstRequireProtocolEntries(t)
+}
+
+func TestRefundPaylink_InvalidId(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to refund a payment link but supply an invalid id")
+	response := tstPerformPost("/api/rest/v1/paylinks/%2f%4c/refund", "", token)
+
+	docs.Then("then the request fails with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusBadRequest, "paylink.id.invalid", nil)
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
+
+	docs.Then("and no protocol entries have been written")
+	tstRequireProtocolEntries(t)
+}
+
+func TestRefundPaylink_NotFound(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to refund a payment link but supply an id that does not exist")
+	response := tstPerformPost("/api/rest/v1/paylinks/13/refund", "", token)
+
+	docs.Then("then the request fails with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusNotFound, "paylink.id.notfound", nil)
+
+	docs.Then("and the expected request for a payment link has been made")
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 13",
+	)
+
+	docs.Then("and no requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, nil)
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "",
+		ApiId:       13,
+		Kind:        "error",
+		Message:     "refund-pay-link failed",
+		Details:     "payment link id not found",
+	})
+}
+
+func TestRefundPaylink_Anonymous(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an unauthenticated caller")
+	token := tstNoToken()
+
+	docs.When("when they attempt to refund a payment link")
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", "", token)
+
+	docs.Then("then the request is denied as unauthenticated (401) with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "you must be logged in for this operation")
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
+
+	docs.Then("and no protocol entries have been written")
+	tstRequireProtocolEntries(t)
+}
+
+func TestRefundPaylink_DownstreamError(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they attempt to refund a payment link while the paylink api is down")
+	concardisMock.SimulateError(concardis.DownstreamError)
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", "", token)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadGateway, "paylink.downstream.error", nil)
+
+	docs.Then("and no requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, nil)
+
+	docs.Then("and the expected email notifications have been sent")
+	expNotif := tstExpectedMailNotification("refund-pay-link", "downstream unavailable - see log for details")
+	expNotif.Variables["referenceId"] = "paylink id 42"
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{expNotif})
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "",
+		ApiId:       42,
+		Kind:        "error",
+		Message:     "refund-pay-link failed",
+		Details:     "downstream unavailable - see log for details",
+	})
+}
+
+// --- helpers ---
+
+func tstInjectTentativeTransaction(grossCent int64, currency string, vatRate float64) {
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Type:      paymentservice.Payment,
+		Status:    paymentservice.Tentative,
+		Amount: paymentservice.Amount{
+			Currency:  currency,
+			GrossCent: grossCent,
+			VatRate:   vatRate,
+		},
+	})
+}
+
+// tstCreatePaylinks creates paylinks 101 (debitor 1), 102 (debitor 2), and 103 (debitor 1)
+func tstCreatePaylinks(t *testing.T, token string) {
+	for n, debitorId := range []uint64{1, 2, 1} {
+		request := tstBuildValidPaymentLinkRequest()
+		request.ReferenceId = fmt.Sprintf("221216-122218-%06d", n+1)
+		request.DebitorId = debitorId
+		response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(request), token)
+		require.Equal(t, http.StatusCreated, response.status)
+	}
+}
+
+func tstRequirePaymentLinkListResponse(t *testing.T, response tstWebResponse, expectedCount int) cncrdapi.PaymentLinkListDto {
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	actual := cncrdapi.PaymentLinkListDto{}
+	tstParseJson(response.body, &actual)
+	require.Equal(t, expectedCount, len(actual.Paylinks))
+	return actual
+}
@@ -0,0 +1,421 @@
+package acceptance
+
+import (
+	"context"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/docs"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/mailservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/paymentservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/service/paymentlinksrv"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReplay_Success(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment provider has transactions in various states, inside and outside the time window")
+	tstInjectReplayTransactions()
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they request a replay of the last day")
+	response := tstPerformPost("/api/rest/v1/transactions/replay?days=1", "", token)
+
+	docs.Then("then the request is successful and the response contains one entry per confirmed paylink in the window")
+	tstRequireReplayResponse(t, response, cncrdapi.TransactionReplayDto{
+		Results: []cncrdapi.TransactionReplayResultDto{
+			{
+				ReferenceId: "221216-122218-000001",
+				PaylinkId:   42,
+				Outcome:     "updated",
+			},
+			{
+				ReferenceId: "230001-122218-000001",
+				PaylinkId:   4242,
+				Outcome:     "skipped",
+				Details:     "ref-id-prefix",
+			},
+		},
+	})
+
+	docs.Then("and the expected downstream requests have been made to the concardis api")
+	tstRequireConcardisRecording(t,
+		"QueryTransactions 2022-12-15 12:22:18 < t < 2022-12-16 12:22:18",
+		"QueryPaymentLink 42",
+		"QueryPaymentLink 4242",
+	)
+
+	docs.Then("and the expected requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			ID:     "mock-transaction-id",
+			Method: paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: 390,
+			},
+			Status:        "valid",
+			EffectiveDate: "2022-12-16",
+			Comment:       "CC orderId d3adb33f brand visa",
+		},
+	})
+
+	docs.Then("and no error notification emails have been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, tstBookingProtocol(paymentservice.Valid, paymentlinksrv.BookingUpdated), entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "replay",
+		Message:     "replay updated",
+		Details:     "",
+	}, entity.ProtocolEntry{
+		ReferenceId: "230001-122218-000001",
+		ApiId:       4242,
+		Kind:        "replay",
+		Message:     "replay skipped",
+		Details:     "ref-id-prefix",
+	})
+}
+
+func TestReplay_AlreadyValid(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment provider has a confirmed transaction in the time window")
+	tstInjectReplayTransactions()
+
+	docs.Given("and the payment service already has the transaction in status valid")
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Status:    paymentservice.Valid,
+	})
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they request a replay of the last day")
+	response := tstPerformPost("/api/rest/v1/transactions/replay?days=1", "", token)
+
+	docs.Then("then the request is successful and the transaction is reported as skipped")
+	tstRequireReplayResponse(t, response, cncrdapi.TransactionReplayDto{
+		Results: []cncrdapi.TransactionReplayResultDto{
+			{
+				ReferenceId: "221216-122218-000001",
+				PaylinkId:   42,
+				Outcome:     "skipped",
+				Details:     "already valid",
+			},
+			{
+				ReferenceId: "230001-122218-000001",
+				PaylinkId:   4242,
+				Outcome:     "skipped",
+				Details:     "ref-id-prefix",
+			},
+		},
+	})
+
+	docs.Then("and no requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, nil)
+
+	docs.Then("and no error notification emails have been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+}
+
+func TestReplay_MissingInPaymentService(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment provider has a confirmed transaction in the time window")
+	tstInjectReplayTransactions()
+
+	docs.Given("and the payment service does not know the reference id")
+	paymentMock.SimulateGetError(paymentservice.NotFoundError)
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they request a replay of the last day")
+	response := tstPerformPost("/api/rest/v1/transactions/replay?days=1", "", token)
+
+	docs.Then("then the request is successful and the transaction is reported as created")
+	tstRequireReplayResponse(t, response, cncrdapi.TransactionReplayDto{
+		Results: []cncrdapi.TransactionReplayResultDto{
+			{
+				ReferenceId: "221216-122218-000001",
+				PaylinkId:   42,
+				Outcome:     "created",
+			},
+			{
+				ReferenceId: "230001-122218-000001",
+				PaylinkId:   4242,
+				Outcome:     "skipped",
+				Details:     "ref-id-prefix",
+			},
+		},
+	})
+
+	docs.Then("and the expected requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			ID:        "221216-122218-000001",
+			DebitorID: 1,
+			Type:      paymentservice.Payment,
+			Method:    paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: 390,
+			},
+			Comment:       "CC orderId d3adb33f brand visa (auto created)",
+			Status:        paymentservice.Pending,
+			EffectiveDate: "2022-12-16",
+			DueDate:       "2022-12-16",
+		},
+	})
+
+	docs.Then("and no error notification emails have been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+}
+
+func TestReplay_MissingInPaymentService_UnparsableDebitor(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment provider has a confirmed transaction in the time window")
+	tstInjectReplayTransactions()
+
+	docs.Given("and a reference id pattern whose debitor group does not capture a number")
+	config.SetTestingReferenceIdPattern(`(?P<debitor>221216-\d{6})-\d+`)
+
+	docs.Given("and the payment service does not know the reference id")
+	paymentMock.SimulateGetError(paymentservice.NotFoundError)
+
+	docs.Given("and a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they request a replay of the last day")
+	response := tstPerformPost("/api/rest/v1/transactions/replay?days=1", "", token)
+
+	docs.Then("then the request is successful and the transaction is reported as created")
+	tstRequireReplayResponse(t, response, cncrdapi.TransactionReplayDto{
+		Results: []cncrdapi.TransactionReplayResultDto{
+			{
+				ReferenceId: "221216-122218-000001",
+				PaylinkId:   42,
+				Outcome:     "created",
+			},
+			{
+				ReferenceId: "230001-122218-000001",
+				PaylinkId:   4242,
+				Outcome:     "skipped",
+				Details:     "ref-id-prefix",
+			},
+		},
+	})
+
+	docs.Then("and the expected requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			ID:     "221216-122218-000001",
+			Type:   paymentservice.Payment,
+			Method: paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: 390,
+			},
+			Comment:       "CC orderId d3adb33f brand visa (auto created)",
+			Status:        paymentservice.Pending,
+			EffectiveDate: "2022-12-16",
+			DueDate:       "2022-12-16",
+		},
+	})
+
+	docs.Then("and the reason has been protocolled")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "error",
+		Message:     "webhook parse-refid-err",
+		Details:     "debitor group '221216-122218' of reference_id 221216-122218-000001 is not a valid debitor id",
+	}, tstBookingProtocol(paymentservice.Valid, paymentlinksrv.BookingCreated), entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "replay",
+		Message:     "replay created",
+		Details:     "",
+	}, entity.ProtocolEntry{
+		ReferenceId: "230001-122218-000001",
+		ApiId:       4242,
+		Kind:        "replay",
+		Message:     "replay skipped",
+		Details:     "ref-id-prefix",
+	})
+
+	docs.Then("and the expected error notification emails have been sent")
+	expNotif := tstExpectedMailNotification("webhook", "parse-refid-err")
+	expNotif.Variables["referenceId"] = "refId: 221216-122218-000001"
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{expNotif})
+}
+
+func TestReplay_TimeBudgetExceeded(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment provider has transactions in various states, inside and outside the time window")
+	tstInjectReplayTransactions()
+
+	docs.Given("and processing each paylink takes longer than half the server write timeout")
+	tstSetupSlowClock(2 * time.Second)
+
+	docs.When("when a caller who supplies a correct api token requests a replay of the last day")
+	response := tstPerformPost("/api/rest/v1/transactions/replay?days=1", "", tstValidApiToken())
+
+	docs.Then("then the request is successful, but the replay stopped after the first paylink and says so")
+	tstRequireReplayResponse(t, response, cncrdapi.TransactionReplayDto{
+		Results: []cncrdapi.TransactionReplayResultDto{
+			{
+				ReferenceId: "221216-122218-000001",
+				PaylinkId:   42,
+				Outcome:     "updated",
+			},
+		},
+		Incomplete: true,
+	})
+
+	docs.Then("and the remaining paylinks have not been queried")
+	tstRequireConcardisRecording(t,
+		"QueryTransactions 2022-12-15 12:22:18 < t < 2022-12-16 12:22:18",
+		"QueryPaymentLink 42",
+	)
+}
+
+func TestReplay_InvalidDays(t *testing.T) {
+	for _, days := range []string{"0", "-1", "91", "kitty"} {
+		t.Run("Days_"+days, func(t *testing.T) {
+			tstSetup(tstConfigFile)
+			defer tstShutdown()
+
+			docs.Given("given a caller who supplies a correct api token")
+			token := tstValidApiToken()
+
+			docs.When("when they request a replay but supply an invalid number of days")
+			response := tstPerformPost("/api/rest/v1/transactions/replay?days="+days, "", token)
+
+			docs.Then("then the request fails with the appropriate error message")
+			tstRequireErrorResponse(t, response, http.StatusBadRequest, "replay.days.invalid", url.Values{
+				"details": []string{"days must be an integer between 1 and 90"},
+			})
+
+			docs.Then("and no requests to the payment provider have been made")
+			require.Empty(t, concardisMock.Recording())
+		})
+	}
+}
+
+func TestReplay_Anonymous(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given an unauthenticated caller")
+	token := tstNoToken()
+
+	docs.When("when they request a replay")
+	response := tstPerformPost("/api/rest/v1/transactions/replay?days=1", "", token)
+
+	docs.Then("then the request is denied as unauthenticated (401) with the appropriate error message")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", "you must be logged in for this operation")
+
+	docs.Then("and no requests to the payment provider have been made")
+	require.Empty(t, concardisMock.Recording())
+}
+
+func TestReplay_DownstreamError(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a caller who supplies a correct api token")
+	token := tstValidApiToken()
+
+	docs.When("when they request a replay while the paylink api is down")
+	concardisMock.SimulateError(concardis.DownstreamError)
+	response := tstPerformPost("/api/rest/v1/transactions/replay?days=3", "", token)
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusBadGateway, "paylink.downstream.error", nil)
+
+	docs.Then("and the expected email notifications have been sent")
+	expNotif := tstExpectedMailNotification("replay", "api-error")
+	expNotif.Variables["referenceId"] = "last 3 days"
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{expNotif})
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "",
+		ApiId:       0,
+		Kind:        "error",
+		Message:     "replay query-transactions failed",
+		Details:     "downstream unavailable - see log for details",
+	})
+}
+
+// --- helpers ---
+
+func tstInjectReplayTransactions() {
+	// older than the replay window
+	concardisMock.InjectTransaction(tstBuildReplayTransaction("221216-122218-000001", 42, "confirmed", "2022-12-14 10:00:00", "0ld0ld00"))
+	// irrelevant status
+	concardisMock.InjectTransaction(tstBuildReplayTransaction("221216-122218-000001", 42, "declined", "2022-12-16 09:58:00", "dec11ned"))
+	// the relevant one
+	concardisMock.InjectTransaction(tstBuildReplayTransaction("221216-122218-000001", 42, "confirmed", "2022-12-16 10:00:00", "d3adb33f"))
+	// wrong prefix
+	concardisMock.InjectTransaction(tstBuildReplayTransaction("230001-122218-000001", 4242, "confirmed", "2022-12-16 11:00:00", "0ther0ne"))
+}
+
+func tstBuildReplayTransaction(referenceId string, paylinkId uint, status string, txTime string, uuid string) concardis.TransactionData {
+	return concardis.TransactionData{
+		UUID:        uuid,
+		Amount:      390,
+		Status:      status,
+		Time:        txTime,
+		Payment:     concardis.Payment{Brand: "visa"},
+		Psp:         "ConCardis_PayEngine_3",
+		Mode:        "TEST",
+		ReferenceID: referenceId,
+		Invoice: concardis.Invoice{
+			ReferenceID:      referenceId,
+			PaymentRequestId: paylinkId,
+			Currency:         "EUR",
+			OriginalAmount:   390,
+		},
+	}
+}
+
+// tstSetupSlowClock restarts the test server with a clock that advances by step every time it is read.
+func tstSetupSlowClock(step time.Duration) {
+	ts.Close()
+	now := tstMockNow()
+	paymentlinksrv.NowFunc = func() time.Time {
+		current := now
+		now = now.Add(step)
+		return current
+	}
+	tstSetupHttpTestServer()
+}
+
+func tstRequireReplayResponse(t *testing.T, response tstWebResponse, expectedBody cncrdapi.TransactionReplayDto) {
+	require.Equal(t, http.StatusOK, response.status, "unexpected http response status")
+	actualBody := cncrdapi.TransactionReplayDto{}
+	tstParseJson(response.body, &actualBody)
+	require.EqualValues(t, expectedBody, actualBody)
+}
@@ -8,6 +8,10 @@ func tstValidApiToken() string {
 	return "put_secure_random_string_here_for_api_token_test_token"
 }
 
+func tstValidAdminToken() string {
+	return "put_secure_random_string_here_for_admin_token_test_token"
+}
+
 func tstInvalidApiToken() string {
 	return "invalid_put_secure_random_string_here_for_api_token_test_token"
 }
@@ -1,7 +1,9 @@
 package acceptance
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database/inmemorydb"
@@ -86,6 +88,23 @@ func tstPerformPost(relativeUrlWithLeadingSlash string, requestBody string, apiT
 	return tstWebResponseFromResponse(response)
 }
 
+func tstPerformPostWithHeader(relativeUrlWithLeadingSlash string, requestBody string, headerName string, headerValue string, apiToken string) tstWebResponse {
+	request, err := http.NewRequest(http.MethodPost, ts.URL+relativeUrlWithLeadingSlash, strings.NewReader(requestBody))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if apiToken != "" {
+		request.Header.Set(media.HeaderXApiKey, apiToken)
+	}
+	request.Header.Set(headerName, headerValue)
+	request.Header.Set(headers.ContentType, media.ContentTypeApplicationJson)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tstWebResponseFromResponse(response)
+}
+
 func tstPerformDelete(relativeUrlWithLeadingSlash string, apiToken string) tstWebResponse {
 	request, err := http.NewRequest(http.MethodDelete, ts.URL+relativeUrlWithLeadingSlash, nil)
 	if err != nil {
@@ -186,6 +205,23 @@ func tstBuildValidPaymentLink() cncrdapi.PaymentLinkDto {
 		Currency:    "EUR",
 		VatRate:     19.0,
 		Link:        "http://localhost:1111/some/paylink/101",
+		Status:      "open",
+	}
+}
+
+func tstBuildValidStoredPaylink() entity.Paylink {
+	return entity.Paylink{
+		ApiId:       101,
+		ReferenceId: "221216-122218-000001",
+		DebitorId:   1,
+		Title:       "some page title",
+		Description: "some page description",
+		Purpose:     "some payment purpose",
+		AmountDue:   390,
+		Currency:    "EUR",
+		VatRate:     19.0,
+		Link:        "http://localhost:1111/some/paylink/101",
+		Status:      "waiting",
 	}
 }
 
@@ -194,9 +230,18 @@ func tstBuildValidPaymentLinkGetResponse() cncrdapi.PaymentLinkDto {
 		ReferenceId: "221216-122218-000001",
 		Purpose:     "some payment purpose",
 		AmountDue:   390,
-		AmountPaid:  0,
+		AmountPaid:  390,
 		Currency:    "EUR",
 		Link:        "http://localhost:1111/some/paylink/42",
+		Status:      "paid",
+		Transactions: []cncrdapi.PaymentLinkTransactionDto{
+			{
+				Uuid:   "d3adb33f",
+				Time:   "2023-01-08 12:22:58",
+				Amount: 390,
+				Status: "confirmed",
+			},
+		},
 	}
 }
 
@@ -223,6 +268,16 @@ func tstBuildValidWebhookRequest() string {
 `
 }
 
+// tstBuildWebhookRequest builds a webhook body that reports the given status, so repeated deliveries can be told apart
+func tstBuildWebhookRequest(status string, refundedAmount int64) string {
+	return fmt.Sprintf(`{"transaction":{"id":1892362736,"status":"%s","invoice":{"paymentRequestId":42,"referenceId":"221216-122218-000001","refundedAmount":%d}}}`, status, refundedAmount)
+}
+
+// tstBuildWebhookRequestFor builds a webhook body for a specific transaction of a specific paylink
+func tstBuildWebhookRequestFor(transactionId int64, paylinkId uint, referenceId string, status string) string {
+	return fmt.Sprintf(`{"transaction":{"id":%d,"status":"%s","invoice":{"paymentRequestId":%d,"referenceId":"%s"}}}`, transactionId, status, paylinkId, referenceId)
+}
+
 func tstExpectedMailNotification(operation string, status string) mailservice.MailSendDto {
 	return mailservice.MailSendDto{
 		CommonID: "payment-cncrd-adapter-error",
@@ -238,6 +293,13 @@ func tstExpectedMailNotification(operation string, status string) mailservice.Ma
 	}
 }
 
+func tstRequireStoredPaylink(t *testing.T, apiId uint, expected entity.Paylink) {
+	actual, err := database.GetRepository().GetPaylinkByApiId(context.Background(), apiId)
+	require.Nil(t, err)
+	expected.Model = actual.Model
+	require.EqualValues(t, expected, *actual)
+}
+
 func tstRequireProtocolEntries(t *testing.T, expectedProtocol ...entity.ProtocolEntry) {
 	db := database.GetRepository().(*inmemorydb.InMemoryRepository)
 	actualProtocol := db.ProtocolEntries()
@@ -251,3 +313,24 @@ func tstRequireProtocolEntries(t *testing.T, expectedProtocol ...entity.Protocol
 		require.Equal(t, expected.Details, actual.Details)
 	}
 }
+
+func tstRequireProtocolEntriesContain(t *testing.T, expected entity.ProtocolEntry) {
+	db := database.GetRepository().(*inmemorydb.InMemoryRepository)
+	for _, actual := range db.ProtocolEntries() {
+		if actual.ReferenceId == expected.ReferenceId && actual.ApiId == expected.ApiId && actual.Kind == expected.Kind &&
+			actual.Message == expected.Message && actual.Details == expected.Details {
+			return
+		}
+	}
+	require.Fail(t, "protocol entry not found", "%+v", expected)
+}
+
+func tstCountConcardisRecording(prefix string) int {
+	count := 0
+	for _, entry := range concardisMock.Recording() {
+		if strings.HasPrefix(entry, prefix) {
+			count++
+		}
+	}
+	return count
+}
@@ -1,12 +1,17 @@
 package acceptance
 
 import (
+	"context"
 	"fmt"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/docs"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/api/v1/cncrdapi"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/entity"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/concardis"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/config"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/mailservice"
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/paymentservice"
+	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/service/paymentlinksrv"
 	"github.com/stretchr/testify/require"
 	"net/http"
 	"testing"
@@ -32,13 +37,14 @@ func TestWebhook_Success_TolerantReader(t *testing.T) {
 		Kind:        "success",
 		Message:     "webhook query-pay-link",
 		Details:     "status=confirmed amount=390",
-	})
+	}, tstBookingProtocol(paymentservice.Valid, paymentlinksrv.BookingUpdated))
 }
 
 func TestWebhook_Success_Status_Confirmed(t *testing.T) {
 	tstWebhookSuccessCase(t, "confirmed", []paymentservice.Transaction{
 		{
-			ID: "mock-transaction-id",
+			ID:     "mock-transaction-id",
+			Method: paymentservice.Credit,
 			Amount: paymentservice.Amount{
 				Currency:  "EUR",
 				GrossCent: 390,
@@ -55,6 +61,7 @@ func TestWebhook_Success_Status_Confirmed(t *testing.T) {
 			Message:     "webhook query-pay-link",
 			Details:     "status=confirmed amount=390",
 		},
+		tstBookingProtocol(paymentservice.Valid, paymentlinksrv.BookingUpdated),
 	})
 }
 
@@ -76,7 +83,7 @@ func TestWebhook_Success_Status_Ignored(t *testing.T) {
 }
 
 func TestWebhook_Success_Status_NotifyMail(t *testing.T) {
-	for _, status := range []string{"waiting", "authorized", "refunded", "partially-refunded", "refund_pending", "chargeback", "error", "uncaptured", "reserved"} {
+	for _, status := range []string{"refunded", "partially-refunded", "refund_pending", "chargeback", "error"} {
 		testname := fmt.Sprintf("Status_%s", status)
 		t.Run(testname, func(t *testing.T) {
 			tstWebhookSuccessCase(t, status, []paymentservice.Transaction{}, []mailservice.MailSendDto{
@@ -94,6 +101,832 @@ func TestWebhook_Success_Status_NotifyMail(t *testing.T) {
 	}
 }
 
+func TestWebhook_Success_Status_Pending(t *testing.T) {
+	for _, status := range []string{"waiting", "authorized", "uncaptured", "reserved"} {
+		testname := fmt.Sprintf("Status_%s", status)
+		t.Run(testname, func(t *testing.T) {
+			tstWebhookSuccessCase(t, status, []paymentservice.Transaction{
+				tstExpectedPendingTransaction(status),
+			}, []mailservice.MailSendDto{}, []entity.ProtocolEntry{
+				{
+					ReferenceId: "221216-122218-000001",
+					ApiId:       42,
+					Kind:        "success",
+					Message:     "webhook query-pay-link",
+					Details:     fmt.Sprintf("status=%s amount=390", status),
+				},
+				tstBookingProtocol(paymentservice.Pending, paymentlinksrv.BookingUpdated),
+			})
+		})
+	}
+}
+
+func TestWebhook_DeclinedAttemptOnWaitingPaylink(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a paylink that is still waiting after a declined payment attempt")
+	concardisMock.ManipulateStatus(42, "waiting")
+
+	docs.When("when the webhook is triggered for the declined transaction")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("declined", 0), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and nothing has been booked in the payment service")
+	tstRequirePaymentServiceRecording(t, nil)
+
+	docs.Then("and no error notification emails have been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+}
+
+func TestWebhook_Success_PendingThenConfirmed(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment service has a tentative transaction for the paylink")
+	tentative := paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Status:    paymentservice.Tentative,
+	}
+	_ = paymentMock.InjectTransaction(context.Background(), tentative)
+
+	docs.Given("and the webhook has reported a pre-authorized payment")
+	concardisMock.ManipulateStatus(42, "authorized")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("authorized", 0), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Given("and the payment has since been confirmed")
+	concardisMock.ManipulateStatus(42, "confirmed")
+
+	docs.When("when the webhook is triggered again for the new status")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the transaction was first moved to pending, then promoted to valid")
+	pending := tstExpectedPendingTransaction("authorized")
+	pending.ID = tentative.ID
+	pending.DebitorID = tentative.DebitorID
+	valid := pending
+	valid.Status = paymentservice.Valid
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{pending, valid})
+
+	docs.Then("and no error notification emails have been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+}
+
+func TestWebhook_Success_PaymentMethod(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service maps paypal payments and sepa transfers to their payment methods")
+	config.Configuration().Service.PaymentMethods = map[string]string{
+		"paypal":      "paypal",
+		"sepa_direct": "transfer",
+	}
+
+	docs.Given("and the payment service has a tentative transaction for the paylink")
+	tentative := paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Method:    paymentservice.Credit,
+		Status:    paymentservice.Tentative,
+	}
+	_ = paymentMock.InjectTransaction(context.Background(), tentative)
+
+	docs.Given("and the attendee has started to pay with paypal")
+	concardisMock.ManipulateStatus(42, "authorized")
+	concardisMock.ManipulatePayment(42, "PayPal", "PayPal_1")
+
+	docs.When("when the webhook is triggered")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("authorized", 0), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the transaction was booked with the mapped payment method, recording the brand")
+	pending := tstExpectedPendingTransaction("authorized")
+	pending.ID = tentative.ID
+	pending.DebitorID = tentative.DebitorID
+	pending.Method = paymentservice.Paypal
+	pending.Comment = "CC orderId d3adb33f brand PayPal"
+	pending.StatusHistory[0].Comment = "Concardis status authorized brand PayPal"
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{pending})
+}
+
+func TestWebhook_Success_MultipleAttempts(t *testing.T) {
+	for _, txId := range []int64{4714, 4713} {
+		testname := fmt.Sprintf("Transaction_%d", txId)
+		t.Run(testname, func(t *testing.T) {
+			tstSetup(tstConfigFile)
+			defer tstShutdown()
+
+			docs.Given("given the payment provider has a paylink with a declined attempt followed by a confirmed one")
+
+			docs.When("when the webhook is triggered for one of the transactions")
+			response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(txId, 43, "221216-122218-000002", "confirmed"), tstNoToken())
+
+			docs.Then("then the request is successful")
+			require.Equal(t, http.StatusOK, response.status)
+
+			docs.Then("and the confirmed transaction was booked, not the declined attempt")
+			tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+				{
+					ID:     "mock-transaction-id",
+					Method: paymentservice.Credit,
+					Amount: paymentservice.Amount{
+						Currency:  "EUR",
+						GrossCent: 390,
+					},
+					Status:        paymentservice.Valid,
+					EffectiveDate: "2023-01-09",
+					Comment:       "CC orderId c0ffee",
+				},
+			})
+		})
+	}
+}
+
+func TestWebhook_Success_PartialPayments(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment service has a tentative transaction for the paylink")
+	tentative := paymentservice.Transaction{
+		ID:        "221216-122218-000003",
+		DebitorID: 1,
+		Status:    paymentservice.Tentative,
+	}
+	_ = paymentMock.InjectTransaction(context.Background(), tentative)
+
+	docs.Given("and the attendee has paid the first part of the amount due")
+	concardisMock.ManipulateTransaction(44, 4716, "waiting")
+
+	docs.When("when the webhook is triggered for the first payment")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(4715, 44, "221216-122218-000003", "confirmed"), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.When("and the attendee pays the rest, and the webhook is triggered for the second payment")
+	concardisMock.ManipulateTransaction(44, 4716, "confirmed")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(4716, 44, "221216-122218-000003", "confirmed"), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.When("and the webhook is triggered again for the first payment, e.g. by a back office status change")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(4715, 44, "221216-122218-000003", "Confirmed"), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("then each payment was booked exactly once")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			ID:        "221216-122218-000003",
+			DebitorID: 1,
+			Method:    paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: 200,
+			},
+			Status:        paymentservice.Valid,
+			EffectiveDate: "2023-01-08",
+			Comment:       "CC orderId ba5eba11",
+		},
+		{
+			DebitorID: 1,
+			Type:      paymentservice.Payment,
+			Method:    paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: 190,
+			},
+			Status:        paymentservice.Valid,
+			EffectiveDate: "2023-01-10",
+			DueDate:       "2023-01-10",
+			Comment:       "CC orderId f00dfeed (additional payment)",
+		},
+	})
+
+	docs.Then("and the bookings have been recorded for the paylink")
+	bookings, err := database.GetRepository().FindPaymentBookings(context.Background(), "221216-122218-000003")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(bookings))
+	for n, expectedTxId := range []int64{4715, 4716} {
+		require.Equal(t, uint(44), bookings[n].ApiId)
+		require.Equal(t, expectedTxId, bookings[n].TransactionId)
+	}
+}
+
+func TestWebhook_AmountMismatch_Book(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service books mismatched amounts as they are (the default)")
+
+	docs.Given("and the locally stored paylink was created for a different amount than was paid")
+	tstInjectStoredPaylink(42, 500)
+
+	docs.When("when the webhook is triggered for the confirmed payment")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the paid amount has been booked as valid")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			ID:     "mock-transaction-id",
+			Method: paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: 390,
+			},
+			Status:        paymentservice.Valid,
+			EffectiveDate: "2023-01-08",
+			Comment:       "CC orderId d3adb33f",
+		},
+	})
+
+	docs.Then("and the mismatch has been alerted")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{
+		tstExpectedMailNotification("webhook", "paid-amount-mismatch"),
+	})
+	tstRequireProtocolEntries(t, append(tstAmountMismatchProtocol("amount mismatch paid=390 EUR paylink due=500 EUR policy=book"),
+		tstBookingProtocol(paymentservice.Valid, paymentlinksrv.BookingUpdated))...)
+}
+
+func TestWebhook_AmountMismatch_Pending(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service books mismatched amounts as pending")
+	config.Configuration().Service.AmountMismatchPolicy = config.AmountMismatchPending
+
+	docs.Given("and the payment service expects a different amount than was paid")
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Amount: paymentservice.Amount{
+			Currency:  "EUR",
+			GrossCent: 500,
+		},
+		Status: paymentservice.Tentative,
+	})
+
+	docs.When("when the webhook is triggered for the confirmed payment")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the paid amount has been booked as pending, with an explanation")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			ID:        "221216-122218-000001",
+			DebitorID: 1,
+			Method:    paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: 390,
+			},
+			Status:        paymentservice.Pending,
+			EffectiveDate: "2023-01-08",
+			Comment:       "CC orderId d3adb33f",
+			StatusHistory: []paymentservice.StatusHistory{
+				{
+					Status:     paymentservice.Pending,
+					Comment:    "Concardis status confirmed - amount mismatch paid=390 EUR payment service due=500 EUR",
+					ChangeDate: tstMockNow(),
+				},
+			},
+		},
+	})
+
+	docs.Then("and the mismatch has been alerted")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{
+		tstExpectedMailNotification("webhook", "paid-amount-mismatch"),
+	})
+	tstRequireProtocolEntries(t, append(tstAmountMismatchProtocol("amount mismatch paid=390 EUR payment service due=500 EUR policy=pending"),
+		tstBookingProtocol(paymentservice.Valid, paymentlinksrv.BookingUpdated))...)
+}
+
+func TestWebhook_AmountMismatch_PendingPartial(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service books mismatched amounts as pending")
+	config.Configuration().Service.AmountMismatchPolicy = config.AmountMismatchPending
+
+	docs.Given("and the attendee has only paid part of the amount due")
+	concardisMock.ManipulateTransaction(44, 4716, "waiting")
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000003",
+		DebitorID: 1,
+		Amount: paymentservice.Amount{
+			Currency:  "EUR",
+			GrossCent: 390,
+		},
+		Status: paymentservice.Tentative,
+	})
+
+	docs.When("when the webhook is triggered for the partial payment")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(4715, 44, "221216-122218-000003", "confirmed"), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the amount actually paid has been booked as pending, not the amount due")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		{
+			ID:        "221216-122218-000003",
+			DebitorID: 1,
+			Method:    paymentservice.Credit,
+			Amount: paymentservice.Amount{
+				Currency:  "EUR",
+				GrossCent: 200,
+			},
+			Status:        paymentservice.Pending,
+			EffectiveDate: "2023-01-08",
+			Comment:       "CC orderId ba5eba11",
+			StatusHistory: []paymentservice.StatusHistory{
+				{
+					Status:     paymentservice.Pending,
+					Comment:    "Concardis status confirmed - amount mismatch paid=200 EUR payment service due=390 EUR",
+					ChangeDate: tstMockNow(),
+				},
+			},
+		},
+	})
+
+	docs.Then("and the mismatch has been alerted")
+	expNotif := tstExpectedMailNotification("webhook", "paid-amount-mismatch")
+	expNotif.Variables["referenceId"] = "221216-122218-000003"
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{expNotif})
+}
+
+func TestWebhook_AmountMismatch_Refuse(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service refuses to book mismatched amounts")
+	config.Configuration().Service.AmountMismatchPolicy = config.AmountMismatchRefuse
+
+	docs.Given("and the paylink was paid in a different currency than expected")
+	tstInjectStoredPaylink(42, 390)
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Amount: paymentservice.Amount{
+			Currency:  "CHF",
+			GrossCent: 390,
+		},
+		Status: paymentservice.Tentative,
+	})
+
+	docs.When("when the webhook is triggered for the confirmed payment")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request is successful, so the payment provider does not retry")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and nothing has been booked")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{})
+
+	docs.Then("and the mismatch has been alerted")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{
+		tstExpectedMailNotification("webhook", "paid-amount-mismatch"),
+	})
+	tstRequireProtocolEntries(t, tstAmountMismatchProtocol("amount mismatch paid=390 EUR payment service due=390 CHF policy=refuse")...)
+}
+
+func TestWebhook_AmountMismatch_OverpaidBySecondTransaction(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service books mismatched amounts as they are (the default)")
+
+	docs.Given("and the locally stored paylink is due the amount of the first payment")
+	stored := tstBuildValidStoredPaylink()
+	stored.ApiId = 44
+	stored.ReferenceId = "221216-122218-000003"
+	stored.AmountDue = 200
+	_ = database.GetRepository().WritePaylink(context.Background(), &stored)
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000003",
+		DebitorID: 1,
+		Status:    paymentservice.Tentative,
+	})
+
+	docs.Given("and the first payment has been booked")
+	concardisMock.ManipulateTransaction(44, 4716, "waiting")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(4715, 44, "221216-122218-000003", "confirmed"), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+	require.Equal(t, 1, len(paymentMock.Recording()))
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+
+	docs.When("when the attendee pays again, and the webhook is triggered for the second payment")
+	concardisMock.ManipulateTransaction(44, 4716, "confirmed")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(4716, 44, "221216-122218-000003", "confirmed"), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the second payment has been booked as valid")
+	recording := paymentMock.Recording()
+	require.Equal(t, 2, len(recording))
+	require.Equal(t, int64(190), recording[1].Amount.GrossCent)
+	require.Equal(t, paymentservice.Valid, recording[1].Status)
+
+	docs.Then("and the overpayment has been alerted")
+	expNotif := tstExpectedMailNotification("webhook", "paid-amount-mismatch")
+	expNotif.Variables["referenceId"] = "221216-122218-000003"
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{expNotif})
+	tstRequireProtocolEntriesContain(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000003",
+		ApiId:       44,
+		Kind:        "mismatch",
+		Message:     "webhook amount-mismatch",
+		Details:     "amount mismatch paid=390 EUR paylink due=200 EUR policy=book",
+	})
+}
+
+func TestWebhook_AmountMismatch_RefuseOverpaidBySecondTransaction(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the service refuses to book mismatched amounts")
+	config.Configuration().Service.AmountMismatchPolicy = config.AmountMismatchRefuse
+
+	docs.Given("and the locally stored paylink is due the amount of the first payment")
+	stored := tstBuildValidStoredPaylink()
+	stored.ApiId = 44
+	stored.ReferenceId = "221216-122218-000003"
+	stored.AmountDue = 200
+	_ = database.GetRepository().WritePaylink(context.Background(), &stored)
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000003",
+		DebitorID: 1,
+		Status:    paymentservice.Tentative,
+	})
+
+	docs.Given("and the first payment has been booked")
+	concardisMock.ManipulateTransaction(44, 4716, "waiting")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(4715, 44, "221216-122218-000003", "confirmed"), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+	require.Equal(t, 1, len(paymentMock.Recording()))
+
+	docs.When("when the attendee pays again, and the webhook is triggered for the second payment")
+	concardisMock.ManipulateTransaction(44, 4716, "confirmed")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequestFor(4716, 44, "221216-122218-000003", "confirmed"), tstNoToken())
+
+	docs.Then("then the request is successful, so the payment provider does not retry")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the second payment has not been booked")
+	require.Equal(t, 1, len(paymentMock.Recording()))
+
+	docs.Then("and the overpayment has been alerted")
+	expNotif := tstExpectedMailNotification("webhook", "paid-amount-mismatch")
+	expNotif.Variables["referenceId"] = "221216-122218-000003"
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{expNotif})
+}
+
+func TestWebhook_Success_PendingAfterValid(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment service already has a valid transaction")
+	tstInjectBookedPayment()
+
+	docs.Given("and the payment provider reports a payment in progress")
+	concardisMock.ManipulateStatus(42, "waiting")
+
+	docs.When("when the webhook is triggered")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the valid transaction has not been moved back to pending")
+	tstRequirePaymentServiceRecording(t, nil)
+}
+
+func TestWebhook_Refund_Status(t *testing.T) {
+	for _, status := range []string{"refunded", "partially-refunded", "chargeback"} {
+		testname := fmt.Sprintf("Status_%s", status)
+		t.Run(testname, func(t *testing.T) {
+			tstSetup(tstConfigFile)
+			defer tstShutdown()
+
+			docs.Given(fmt.Sprintf("given the payment provider reports a paylink with a transaction in status %s", status))
+			concardisMock.ManipulateTransactions(42, status, 300)
+			tstInjectBookedPayment()
+
+			docs.When("when an anonymous caller who knows the secret url triggers our webhook endpoint")
+			response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+
+			docs.Then("then the request is successful")
+			require.Equal(t, http.StatusOK, response.status)
+
+			comment := "CC refund orderId d3adb33f (reported by webhook)"
+			if status == "chargeback" {
+				comment = "CC chargeback orderId d3adb33f"
+			}
+			docs.Then("and a matching negative transaction has been booked in the payment service")
+			tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+				tstExpectedRefundBooking(-300, comment),
+			})
+
+			docs.Then("and no error notification emails have been sent")
+			tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+
+			docs.Then("and the expected protocol entries have been written, with the status as kind")
+			tstRequireProtocolEntries(t, entity.ProtocolEntry{
+				ReferenceId: "221216-122218-000001",
+				ApiId:       42,
+				Kind:        "success",
+				Message:     "webhook query-pay-link",
+				Details:     fmt.Sprintf("status=%s amount=390", status),
+			}, entity.ProtocolEntry{
+				ReferenceId: "221216-122218-000001",
+				ApiId:       42,
+				Kind:        status,
+				Message:     "webhook book-refund",
+				Details:     "transaction id=4711 amount=390 refunded=300 booked=0",
+			})
+		})
+	}
+}
+
+func TestWebhook_Refund_ChargebackWithoutAmount(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given the payment provider reports a chargeback that does not list a refunded amount")
+	concardisMock.ManipulateTransactions(42, "chargeback", 0)
+	tstInjectBookedPayment()
+
+	docs.When("when an anonymous caller who knows the secret url triggers our webhook endpoint")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the whole transaction amount has been booked back in the payment service")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		tstExpectedRefundBooking(-390, "CC chargeback orderId d3adb33f"),
+	})
+}
+
+func TestWebhook_Refund_PartialTwice(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a partial refund was made in the back office and already reported by the webhook")
+	concardisMock.ManipulateTransactions(42, "partially-refunded", 100)
+	tstInjectBookedPayment()
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("partially-refunded", 100), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Given("and another partial refund was made in the back office")
+	concardisMock.ManipulateTransactions(42, "partially-refunded", 250)
+
+	docs.When("when the webhook is triggered again")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("partially-refunded", 250), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and only the difference has been booked the second time")
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		tstExpectedRefundBooking(-100, "CC refund orderId d3adb33f (reported by webhook)"),
+		tstExpectedRefundBooking(-150, "CC refund orderId d3adb33f (reported by webhook)"),
+	})
+}
+
+func TestWebhook_Refund_AlreadyBookedByApi(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a paylink that was refunded through our api")
+	tstInjectBookedPayment()
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", "", tstValidApiToken())
+	require.Equal(t, http.StatusNoContent, response.status)
+	concardisMock.ManipulateStatus(42, "refunded")
+	paymentMock.Reset()
+
+	docs.When("when the payment provider reports the refund through our webhook")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the refund has not been booked a second time")
+	tstRequirePaymentServiceRecording(t, nil)
+
+	docs.Then("and no error notification emails have been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "refund-pay-link",
+		Details:     "transaction id=4711 status=refunded amount=390 refunded=390 reason=",
+	}, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "webhook query-pay-link",
+		Details:     "status=refunded amount=390",
+	}, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "refunded",
+		Message:     "webhook refund already booked",
+		Details:     "transaction id=4711 amount=390 refunded=390 booked=390",
+	})
+}
+
+func TestWebhook_Refund_PendingThenRefunded(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a payment service that assigns its own transaction identifiers")
+	paymentMock.SimulateGeneratedIds(true)
+
+	docs.Given("and a paylink that was partially refunded through our api, but the bank has not confirmed the refund yet")
+	tstInjectBookedPayment()
+	concardisMock.SimulateRefundPending(true)
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", tstRenderJson(cncrdapi.PaymentLinkRefundRequestDto{Amount: 150}), tstValidApiToken())
+	require.Equal(t, http.StatusNoContent, response.status)
+
+	docs.Given("and the bank then confirms the refund")
+	concardisMock.ManipulateTransactions(42, "partially-refunded", 150)
+
+	docs.When("when the payment provider reports the refund through our webhook")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("partially-refunded", 150), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the pending refund has been promoted to valid in the payment service, without booking it a second time")
+	pending := tstExpectedRefundBooking(-150, "CC refund orderId d3adb33f")
+	pending.ID = "mock-generated-id-1"
+	pending.Status = paymentservice.Pending
+	confirmed := pending
+	confirmed.Status = paymentservice.Valid
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		pending,
+		confirmed,
+	})
+
+	docs.Then("and no error notification emails have been sent")
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{})
+
+	docs.Then("and the expected protocol entries have been written")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "refund-pay-link",
+		Details:     "transaction id=4711 status=refund_pending amount=150 refunded=150 reason=",
+	}, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "webhook query-pay-link",
+		Details:     "status=partially-refunded amount=390",
+	}, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "partially-refunded",
+		Message:     "webhook confirm-refund",
+		Details:     "transaction id=4711 amount=390 refunded=150 booked=150",
+	})
+}
+
+func TestWebhook_Refund_PendingNotFound(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a paylink that was partially refunded through our api while the payment service could not be queried")
+	tstInjectBookedPayment()
+	concardisMock.SimulateRefundPending(true)
+	paymentMock.SimulateGetError(paymentservice.DownstreamError)
+	response := tstPerformPost("/api/rest/v1/paylinks/42/refund", tstRenderJson(cncrdapi.PaymentLinkRefundRequestDto{Amount: 150}), tstValidApiToken())
+	require.Equal(t, http.StatusNoContent, response.status)
+	paymentMock.SimulateGetError(nil)
+
+	docs.Given("and the bank then confirms the refund")
+	concardisMock.ManipulateTransactions(42, "partially-refunded", 150)
+
+	docs.When("when the payment provider reports the refund through our webhook")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("partially-refunded", 150), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the refund has been booked as pending only once")
+	pending := tstExpectedRefundBooking(-150, "CC refund orderId d3adb33f")
+	pending.Status = paymentservice.Pending
+	tstRequirePaymentServiceRecording(t, []paymentservice.Transaction{
+		pending,
+	})
+
+	docs.Then("and an error notification email has been sent, so someone confirms the refund manually")
+	expNotif := tstExpectedMailNotification("refund-pay-link", "find-refund-err")
+	expNotif.Variables["referenceId"] = "refId: 221216-122218-000001"
+	tstRequireMailServiceRecording(t, []mailservice.MailSendDto{
+		expNotif,
+	})
+}
+
+func TestWebhook_Duplicate(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a webhook delivery that has already been processed successfully")
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+	require.Equal(t, http.StatusOK, response.status)
+	concardisMock.Reset()
+	paymentMock.Reset()
+
+	docs.When("when the payment provider delivers it again")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the payment provider has not been queried again")
+	tstRequireConcardisRecording(t)
+
+	docs.Then("and no requests to the payment service have been made")
+	tstRequirePaymentServiceRecording(t, nil)
+
+	docs.Then("and the duplicate has been protocolled")
+	tstRequireProtocolEntries(t, entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "webhook query-pay-link",
+		Details:     "status=confirmed amount=390",
+	}, tstBookingProtocol(paymentservice.Valid, paymentlinksrv.BookingUpdated), entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "duplicate",
+		Message:     "webhook duplicate",
+		Details:     "transaction id=1892362736 status=confirmed refunded=0 outcome=success",
+	})
+}
+
+func TestWebhook_RetryAfterFailure(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a webhook delivery that failed because the payment provider was down")
+	concardisMock.SimulateError(concardis.DownstreamError)
+	response := tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+	require.Equal(t, http.StatusBadGateway, response.status)
+	concardisMock.Reset()
+	mailMock.Reset()
+
+	docs.When("when the payment provider retries the delivery")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", tstBuildWebhookRequest("confirmed", 0), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the delivery has been processed")
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+	)
+	require.Equal(t, 1, len(paymentMock.Recording()))
+}
+
+func TestWebhook_UpdatesStoredStatus(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+
+	docs.Given("given a payment link that was created through this service")
+	response := tstPerformPost("/api/rest/v1/paylinks", tstRenderJson(tstBuildValidPaymentLinkRequest()), tstValidApiToken())
+	require.Equal(t, http.StatusCreated, response.status)
+
+	docs.When("when Concardis calls our webhook because the payment link has been paid")
+	concardisMock.ManipulateStatus(101, "confirmed")
+	response = tstPerformPost("/api/rest/v1/webhook/demosecret", `{"transaction":{"id":1892362737,"status":"confirmed","invoice":{"paymentRequestId":101,"referenceId":"221216-122218-000001"}}}`, tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the status of the locally stored payment link has been updated")
+	expected := tstBuildValidStoredPaylink()
+	expected.Status = "confirmed"
+	tstRequireStoredPaylink(t, 101, expected)
+}
+
 func TestWebhook_InvalidJson(t *testing.T) {
 	tstSetup(tstConfigFile)
 	defer tstShutdown()
@@ -122,6 +955,109 @@ func TestWebhook_WrongSecret(t *testing.T) {
 	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", nil)
 }
 
+func TestWebhook_Signature_Success(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstSetWebhookSecurityMode(config.WebhookModeSignature)
+
+	docs.Given("given an anonymous caller who knows the api secret")
+	url := "/api/rest/v1/webhook"
+	body := tstBuildValidWebhookRequest()
+
+	docs.When("when they trigger our webhook endpoint with a correctly signed request")
+	response := tstPerformPostWithHeader(url, body, "X-Webhook-Signature", concardis.WebhookSignature([]byte(body)), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+
+	docs.Then("and the expected downstream requests have been made to the concardis api")
+	tstRequireConcardisRecording(t,
+		"QueryPaymentLink 42",
+	)
+}
+
+func TestWebhook_Signature_Missing(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstSetWebhookSecurityMode(config.WebhookModeSignature)
+
+	docs.Given("given an anonymous caller who knows the secret url")
+	url := "/api/rest/v1/webhook/demosecret"
+
+	docs.When("when they attempt to trigger our webhook endpoint without a signature")
+	response := tstPerformPost(url, tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "webhook.signature.invalid", "missing signature")
+
+	docs.Then("and no downstream requests have been made to the concardis api")
+	tstRequireConcardisRecording(t)
+}
+
+func TestWebhook_Signature_Invalid(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstSetWebhookSecurityMode(config.WebhookModeSignature)
+
+	docs.Given("given an anonymous caller who signed a different body")
+	url := "/api/rest/v1/webhook"
+	signature := concardis.WebhookSignature([]byte(`{"transaction":{"id":1}}`))
+
+	docs.When("when they attempt to trigger our webhook endpoint")
+	response := tstPerformPostWithHeader(url, tstBuildValidWebhookRequest(), "X-Webhook-Signature", signature, tstNoToken())
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "webhook.signature.invalid", "invalid signature")
+
+	docs.Then("and no downstream requests have been made to the concardis api")
+	tstRequireConcardisRecording(t)
+}
+
+func TestWebhook_Both_UnsignedWithSecret(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstSetWebhookSecurityMode(config.WebhookModeBoth)
+
+	docs.Given("given an anonymous caller who knows the secret url, but does not sign requests")
+	url := "/api/rest/v1/webhook/demosecret"
+
+	docs.When("when they trigger our webhook endpoint with valid information")
+	response := tstPerformPost(url, tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request is successful")
+	require.Equal(t, http.StatusOK, response.status)
+}
+
+func TestWebhook_Both_InvalidSignatureWithSecret(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstSetWebhookSecurityMode(config.WebhookModeBoth)
+
+	docs.Given("given an anonymous caller who knows the secret url")
+	url := "/api/rest/v1/webhook/demosecret"
+
+	docs.When("when they attempt to trigger our webhook endpoint with an invalid signature")
+	response := tstPerformPostWithHeader(url, tstBuildValidWebhookRequest(), "X-Webhook-Signature", "aW52YWxpZA==", tstNoToken())
+
+	docs.Then("then the request fails with the appropriate error, the secret does not override a bad signature")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "webhook.signature.invalid", "invalid signature")
+}
+
+func TestWebhook_Both_WrongSecret(t *testing.T) {
+	tstSetup(tstConfigFile)
+	defer tstShutdown()
+	tstSetWebhookSecurityMode(config.WebhookModeBoth)
+
+	docs.Given("given an anonymous caller who neither knows the secret url nor signs requests")
+	url := "/api/rest/v1/webhook/wrongsecret"
+
+	docs.When("when they attempt to trigger our webhook endpoint")
+	response := tstPerformPost(url, tstBuildValidWebhookRequest(), tstNoToken())
+
+	docs.Then("then the request fails with the appropriate error")
+	tstRequireErrorResponse(t, response, http.StatusUnauthorized, "auth.unauthorized", nil)
+}
+
 func TestWebhook_DownstreamError(t *testing.T) {
 	tstSetup(tstConfigFile)
 	defer tstShutdown()
@@ -193,12 +1129,97 @@ func TestWebhook_Success_Status_WrongPrefix(t *testing.T) {
 		ApiId:       4242,
 		Kind:        "error",
 		Message:     "webhook ref-id-prefix",
-		Details:     "ref-id=230001-122218-000001",
+		Details:     "ref-id=230001-122218-000001 does not match reference_id_pattern",
 	})
 }
 
 // --- helpers ---
 
+func tstInjectStoredPaylink(apiId uint, amountDue int64) {
+	stored := tstBuildValidStoredPaylink()
+	stored.ApiId = apiId
+	stored.AmountDue = amountDue
+	_ = database.GetRepository().WritePaylink(context.Background(), &stored)
+}
+
+func tstAmountMismatchProtocol(details string) []entity.ProtocolEntry {
+	return []entity.ProtocolEntry{
+		{
+			ReferenceId: "221216-122218-000001",
+			ApiId:       42,
+			Kind:        "success",
+			Message:     "webhook query-pay-link",
+			Details:     "status=confirmed amount=390",
+		},
+		{
+			ReferenceId: "221216-122218-000001",
+			ApiId:       42,
+			Kind:        "mismatch",
+			Message:     "webhook amount-mismatch",
+			Details:     details,
+		},
+	}
+}
+
+func tstBookingProtocol(status paymentservice.TransactionStatus, outcome paymentlinksrv.BookingOutcome) entity.ProtocolEntry {
+	return entity.ProtocolEntry{
+		ReferenceId: "221216-122218-000001",
+		ApiId:       42,
+		Kind:        "success",
+		Message:     "booking " + string(outcome),
+		Details:     fmt.Sprintf("requested=%s", status),
+	}
+}
+
+func tstInjectBookedPayment() {
+	_ = paymentMock.InjectTransaction(context.Background(), paymentservice.Transaction{
+		ID:        "221216-122218-000001",
+		DebitorID: 1,
+		Status:    paymentservice.Valid,
+	})
+}
+
+func tstExpectedRefundBooking(grossCent int64, comment string) paymentservice.Transaction {
+	return paymentservice.Transaction{
+		DebitorID: 1,
+		Type:      paymentservice.Payment,
+		Method:    paymentservice.Credit,
+		Amount: paymentservice.Amount{
+			Currency:  "EUR",
+			GrossCent: grossCent,
+		},
+		Comment:       comment,
+		Status:        paymentservice.Valid,
+		EffectiveDate: "2022-12-16",
+		DueDate:       "2022-12-16",
+	}
+}
+
+func tstExpectedPendingTransaction(status string) paymentservice.Transaction {
+	return paymentservice.Transaction{
+		ID:     "mock-transaction-id",
+		Method: paymentservice.Credit,
+		Amount: paymentservice.Amount{
+			Currency:  "EUR",
+			GrossCent: 390,
+		},
+		Status:        paymentservice.Pending,
+		EffectiveDate: "2023-01-08",
+		Comment:       "CC orderId d3adb33f",
+		StatusHistory: []paymentservice.StatusHistory{
+			{
+				Status:     paymentservice.Pending,
+				Comment:    "Concardis status " + status,
+				ChangeDate: tstMockNow(),
+			},
+		},
+	}
+}
+
+func tstSetWebhookSecurityMode(mode config.WebhookMode) {
+	config.Configuration().Security.Webhook.Mode = mode
+}
+
 func tstWebhookSuccessCase(t *testing.T, status string, expectedPaymentServiceRecording []paymentservice.Transaction, expectedMailRecording []mailservice.MailSendDto, expectedProtocol []entity.ProtocolEntry) {
 	tstSetup(tstConfigFile)
 	defer tstShutdown()
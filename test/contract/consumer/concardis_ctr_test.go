@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	auzerolog "github.com/StephanHCB/go-autumn-logging-zerolog"
 	aurestclientapi "github.com/StephanHCB/go-autumn-restclient/api"
 	aurestverifier "github.com/StephanHCB/go-autumn-restclient/implementation/verifier"
@@ -13,6 +14,7 @@ import (
 	"github.com/eurofurence/reg-payment-cncrd-adapter/internal/repository/database/inmemorydb"
 	"github.com/stretchr/testify/require"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 )
@@ -338,3 +340,216 @@ func tstRequireProtocolEntries(t *testing.T, expectedProtocol ...entity.Protocol
 		require.Equal(t, expected.Details, actual.Details)
 	}
 }
+
+func TestConcardisApiClientTransactions(t *testing.T) {
+	auzerolog.SetupPlaintextLogging()
+
+	db := inmemorydb.Create()
+	database.SetRepository(db)
+
+	docs.Given("given the concardis adapter is correctly configured (not in local mock mode)")
+	config.LoadTestingConfigurationFromPathOrAbort("../../resources/testconfig.yaml")
+
+	// prepare dtos
+
+	timeGreaterThan := time.Date(2022, 10, 15, 0, 0, 0, 0, time.UTC)
+	timeLessThan := time.Date(2022, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	// the first page is full, so the client must ask for the second page
+	firstPageEntries := make([]string, 100)
+	for i := range firstPageEntries {
+		firstPageEntries[i] = fmt.Sprintf(`{"id":%d,"uuid":"%08x","amount":10550,"referenceId":"220118-150405-%06d","time":"2022-10-15 15:50:20","status":"confirmed","payment":{"brand":"visa"},"invoice":{"referenceId":"220118-150405-%06d","paymentRequestId":%d,"currency":"EUR","originalAmount":10550,"refundedAmount":0}}`, 1000+i, i, i, i, 42+i)
+	}
+	firstPageResponse := `{"status":"success","data":[` + strings.Join(firstPageEntries, ",") + `]}`
+	secondPageResponse := `{
+  "status": "success",
+  "data": [
+    {
+      "id": 777777,
+      "uuid": "b9bee580",
+      "amount": 10550,
+      "referenceId": "220118-150405-000004",
+      "time": "2022-10-15 16:01:02",
+      "status": "confirmed",
+      "lang": "de",
+      "psp": "ConCardis_PayEngine_3",
+      "pspId": 29,
+      "mode": "TEST",
+      "payment": {
+        "brand": "visa"
+      },
+      "invoice": {
+        "referenceId": "220118-150405-000004",
+        "paymentRequestId": 424242,
+        "currency": "EUR",
+        "originalAmount": 10550,
+        "refundedAmount": 0
+      }
+    }
+  ]
+}`
+
+	ctx := auzerolog.AddLoggerToCtx(context.Background())
+
+	// set a server url so local simulator mode is off
+	config.Configuration().Service.ConcardisDownstream = "http://localhost:8000"
+
+	docs.When("when transactions are requested for a time window that spans more than one page")
+	docs.Then("then all pages are requested and the combined result is returned")
+
+	verifierClient, verifierImpl := aurestverifier.New()
+	verifierImpl.AddExpectation(aurestverifier.Request{
+		Name:   "query-transactions-page-1",
+		Method: http.MethodGet,
+		Header: http.Header{ // not verified
+			"Content-Type": []string{"application/x-www-form-urlencoded"},
+		},
+		Url:  "http://localhost:8000/v1.0/Transaction/?instance=myinstance",
+		Body: `filterDatetimeUtcGreaterThan=2022-10-15%2000:00:00&filterDatetimeUtcLessThan=2022-10-16%2000:00:00&offset=0&limit=100&ApiSignature=omitted`,
+	}, aurestclientapi.ParsedResponse{
+		Body:   firstPageResponse,
+		Status: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Time: time.Time{},
+	}, nil)
+	verifierImpl.AddExpectation(aurestverifier.Request{
+		Name:   "query-transactions-page-2",
+		Method: http.MethodGet,
+		Header: http.Header{ // not verified
+			"Content-Type": []string{"application/x-www-form-urlencoded"},
+		},
+		Url:  "http://localhost:8000/v1.0/Transaction/?instance=myinstance",
+		Body: `filterDatetimeUtcGreaterThan=2022-10-15%2000:00:00&filterDatetimeUtcLessThan=2022-10-16%2000:00:00&offset=100&limit=100&ApiSignature=omitted`,
+	}, aurestclientapi.ParsedResponse{
+		Body:   secondPageResponse,
+		Status: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Time: time.Time{},
+	}, nil)
+
+	// set up downstream client
+	client := concardis.NewTestingClient(verifierClient)
+	// verifier does not support regex matchers for x-www-form-urlencoded
+	concardis.FixedSignatureValue = "omitted"
+
+	transactions, err := client.QueryTransactions(ctx, timeGreaterThan, timeLessThan)
+	require.Nil(t, err)
+	require.Equal(t, 101, len(transactions))
+	require.Equal(t, int64(1000), transactions[0].ID)
+	last := transactions[100]
+	require.Equal(t, int64(777777), last.ID)
+	require.Equal(t, "b9bee580", last.UUID)
+	require.Equal(t, "confirmed", last.Status)
+	require.Equal(t, uint(424242), last.Invoice.PaymentRequestId)
+	require.Equal(t, "visa", last.Payment.Brand)
+
+	docs.Then("and the expected interactions have occurred in the correct order")
+	require.Nil(t, verifierImpl.FirstUnexpectedOrNil())
+}
+
+func TestConcardisApiClientRefund(t *testing.T) {
+	auzerolog.SetupPlaintextLogging()
+
+	db := inmemorydb.Create()
+	database.SetRepository(db)
+
+	docs.Given("given the concardis adapter is correctly configured (not in local mock mode)")
+	config.LoadTestingConfigurationFromPathOrAbort("../../resources/testconfig.yaml")
+
+	refundResponse := `{
+  "status": "success",
+  "data": [
+    {
+      "id": 777777,
+      "uuid": "b9bee580",
+      "amount": 10550,
+      "referenceId": "220118-150405-000004",
+      "time": "2022-10-15 15:50:20",
+      "status": "partially-refunded",
+      "lang": "de",
+      "psp": "ConCardis_PayEngine_3",
+      "pspId": 29,
+      "mode": "TEST",
+      "payment": {
+        "brand": "visa"
+      },
+      "invoice": {
+        "referenceId": "220118-150405-000004",
+        "paymentRequestId": 42,
+        "currency": "EUR",
+        "originalAmount": 10550,
+        "refundedAmount": 5000
+      }
+    }
+  ]
+}`
+
+	fullRefundResponse := strings.ReplaceAll(strings.ReplaceAll(refundResponse,
+		`"status": "partially-refunded"`, `"status": "refunded"`),
+		`"refundedAmount": 5000`, `"refundedAmount": 10550`)
+
+	ctx := auzerolog.AddLoggerToCtx(context.Background())
+
+	// set a server url so local simulator mode is off
+	config.Configuration().Service.ConcardisDownstream = "http://localhost:8000"
+
+	docs.When("when a partial refund is requested for a transaction, followed by a refund of the rest")
+	docs.Then("then both requests are successful and the refunded transaction is returned")
+
+	verifierClient, verifierImpl := aurestverifier.New()
+	verifierImpl.AddExpectation(aurestverifier.Request{
+		Name:   "refund-transaction",
+		Method: http.MethodPost,
+		Header: http.Header{ // not verified
+			"Content-Type": []string{"application/x-www-form-urlencoded"},
+		},
+		Url:  "http://localhost:8000/v1.0/Transaction/777777/refund/?instance=myinstance",
+		Body: `amount=5000&ApiSignature=omitted`,
+	}, aurestclientapi.ParsedResponse{
+		Body:   refundResponse,
+		Status: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Time: time.Time{},
+	}, nil)
+	verifierImpl.AddExpectation(aurestverifier.Request{
+		Name:   "refund-transaction-rest",
+		Method: http.MethodPost,
+		Header: http.Header{ // not verified
+			"Content-Type": []string{"application/x-www-form-urlencoded"},
+		},
+		Url:  "http://localhost:8000/v1.0/Transaction/777777/refund/?instance=myinstance",
+		Body: `ApiSignature=omitted`,
+	}, aurestclientapi.ParsedResponse{
+		Body:   fullRefundResponse,
+		Status: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Time: time.Time{},
+	}, nil)
+
+	// set up downstream client
+	client := concardis.NewTestingClient(verifierClient)
+	// verifier does not support regex matchers for x-www-form-urlencoded
+	concardis.FixedSignatureValue = "omitted"
+
+	refunded, err := client.RefundTransaction(ctx, 777777, 5000)
+	require.Nil(t, err)
+	require.Equal(t, int64(777777), refunded.ID)
+	require.Equal(t, "partially-refunded", refunded.Status)
+	require.Equal(t, int64(5000), refunded.Invoice.RefundedAmount)
+
+	refunded, err = client.RefundTransaction(ctx, 777777, 0)
+	require.Nil(t, err)
+	require.Equal(t, "refunded", refunded.Status)
+	require.Equal(t, int64(10550), refunded.Invoice.RefundedAmount)
+
+	docs.Then("and the expected interactions have occurred in the correct order")
+	require.Nil(t, verifierImpl.FirstUnexpectedOrNil())
+}